@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// albumManifestName is the name of the manifest written to each album folder.
+const albumManifestName = "album.json"
+
+// Album is a Google Photos album among the incoming files: a directory with the album's metadata, whose media files are its members.
+type Album struct {
+	Title        string
+	Description  string
+	Date         time.Time
+	Dir          string
+	MetadataPath string
+}
+
+// AlbumManifest records the members of an album folder, and where each came from.
+type AlbumManifest struct {
+	Title       string              `json:"title"`
+	Description string              `json:"description,omitempty"`
+	Date        string              `json:"date,omitempty"`
+	Source      string              `json:"source"` // the incoming album directory
+	Files       []AlbumManifestFile `json:"files"`
+}
+
+// AlbumManifestFile records a link in an album folder.
+type AlbumManifestFile struct {
+	Link   string `json:"link"`   // relative to the album folder
+	Target string `json:"target"` // the file in the library
+	Source string `json:"source"` // the incoming file
+}
+
+// albumMetadataJSON is the album metadata written by Takeout, named metadata.json or a localized variant (e.g. metadati.json).  Unlike the sidecar of a media file, it has a date but no photoTakenTime.
+type albumMetadataJSON struct {
+	Title          string               `json:"title"`
+	Description    string               `json:"description"`
+	Date           *googleTimestampJSON `json:"date"`
+	PhotoTakenTime *googleTimestampJSON `json:"photoTakenTime"`
+}
+
+// findAlbums finds the album directories within the specified directory, by their metadata.
+func findAlbums(dirPath string) ([]Album, error) {
+	var result []Album
+	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.EqualFold(filepath.Ext(path), ".json") {
+			return nil
+		}
+		if album, isAlbum := readAlbumMetadata(path); isAlbum {
+			result = append(result, album)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// readAlbumMetadata parses the file as album metadata, returning false if it's something else, such as the sidecar of a media file.  An album without a title is named after its directory.
+func readAlbumMetadata(filePath string) (Album, bool) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		log.Println("[WARN]", "Failed to read", filePath, ":", err)
+		return Album{}, false
+	}
+	var metadata albumMetadataJSON
+	if err := json.Unmarshal(content, &metadata); err != nil || metadata.Date == nil || metadata.PhotoTakenTime != nil {
+		return Album{}, false
+	}
+	result := Album{Title: metadata.Title, Description: metadata.Description, Dir: filepath.Dir(filePath), MetadataPath: filePath}
+	if len(result.Title) == 0 {
+		result.Title = filepath.Base(result.Dir)
+	}
+	if date, err := metadata.Date.parse(); err == nil {
+		result.Date = date
+	}
+	return result, true
+}
+
+// albumFolderName returns a name for the folder of the album, from its title made safe for use as a file name.
+func albumFolderName(album Album) string {
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == 0 {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(album.Title))
+	if len(name) == 0 || name == "." || name == ".." {
+		return filepath.Base(album.Dir)
+	}
+	return name
+}
+
+// linkAlbums creates a folder of links for each album, to the files in the library holding the content of its members: where they were sorted to, or the library files kept instead of duplicates.  Members that didn't end up in the library, such as trashed files, are left out.  Each folder gets a manifest of its links.
+func (sorter PicSorter) linkAlbums(albums []Album) {
+	entries := sorter.report.EntriesByPath()
+	for _, album := range albums {
+		var memberPaths []string
+		for path := range entries {
+			if filepath.Dir(path) == album.Dir && path != album.MetadataPath && !strings.EqualFold(filepath.Ext(path), ".json") {
+				memberPaths = append(memberPaths, path)
+			}
+		}
+		sort.Strings(memberPaths)
+
+		folderPath := filepath.Join(sorter.albumsDir, albumFolderName(album))
+		log.Println("[INFO]", "Linking", len(memberPaths), "members of album", album.Title, "in", folderPath)
+		manifest := AlbumManifest{Title: album.Title, Description: album.Description, Source: album.Dir, Files: []AlbumManifestFile{}}
+		if !album.Date.IsZero() {
+			manifest.Date = album.Date.UTC().Format(time.RFC3339)
+		}
+		for _, memberPath := range memberPaths {
+			targetPath := sorter.libraryPathOf(entries[memberPath])
+			if len(targetPath) == 0 {
+				log.Println("[DEBUG]", "Leaving", memberPath, "out of album", album.Title, "since its outcome is", entries[memberPath].Outcome)
+				continue
+			}
+			linkPath, err := sorter.fileMover.CreateLink(filepath.Join(folderPath, filepath.Base(targetPath)), targetPath, sorter.linkType == linkTypeSymlink)
+			if err != nil {
+				log.Println("[WARN]", memberPath, "Failed to link into album", album.Title, ":", err)
+				continue
+			}
+			manifest.Files = append(manifest.Files, AlbumManifestFile{Link: filepath.Base(linkPath), Target: targetPath, Source: memberPath})
+		}
+
+		content, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			log.Println("[WARN]", "Failed to write manifest of album", album.Title, ":", err)
+			continue
+		}
+		if _, err := sorter.fileMover.CreateFile(filepath.Join(folderPath, albumManifestName), bytes.NewReader(content), time.Time{}); err != nil {
+			log.Println("[WARN]", "Failed to write manifest of album", album.Title, ":", err)
+		}
+	}
+}
+
+// libraryPathOf returns the library file holding the content of the reported incoming file, or "" if there is none.
+func (sorter PicSorter) libraryPathOf(entry SortReportEntry) string {
+	libraryPath := ""
+	switch entry.Outcome {
+	case outcomeSorted:
+		libraryPath = entry.Destination
+	case outcomeDuplicate, outcomeSimilar:
+		libraryPath = entry.Kept
+	}
+	if len(libraryPath) == 0 {
+		return ""
+	}
+	// A duplicate of an incoming file that wasn't sorted has no copy in the library.
+	if relPath, err := filepath.Rel(sorter.libDir, libraryPath); err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	return libraryPath
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// archiveExtensions lists the extensions of Google Takeout archives, which are sorted straight out of the archive.
+var archiveExtensions = []string{".zip", ".tgz", ".tar.gz", ".tar"}
+
+// takeoutArchivePrefix begins the name of every Google Takeout archive (e.g. takeout-20230101T000000Z-001.zip).  Other archives are left alone, as unsupported files.
+const takeoutArchivePrefix = "takeout-"
+
+// archivePartRegex matches the part number of a multi-part archive, e.g. "-001" in "takeout-20230101T000000Z-001.zip".
+var archivePartRegex = regexp.MustCompile(`-\d{3}$`)
+
+// archiveGroup is an archive to be sorted, made up of one or more parts (e.g. takeout-20230101T000000Z-001.zip and -002.zip) that are extracted into the same staging directory, so that the sidecars in one part are found for the media in another.
+type archiveGroup struct {
+	stagingDir   string         // next to the archive
+	partPaths    []string       // sorted by path
+	incomingDir  string         // to which the path of each part is relative
+	fileRoot     string         // the root of the incoming directory, or of the scratch directory of a dry run
+	extractDir   string         // the staging directory, or its counterpart within the scratch directory of a dry run
+	sidecarPaths []string       // the JSON files extracted, which are moved with the unsupported files once every media file is sorted
+	entryCounts  map[string]int // the number of files extracted, by part
+	failedParts  map[string]bool
+}
+
+// archiveExtension returns the extension of the specified archive, or "" if the file is not an archive.
+func archiveExtension(filePath string) string {
+	lowerFilePath := strings.ToLower(filePath)
+	for _, extension := range archiveExtensions {
+		if strings.HasSuffix(lowerFilePath, extension) {
+			return extension
+		}
+	}
+	return ""
+}
+
+// isTakeoutArchive determines by its name and extension whether the file is a Google Takeout archive, to be extracted.
+func isTakeoutArchive(filePath string) bool {
+	return strings.HasPrefix(strings.ToLower(filepath.Base(filePath)), takeoutArchivePrefix) && len(archiveExtension(filePath)) > 0
+}
+
+// isSidecarEntry determines by its extension whether the archive entry is a JSON file, such as a sidecar or album metadata.
+func isSidecarEntry(entryName string) bool {
+	return strings.EqualFold(filepath.Ext(entryName), ".json")
+}
+
+// archiveStagingDir returns the directory, next to the archive, into which it's extracted.  The directory is named after the archive without its part number, so that all parts of a multi-part archive are extracted together.
+func archiveStagingDir(archivePath string) string {
+	name := filepath.Base(archivePath)
+	name = name[:len(name)-len(archiveExtension(name))]
+	return filepath.Join(filepath.Dir(archivePath), archivePartRegex.ReplaceAllString(name, ""))
+}
+
+// findArchiveGroups finds the Google Takeout archives in the specified directory, grouping the parts of each multi-part archive, in order of their staging directories.  Each is to be extracted relative to extractRoot, which is the directory itself unless this is a dry run.
+func findArchiveGroups(dirPath string, extractRoot string) ([]*archiveGroup, error) {
+	groups := make(map[string]*archiveGroup)
+	var stagingDirs []string
+	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !isTakeoutArchive(path) {
+			return nil
+		}
+		stagingDir := archiveStagingDir(path)
+		group, isPresent := groups[stagingDir]
+		if !isPresent {
+			relPath, err := filepath.Rel(dirPath, stagingDir)
+			if err != nil {
+				return err
+			}
+			group = &archiveGroup{stagingDir: stagingDir, incomingDir: dirPath, fileRoot: extractRoot, extractDir: filepath.Join(extractRoot, relPath), entryCounts: make(map[string]int), failedParts: make(map[string]bool)}
+			groups[stagingDir] = group
+			stagingDirs = append(stagingDirs, stagingDir)
+		}
+		group.partPaths = append(group.partPaths, path)
+		return nil
+	})
+	sort.Strings(stagingDirs)
+	var result []*archiveGroup
+	for _, stagingDir := range stagingDirs {
+		sort.Strings(groups[stagingDir].partPaths)
+		result = append(result, groups[stagingDir])
+	}
+	return result, err
+}
+
+// extractArchiveSidecars extracts the JSON files of every part of the archive, and lists the media files in the sidecar resolver, so that the sidecar of each media file is found however the parts are ordered.  Parts that fail are reported, and left alone thereafter.
+func (sorter PicSorter) extractArchiveSidecars(group *archiveGroup) {
+	var mediaPaths []string
+	for _, partPath := range group.partPaths {
+		log.Println("[INFO]", "Extracting metadata from archive", partPath, "to", group.extractDir)
+		err := walkArchive(partPath, func(entryName string, modTime time.Time, content io.Reader) error {
+			entryPath, err := archiveEntryPath(group.extractDir, entryName)
+			if err != nil {
+				log.Println("[WARN]", "Skipping entry of", partPath, ":", err)
+				return nil
+			}
+			if !isSidecarEntry(entryName) {
+				mediaPaths = append(mediaPaths, entryPath)
+				return nil
+			}
+			sidecarPath, err := sorter.extractArchiveEntry(entryPath, content, modTime)
+			if err != nil {
+				return err
+			}
+			group.sidecarPaths = append(group.sidecarPaths, sidecarPath)
+			group.entryCounts[partPath]++
+			return nil
+		})
+		if err != nil {
+			log.Println("[WARN]", partPath, "Failed to extract archive:", err)
+			sorter.report.Add(SortReportEntry{Path: partPath, Outcome: outcomeFailed, Detail: err.Error()})
+			group.failedParts[partPath] = true
+		}
+	}
+	for _, mediaPath := range mediaPaths {
+		sorter.sidecarResolver.AddFile(mediaPath)
+	}
+}
+
+// sortArchive extracts the media files of each part of the archive one at a time, and sorts each before extracting the next, so that the archive's content never takes up space twice.  Once every part is sorted, its JSON files are moved with the unsupported files, and each part is moved to the archive directory.  A part that fails is left in place.
+func (sorter PicSorter) sortArchive(group *archiveGroup) {
+	for _, partPath := range group.partPaths {
+		if group.failedParts[partPath] {
+			continue
+		}
+		log.Println("[INFO]", "Sorting files from archive", partPath)
+		err := walkArchive(partPath, func(entryName string, modTime time.Time, content io.Reader) error {
+			if isSidecarEntry(entryName) {
+				return nil
+			}
+			entryPath, err := archiveEntryPath(group.extractDir, entryName)
+			if err != nil {
+				// Logged when extracting the sidecars.
+				return nil
+			}
+			filePath, err := sorter.extractArchiveEntry(entryPath, content, modTime)
+			if err != nil {
+				return err
+			}
+			sorter.sortExtractedFile(filePath, group.fileRoot)
+			group.entryCounts[partPath]++
+			return nil
+		})
+		if err != nil {
+			log.Println("[WARN]", partPath, "Failed to extract archive:", err)
+			sorter.report.Add(SortReportEntry{Path: partPath, Outcome: outcomeFailed, Detail: err.Error()})
+			group.failedParts[partPath] = true
+		}
+	}
+
+	for _, sidecarPath := range group.sidecarPaths {
+		sorter.moveUnsupported(sidecarPath, group.fileRoot)
+	}
+	for _, partPath := range group.partPaths {
+		if group.failedParts[partPath] {
+			continue
+		}
+		destPath, err := sorter.fileMover.MoveFileWithPreservedPath(partPath, group.incomingDir, sorter.archiveDir)
+		if err != nil {
+			log.Println("[WARN]", partPath, "Failed to move extracted archive:", err)
+			sorter.report.Add(SortReportEntry{Path: partPath, Outcome: outcomeFailed, Detail: err.Error()})
+			continue
+		}
+		sorter.report.Add(SortReportEntry{Path: partPath, Outcome: outcomeExtracted, Destination: destPath, Detail: "extracted " + strconv.Itoa(group.entryCounts[partPath]) + " files to " + group.stagingDir})
+	}
+}
+
+// sortExtractedFile sorts a file just extracted from an archive, moving it with the unsupported files if it can't be sorted.  In a dry run, the file is deleted once its hashes are derived, so that the files extracted later are still compared to it.
+func (sorter PicSorter) sortExtractedFile(filePath string, fileRoot string) {
+	candidate := sorter.prepare(filePath, fileRoot)
+	if candidate.isUnsupported {
+		sorter.moveUnsupported(filePath, fileRoot)
+	} else if !sorter.decide(candidate, fileRoot) {
+		log.Println("[INFO] Treating file as 'unsupported' due to lack of a date from any source", filePath)
+		sorter.moveUnsupported(filePath, fileRoot)
+	}
+	if sorter.isDryRun {
+		if err := sorter.deduper.HashFile(filePath); err != nil {
+			log.Println("[WARN]", filePath, "Failed to hash extracted file:", err)
+		}
+		if err := os.Remove(filePath); err != nil {
+			log.Println("[WARN]", "Failed to remove", filePath, ":", err)
+		}
+	}
+}
+
+// extractArchiveEntry writes the content of an archive entry to the given path, or to a numbered path if that's taken, and returns the path written.  In a dry run, the path is within a scratch directory, so the file is written regardless, and not journaled.
+func (sorter PicSorter) extractArchiveEntry(destPath string, content io.Reader, modTime time.Time) (string, error) {
+	if !sorter.isDryRun {
+		return sorter.fileMover.CreateFile(destPath, content, modTime)
+	}
+	if err := os.MkdirAll(filepath.Dir(destPath), os.ModePerm); err != nil {
+		return "", err
+	}
+	destPath, err := getNonCollidingPath(destPath)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.Create(destPath)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(file, content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && !modTime.IsZero() {
+		err = os.Chtimes(destPath, modTime, modTime)
+	}
+	return destPath, err
+}
+
+// walkArchive calls walkFn for each regular file in the archive, in the order stored, with the file's name within the archive, modification time, and content, stopping at the first error.
+func walkArchive(archivePath string, walkFn func(entryName string, modTime time.Time, content io.Reader) error) error {
+	switch archiveExtension(archivePath) {
+	case ".zip":
+		return walkZip(archivePath, walkFn)
+	case ".tgz", ".tar.gz":
+		return walkTar(archivePath, true, walkFn)
+	case ".tar":
+		return walkTar(archivePath, false, walkFn)
+	}
+	return errors.New("unsupported archive " + archivePath)
+}
+
+func walkZip(archivePath string, walkFn func(entryName string, modTime time.Time, content io.Reader) error) error {
+	reader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	for _, entry := range reader.File {
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		content, err := entry.Open()
+		if err != nil {
+			return err
+		}
+		err = walkFn(entry.Name, entry.Modified, content)
+		content.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkTar(archivePath string, isGzipped bool, walkFn func(entryName string, modTime time.Time, content io.Reader) error) error {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var content io.Reader = file
+	if isGzipped {
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		content = gzipReader
+	}
+	reader := tar.NewReader(content)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := walkFn(header.Name, header.ModTime, reader); err != nil {
+			return err
+		}
+	}
+}
+
+// archiveEntryPath returns the path within the given directory at which to extract the named archive entry, or an error if the name would lead outside the directory.
+func archiveEntryPath(destDir string, entryName string) (string, error) {
+	relPath := filepath.Clean(filepath.FromSlash(entryName))
+	if filepath.IsAbs(relPath) || relPath == "." || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", errors.New("invalid entry path '" + entryName + "'")
+	}
+	return filepath.Join(destDir, relPath), nil
+}
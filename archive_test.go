@@ -0,0 +1,144 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testArchiveEntries are the regular files written to each test archive, in order.
+var testArchiveEntries = []string{"Takeout/a.jpg.json", "Takeout/a.jpg", "Takeout/Trip/b.jpg"}
+
+func writeTestZip(t *testing.T, archivePath string) {
+	file, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer := zip.NewWriter(file)
+	if _, err := writer.Create("Takeout/"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range testArchiveEntries {
+		entry, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(entry, name)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestTarGz(t *testing.T, archivePath string) {
+	file, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gzipWriter := gzip.NewWriter(file)
+	writer := tar.NewWriter(gzipWriter)
+	if err := writer.WriteHeader(&tar.Header{Name: "Takeout/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range testArchiveEntries {
+		if err := writer.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(name)), ModTime: time.Unix(1562768659, 0)}); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(writer, name)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWalkArchive(t *testing.T) {
+	dirPath := t.TempDir()
+	zipPath := filepath.Join(dirPath, "takeout-001.zip")
+	tarPath := filepath.Join(dirPath, "takeout-002.tgz")
+	writeTestZip(t, zipPath)
+	writeTestTarGz(t, tarPath)
+	for _, archivePath := range []string{zipPath, tarPath} {
+		var names []string
+		err := walkArchive(archivePath, func(entryName string, modTime time.Time, content io.Reader) error {
+			data, err := ioutil.ReadAll(content)
+			if err != nil {
+				return err
+			}
+			if string(data) != entryName {
+				t.Errorf("%s: entry %s has content %q", archivePath, entryName, data)
+			}
+			names = append(names, entryName)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(names, testArchiveEntries) {
+			t.Errorf("%s: entries = %v, expected %v", archivePath, names, testArchiveEntries)
+		}
+	}
+}
+
+func TestFindArchiveGroups(t *testing.T) {
+	dirPath := t.TempDir()
+	for _, name := range []string{"takeout-20230101T000000Z-002.zip", "takeout-20230101T000000Z-001.zip", "Takeout-20240101T000000Z-001.tgz", "documents.zip", "photos.tar.gz", "photo.jpg"} {
+		writeTestFile(t, filepath.Join(dirPath, name), "")
+	}
+	groups, err := findArchiveGroups(dirPath, dirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 {
+		t.Fatalf("found %d groups, expected 2", len(groups))
+	}
+	if groups[0].extractDir != filepath.Join(dirPath, "Takeout-20240101T000000Z") || len(groups[0].partPaths) != 1 {
+		t.Errorf("group 0 = %+v", groups[0])
+	}
+	expectedParts := []string{filepath.Join(dirPath, "takeout-20230101T000000Z-001.zip"), filepath.Join(dirPath, "takeout-20230101T000000Z-002.zip")}
+	if groups[1].extractDir != filepath.Join(dirPath, "takeout-20230101T000000Z") || !reflect.DeepEqual(groups[1].partPaths, expectedParts) {
+		t.Errorf("group 1 = %+v", groups[1])
+	}
+
+	// A dry run extracts to the same relative path within the scratch directory.
+	scratchDir := t.TempDir()
+	groups, err = findArchiveGroups(dirPath, scratchDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups[1].extractDir != filepath.Join(scratchDir, "takeout-20230101T000000Z") || groups[1].stagingDir != filepath.Join(dirPath, "takeout-20230101T000000Z") {
+		t.Errorf("dry run group = %+v", groups[1])
+	}
+}
+
+func TestArchiveEntryPath(t *testing.T) {
+	destDir := filepath.Join("in", "takeout")
+	for entryName, expected := range map[string]string{
+		"Takeout/a.jpg":       filepath.Join(destDir, "Takeout", "a.jpg"),
+		"./Takeout/../b.jpg":  filepath.Join(destDir, "b.jpg"),
+		"../escape.jpg":       "",
+		"Takeout/../../x.jpg": "",
+		"/etc/passwd":         "",
+		".":                   "",
+	} {
+		actual, err := archiveEntryPath(destDir, entryName)
+		if len(expected) == 0 {
+			if err == nil {
+				t.Errorf("archiveEntryPath(%q) = %q, expected an error", entryName, actual)
+			}
+		} else if err != nil || actual != expected {
+			t.Errorf("archiveEntryPath(%q) = %q, %v, expected %q", entryName, actual, err, expected)
+		}
+	}
+}
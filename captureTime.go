@@ -0,0 +1,68 @@
+package main
+
+import "time"
+
+// CaptureTimeKind describes what is known about the zone of a CaptureTime.
+type CaptureTimeKind int
+
+const (
+	// CaptureTimeLocal is a wall clock reading whose zone is unknown (e.g. EXIF DateTimeOriginal without OffsetTimeOriginal).  It's stored as UTC and interpreted in the target location.
+	CaptureTimeLocal CaptureTimeKind = iota
+	// CaptureTimeZoned is a wall clock reading with the offset recorded by the device, which is preferred over the target location.
+	CaptureTimeZoned
+	// CaptureTimeInstant is an absolute point in time without a recorded offset (e.g. Google "photoTakenTime"), converted to the target location.
+	CaptureTimeInstant
+)
+
+// CaptureTime is the capture date of a media file, as found in one of its sources.
+type CaptureTime struct {
+	Time time.Time
+	Kind CaptureTimeKind
+}
+
+// NewLocalCaptureTime creates a CaptureTime from a wall clock reading with unknown zone.  The location of the given time is ignored.
+func NewLocalCaptureTime(wallClock time.Time) CaptureTime {
+	year, month, day := wallClock.Date()
+	hour, minute, second := wallClock.Clock()
+	return CaptureTime{
+		Time: time.Date(year, month, day, hour, minute, second, wallClock.Nanosecond(), time.UTC),
+		Kind: CaptureTimeLocal,
+	}
+}
+
+// NewZonedCaptureTime creates a CaptureTime from a time carrying the offset recorded by the device.
+func NewZonedCaptureTime(zoned time.Time) CaptureTime {
+	return CaptureTime{Time: zoned, Kind: CaptureTimeZoned}
+}
+
+// NewInstantCaptureTime creates a CaptureTime from an absolute point in time.
+func NewInstantCaptureTime(instant time.Time) CaptureTime {
+	return CaptureTime{Time: instant, Kind: CaptureTimeInstant}
+}
+
+// Localize returns the capture time as local time, using the given location unless the device recorded its offset.  The offset is determined per timestamp, so daylight saving time is honored.
+func (captureTime CaptureTime) Localize(location *time.Location) time.Time {
+	switch captureTime.Kind {
+	case CaptureTimeLocal:
+		wallClock := captureTime.Time
+		year, month, day := wallClock.Date()
+		hour, minute, second := wallClock.Clock()
+		return time.Date(year, month, day, hour, minute, second, wallClock.Nanosecond(), location)
+	case CaptureTimeZoned:
+		return captureTime.Time
+	default:
+		return captureTime.Time.In(location)
+	}
+}
+
+// String describes the capture time for logging.
+func (captureTime CaptureTime) String() string {
+	switch captureTime.Kind {
+	case CaptureTimeLocal:
+		return captureTime.Time.Format("2006-01-02 15:04:05") + " (local)"
+	case CaptureTimeZoned:
+		return captureTime.Time.Format("2006-01-02 15:04:05 -07:00") + " (recorded offset)"
+	default:
+		return captureTime.Time.UTC().String()
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DateExtractor extracts the capture date of a media file from one particular source.
+type DateExtractor interface {
+	// Name identifies the source, e.g. in the -datesources flag.
+	Name() string
+	// ExtractDate extracts the capture date of the given file, or returns an error if this source has none.
+	ExtractDate(mediaFile *MediaFile) (CaptureTime, error)
+}
+
+// DateExtractorRegistry holds the available date extractors by name.
+type DateExtractorRegistry struct {
+	extractors map[string]DateExtractor
+}
+
+// NewDateExtractorRegistry creates a registry containing the built-in date extractors.
+func NewDateExtractorRegistry() *DateExtractorRegistry {
+	result := new(DateExtractorRegistry)
+	result.extractors = make(map[string]DateExtractor)
+	result.Register(exifDateExtractor{})
+	result.Register(videoDateExtractor{})
+	result.Register(googleDateExtractor{})
+	result.Register(xmpDateExtractor{})
+	result.Register(mtimeDateExtractor{})
+	// Without user-defined patterns, this cannot fail.
+	filenameDateExtractor, _ := NewFilenameDateExtractor(nil)
+	result.Register(filenameDateExtractor)
+	return result
+}
+
+// Register adds the given extractor to the registry, replacing any extractor with the same name.
+func (registry DateExtractorRegistry) Register(extractor DateExtractor) {
+	registry.extractors[extractor.Name()] = extractor
+}
+
+// Names returns the names of all registered extractors, sorted.
+func (registry DateExtractorRegistry) Names() []string {
+	var result []string
+	for name := range registry.extractors {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Chain returns the extractors named in the given comma-separated list, in order of precedence.
+func (registry DateExtractorRegistry) Chain(names string) ([]DateExtractor, error) {
+	var result []DateExtractor
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		extractor, isPresent := registry.extractors[name]
+		if !isPresent {
+			return nil, errors.New("unknown date source '" + name + "', expected one of: " + strings.Join(registry.Names(), ", "))
+		}
+		result = append(result, extractor)
+	}
+	if len(result) == 0 {
+		return nil, errors.New("no date sources specified")
+	}
+	return result, nil
+}
+
+// exifDateExtractor extracts DateTimeOriginal (or DateTime) from the EXIF metadata of JPEG, TIFF, and HEIF files.
+type exifDateExtractor struct{}
+
+func (extractor exifDateExtractor) Name() string {
+	return "exif"
+}
+
+func (extractor exifDateExtractor) ExtractDate(mediaFile *MediaFile) (CaptureTime, error) {
+	metadata, err := mediaFile.Exif()
+	if err != nil {
+		return CaptureTime{}, err
+	}
+	return extractExifCaptureTime(metadata)
+}
+
+// videoDateExtractor extracts the creation time from QuickTime, MP4, and 3GP containers.
+type videoDateExtractor struct{}
+
+func (extractor videoDateExtractor) Name() string {
+	return "video"
+}
+
+func (extractor videoDateExtractor) ExtractDate(mediaFile *MediaFile) (CaptureTime, error) {
+	videoFile, err := os.Open(mediaFile.Path)
+	if err != nil {
+		return CaptureTime{}, err
+	}
+	defer videoFile.Close()
+
+	return extractVideoCreationTime(videoFile)
+}
+
+// googleDateExtractor uses the "photoTakenTime" from the Google Photos JSON metadata.
+type googleDateExtractor struct{}
+
+func (extractor googleDateExtractor) Name() string {
+	return "google"
+}
+
+func (extractor googleDateExtractor) ExtractDate(mediaFile *MediaFile) (CaptureTime, error) {
+	if mediaFile.GoogleMetadata == nil {
+		return CaptureTime{}, errors.New("no Google metadata present")
+	}
+	if mediaFile.GoogleMetadata.PhotoTakenTime.IsZero() {
+		return CaptureTime{}, errors.New("no 'PhotoTakenTime' present in Google metadata")
+	}
+	return NewInstantCaptureTime(mediaFile.GoogleMetadata.PhotoTakenTime), nil
+}
+
+// xmpDateExtractor extracts the capture date from an XMP sidecar, named either <picname>.xmp or <picname without extension>.xmp.
+type xmpDateExtractor struct{}
+
+// xmpDateProperty is an XMP property holding the capture date, with a regex for its value.
+type xmpDateProperty struct {
+	name  string
+	regex *regexp.Regexp
+}
+
+// xmpDateProperties are the XMP properties holding the capture date, in order of preference.
+var xmpDateProperties = []xmpDateProperty{
+	newXmpDateProperty("exif:DateTimeOriginal"),
+	newXmpDateProperty("photoshop:DateCreated"),
+	newXmpDateProperty("xmp:CreateDate"),
+}
+
+// newXmpDateProperty compiles the regex for the value of the named property, which may be serialized as an attribute or as an element.
+func newXmpDateProperty(name string) xmpDateProperty {
+	return xmpDateProperty{name: name, regex: regexp.MustCompile(regexp.QuoteMeta(name) + `(?:\s*=\s*["']|\s*>)\s*([^"'<]+)`)}
+}
+
+// xmpDateLayouts are the forms of ISO 8601 permitted by XMP.  Dates without an offset are local.
+var xmpDateLayouts = []string{
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+func (extractor xmpDateExtractor) Name() string {
+	return "xmp"
+}
+
+func (extractor xmpDateExtractor) ExtractDate(mediaFile *MediaFile) (CaptureTime, error) {
+	ext := filepath.Ext(mediaFile.Path)
+	for _, xmpFilePath := range []string{
+		mediaFile.Path + ".xmp",
+		strings.TrimSuffix(mediaFile.Path, ext) + ".xmp",
+		strings.TrimSuffix(mediaFile.Path, ext) + ".XMP",
+	} {
+		content, err := ioutil.ReadFile(xmpFilePath)
+		if err != nil {
+			continue
+		}
+		log.Println("[DEBUG] Using XMP sidecar:", xmpFilePath)
+		return parseXmpDate(string(content))
+	}
+	return CaptureTime{}, errors.New("no XMP sidecar present")
+}
+
+func parseXmpDate(content string) (CaptureTime, error) {
+	for _, property := range xmpDateProperties {
+		match := property.regex.FindStringSubmatch(content)
+		if match == nil {
+			continue
+		}
+		value := strings.TrimSpace(match[1])
+		for _, layout := range xmpDateLayouts {
+			result, err := time.Parse(layout, value)
+			if err != nil {
+				continue
+			}
+			if strings.HasSuffix(layout, "Z07:00") {
+				return NewZonedCaptureTime(result), nil
+			}
+			return NewLocalCaptureTime(result), nil
+		}
+		log.Println("[WARN] Ignoring unrecognized XMP date", property.name, value)
+	}
+	return CaptureTime{}, errors.New("no date present in XMP sidecar")
+}
+
+// mtimeDateExtractor uses the file modification time, which is a last resort since copying often resets it.
+type mtimeDateExtractor struct{}
+
+func (extractor mtimeDateExtractor) Name() string {
+	return "mtime"
+}
+
+func (extractor mtimeDateExtractor) ExtractDate(mediaFile *MediaFile) (CaptureTime, error) {
+	fileInfo, err := os.Stat(mediaFile.Path)
+	if err != nil {
+		return CaptureTime{}, err
+	}
+	return NewInstantCaptureTime(fileInfo.ModTime()), nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const libraryDuplicatesSubDir = "library-duplicates"
+
+// DuplicateCluster is a group of identical files within the library, of which one is kept and the rest are extras.
+type DuplicateCluster struct {
+	Hash   string   `json:"hash"`
+	Size   int64    `json:"size"`
+	Kept   string   `json:"kept"`
+	Extras []string `json:"extras"`
+}
+
+// runDedupeLibrary implements "picsort dedupe-library", which finds duplicates already in the library and optionally moves the extras out of it.
+func runDedupeLibrary(args []string) {
+	dedupeFlags := flag.NewFlagSet("dedupe-library", flag.ExitOnError)
+	libDir := dedupeFlags.String("libdir", "", "The directory containing your photo library.")
+	rejectDir := dedupeFlags.String("rejectdir", "", "The root directory to which extra copies will be moved, in the \""+libraryDuplicatesSubDir+"\" subdirectory.  Required with -move.")
+	isMove := dedupeFlags.Bool("move", false, "Move the extra copies of each duplicate to -rejectdir, rather than only reporting them.")
+	isDryrun := dedupeFlags.Bool("dryrun", false, "With -move, only log the moves.")
+	undoFilePath := dedupeFlags.String("undofile", "undo.jsonl", "The name of a journal file in which to record moves, for \"picsort undo\".")
+	isUndoHashed := dedupeFlags.Bool("undohash", true, "Record the checksum of each moved file in the undo journal, so that undo only moves back files whose content is unchanged.  Set to false to record only the size and modification time.")
+	reportFilePath := dedupeFlags.String("report", "", "The name of a file in which to write the duplicate clusters: CSV if it ends in .csv, otherwise JSON.")
+	indexFilePath := dedupeFlags.String("indexfile", defaultIndexFile, "The name of a file in which to cache the hashes of library files between runs.  Relative to -libdir unless absolute.  Set to \"\" to disable.")
+	hashAlgorithm := dedupeFlags.String("hash", defaultHashAlgorithm, "The algorithm for hashing file content to find duplicates: "+strings.Join(sortedHashAlgorithmNames(), ", ")+".")
+	isByteCompare := dedupeFlags.Bool("bytecompare", false, "Confirm that files with matching hashes are identical, byte by byte, before treating them as duplicates.")
+	jobs := dedupeFlags.Int("jobs", runtime.NumCPU(), "The number of files to hash concurrently.")
+	dedupeFlags.Usage = func() {
+		fmt.Fprintln(dedupeFlags.Output(), "Usage: picsort dedupe-library -libdir <dir> [-report <file>] [-move -rejectdir <dir>]")
+		fmt.Fprintln(dedupeFlags.Output(), "Finds files with identical content within the library.  Of each group, the file with the shortest name is kept.")
+		dedupeFlags.PrintDefaults()
+	}
+	dedupeFlags.Parse(args)
+	if dedupeFlags.NArg() != 0 ||
+		len(*libDir) <= 0 ||
+		(*isMove && len(*rejectDir) <= 0) ||
+		*jobs < 1 ||
+		hashAlgorithms[*hashAlgorithm] == nil {
+		dedupeFlags.Usage()
+		os.Exit(2)
+	}
+
+	log.Println("[INFO]", "Finding duplicates in library", *libDir)
+	log.Println("[INFO]", "Hashing with", *hashAlgorithm)
+	if *isByteCompare {
+		log.Println("[INFO]", "Confirming duplicates byte by byte")
+	}
+	hashCache := loadIndexFile(*indexFilePath, *libDir, *hashAlgorithm, *isDryrun)
+	fileIndex := NewFileIndex(*hashAlgorithm, hashCache, *isByteCompare, libraryLinkDirs(*libDir), *jobs)
+	if err := fileIndex.BuildIndexForDirectory(*libDir); err != nil {
+		log.Fatalln("[FATAL]", "Failed to index library", *libDir, ":", err)
+	}
+	clusters, err := findDuplicateClusters(fileIndex)
+	if err != nil {
+		log.Fatalln("[FATAL]", "Failed to find duplicates in", *libDir, ":", err)
+	}
+	extraCount := 0
+	for _, cluster := range clusters {
+		log.Println("[INFO]", "Keeping", cluster.Kept, "with duplicates", strings.Join(cluster.Extras, ", "))
+		extraCount += len(cluster.Extras)
+	}
+	log.Println("[INFO]", "Found", len(clusters), "files with", extraCount, "extra copies in the library.")
+	if len(*reportFilePath) > 0 {
+		if err := writeDuplicateClusters(*reportFilePath, clusters); err != nil {
+			log.Println("[WARN]", "Failed to write report file:", err)
+		}
+	}
+
+	var moveErr error
+	if *isMove {
+		if *isDryrun {
+			log.Println("[INFO]", "Dry run only")
+		}
+		var journal *UndoJournal
+		if !*isDryrun {
+			journal = openUndoFile(*undoFilePath, *isUndoHashed)
+			defer journal.Close()
+		}
+		fileMover := NewFileMover(*isDryrun, journal)
+		moveErr = moveDuplicateExtras(clusters, fileMover, fileIndex, *libDir, filepath.Join(*rejectDir, libraryDuplicatesSubDir))
+	}
+	if hashCache != nil {
+		if err := hashCache.Save(); err != nil {
+			log.Println("[WARN]", "Failed to save index file:", err)
+		}
+	}
+	if moveErr != nil {
+		log.Fatalln("[FATAL]", "Failed to move duplicates out of", *libDir, ":", moveErr)
+	}
+	if *isMove && !*isDryrun {
+		log.Println("[INFO]", "To reinstate moved files, execute: picsort undo", *undoFilePath)
+	}
+}
+
+// findDuplicateClusters groups the indexed files with identical content, keeping of each group the file with the shortest name (e.g. IMG_1234.jpg rather than IMG_1234.1.jpg, renamed to avoid a collision), then the first by path.
+func findDuplicateClusters(fileIndex *FileIndex) ([]DuplicateCluster, error) {
+	var result []DuplicateCluster
+	for _, group := range fileIndex.FindDuplicateGroups() {
+		sort.SliceStable(group, func(i int, j int) bool {
+			return len(filepath.Base(group[i])) < len(filepath.Base(group[j]))
+		})
+		group, err := withoutHardLinks(group)
+		if err != nil {
+			return nil, err
+		} else if len(group) < 2 {
+			continue
+		}
+		hash, err := fileIndex.DeriveHash(group[0])
+		if err != nil {
+			return nil, err
+		}
+		fileInfo, err := os.Stat(group[0])
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, DuplicateCluster{Hash: hash, Size: fileInfo.Size(), Kept: group[0], Extras: group[1:]})
+	}
+	return result, nil
+}
+
+// withoutHardLinks returns the paths excluding any that are hard links to an earlier one, since they take no extra space.
+func withoutHardLinks(paths []string) ([]string, error) {
+	var result []string
+	var fileInfos []os.FileInfo
+	for _, path := range paths {
+		fileInfo, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		isLink := false
+		for _, otherFileInfo := range fileInfos {
+			if os.SameFile(fileInfo, otherFileInfo) {
+				isLink = true
+				break
+			}
+		}
+		if !isLink {
+			result = append(result, path)
+			fileInfos = append(fileInfos, fileInfo)
+		}
+	}
+	return result, nil
+}
+
+// moveDuplicateExtras moves the extra copies of each cluster from the library to the given directory, preserving their paths within the library.
+func moveDuplicateExtras(clusters []DuplicateCluster, fileMover *FileMover, fileIndex *FileIndex, libDir string, destDir string) error {
+	for _, cluster := range clusters {
+		for _, extra := range cluster.Extras {
+			if _, err := fileMover.MoveFileWithPreservedPath(extra, libDir, destDir); err != nil {
+				return err
+			}
+			fileIndex.RemoveFileFromIndex(extra)
+		}
+	}
+	return nil
+}
+
+// writeDuplicateClusters writes the clusters to the given file: as CSV with a row per file if the name ends in .csv, otherwise as JSON.
+func writeDuplicateClusters(filePath string, clusters []DuplicateCluster) error {
+	if strings.ToLower(filepath.Ext(filePath)) != ".csv" {
+		content, err := json.MarshalIndent(clusters, "", "  ")
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filePath, content, 0644)
+	}
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"cluster", "hash", "size", "path", "action"})
+	for i, cluster := range clusters {
+		row := []string{strconv.Itoa(i + 1), cluster.Hash, strconv.FormatInt(cluster.Size, 10)}
+		writer.Write(append(row, cluster.Kept, "keep"))
+		for _, extra := range cluster.Extras {
+			writer.Write(append(row, extra, "extra"))
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -1,19 +1,50 @@
 package main
 
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+// Policies for resolving an incoming image that is similar to a library image.
+const (
+	dupePolicyKeepExisting         = "keep-existing"
+	dupePolicyKeepLarger           = "keep-larger"
+	dupePolicyKeepHigherResolution = "keep-higher-resolution"
+	dupePolicyKeepWithMoreMetadata = "keep-with-more-metadata"
+)
+
+// dupePolicies lists the policies for the usage message.
+var dupePolicies = []string{dupePolicyKeepExisting, dupePolicyKeepLarger, dupePolicyKeepHigherResolution, dupePolicyKeepWithMoreMetadata}
+
+// Actions for an incoming file identical to a library file.
+const (
+	dupeActionMove     = "move"     // move it to the duplicate directory
+	dupeActionHardlink = "hardlink" // replace it in place with a hard link to the library file
+	dupeActionReflink  = "reflink"  // replace it in place with a copy-on-write clone of the library file
+)
+
+// dupeActions lists the actions for the usage message.
+var dupeActions = []string{dupeActionMove, dupeActionHardlink, dupeActionReflink}
+
 // Deduper identifies and moves duplicate files.
 type Deduper struct {
 	fileIndex               *FileIndex
+	perceptualIndex         *PerceptualIndex // nil unless finding similar images
+	dupePolicy              string           // for similar images
+	dupeAction              string           // for identical files
 	duplicateDestinationDir string
-	originalBaseDir         string
 	duplicateFileMover      *FileMover
 }
 
 // NewDeduper creates a default instance of FileIndex.
-func NewDeduper(fileIndex *FileIndex, duplicateDestinationDir string, originalBaseDir string, duplicateFileMover *FileMover) *Deduper {
+func NewDeduper(fileIndex *FileIndex, perceptualIndex *PerceptualIndex, dupePolicy string, dupeAction string, duplicateDestinationDir string, duplicateFileMover *FileMover) *Deduper {
 	result := new(Deduper)
 	result.fileIndex = fileIndex
+	result.perceptualIndex = perceptualIndex
+	result.dupePolicy = dupePolicy
+	result.dupeAction = dupeAction
 	result.duplicateDestinationDir = duplicateDestinationDir
-	result.originalBaseDir = originalBaseDir
 	result.duplicateFileMover = duplicateFileMover
 	return result
 }
@@ -30,14 +61,147 @@ func (deduper Deduper) AddDirectoryToIndex(dirPath string) error {
 
 // AddFileToIndex indexe the specified file.
 func (deduper Deduper) AddFileToIndex(filePath string) error {
+	if deduper.perceptualIndex != nil {
+		if err := deduper.perceptualIndex.AddFileToIndex(filePath); err != nil {
+			log.Println("[WARN]", "Failed to add", filePath, "to perceptual index:", err)
+		}
+	}
 	return deduper.fileIndex.AddFileToIndex(filePath)
 }
 
-// IsDuplicate determines whether the specified file is a duplicate.
-func (deduper Deduper) IsDuplicate(filePath string) (bool, error) {
-	isPresent, err := deduper.fileIndex.IsFilePresent(filePath)
-	if err != nil {
-		return false, err
+// AddMovedFileToIndex indexes the specified file, just moved from sourcePath, keeping any hashes already derived for it.
+func (deduper Deduper) AddMovedFileToIndex(sourcePath string, destPath string) error {
+	if deduper.perceptualIndex != nil {
+		if err := deduper.perceptualIndex.AddMovedFileToIndex(sourcePath, destPath); err != nil {
+			log.Println("[WARN]", "Failed to add", destPath, "to perceptual index:", err)
+		}
+	}
+	return deduper.fileIndex.AddMovedFileToIndex(sourcePath, destPath)
+}
+
+// DeriveHash derives the full content hash of the specified file.
+func (deduper Deduper) DeriveHash(filePath string) (string, error) {
+	return deduper.fileIndex.DeriveHash(filePath)
+}
+
+// PrehashFile derives in advance the hashes that IsDuplicate and FindSimilar will need for the specified file, so that they can be derived concurrently.
+func (deduper Deduper) PrehashFile(filePath string) {
+	if _, err := deduper.fileIndex.FindDuplicate(filePath); err != nil {
+		log.Println("[DEBUG]", "Failed to prehash", filePath, ":", err)
+	}
+	if deduper.perceptualIndex != nil {
+		if _, err := deduper.perceptualIndex.FindSimilar(filePath); err != nil {
+			log.Println("[DEBUG]", "Failed to derive perceptual hash of", filePath, ":", err)
+		}
+	}
+}
+
+// HashFile derives every hash of the specified file that the indexes compare, so that the file can be compared to even once it's deleted, e.g. a file extracted from an archive in a dry run.
+func (deduper Deduper) HashFile(filePath string) error {
+	if deduper.perceptualIndex != nil && isPerceptualHashSupported(filePath) {
+		if _, err := deduper.perceptualIndex.derivePerceptualHash(filePath); err != nil {
+			log.Println("[DEBUG]", "Failed to derive perceptual hash of", filePath, ":", err)
+		}
+	}
+	return deduper.fileIndex.DeriveHashes(filePath)
+}
+
+// FindDuplicatesWithin returns the groups of identical files within the specified directory, each sorted by path.
+func (deduper Deduper) FindDuplicatesWithin(dirPath string) ([][]string, error) {
+	return deduper.fileIndex.FindDuplicateGroupsWithin(dirPath)
+}
+
+// FindSimilar returns the path of an indexed image that looks like the specified file, or "" if there is none or similar images are not being found.
+func (deduper Deduper) FindSimilar(filePath string) (string, error) {
+	if deduper.perceptualIndex == nil {
+		return "", nil
+	}
+	return deduper.perceptualIndex.FindSimilar(filePath)
+}
+
+// FindDuplicate returns the path of an indexed file identical to the specified file, or "" if the file is not a duplicate.
+func (deduper Deduper) FindDuplicate(filePath string) (string, error) {
+	return deduper.fileIndex.FindDuplicate(filePath)
+}
+
+// HandleDuplicate disposes of the specified file (relative to fileRoot), which is identical to the file at keptPath, according to the action: by moving it to the duplicate directory, or by replacing it in place with a link to the kept file.  If linking fails (e.g. across filesystems), the file is moved instead.  Returns a description of what was done.
+func (deduper Deduper) HandleDuplicate(filePath string, fileRoot string, keptPath string) (string, error) {
+	if deduper.dupeAction == dupeActionHardlink || deduper.dupeAction == dupeActionReflink {
+		err := deduper.duplicateFileMover.LinkFile(filePath, keptPath, deduper.dupeAction == dupeActionReflink)
+		if err == nil {
+			return deduper.dupeAction + "ed to " + keptPath, nil
+		}
+		log.Println("[WARN]", filePath, "Moving duplicate instead of linking it to", keptPath, "due to failure to link:", err)
+	}
+	return deduper.MoveDuplicate(filePath, fileRoot, keptPath)
+}
+
+// MoveDuplicate moves the specified file (relative to fileRoot), a duplicate of the file at keptPath, to the duplicate directory regardless of the action, e.g. when its content only matches once modified.  Returns a description of what was done.
+func (deduper Deduper) MoveDuplicate(filePath string, fileRoot string, keptPath string) (string, error) {
+	if _, err := deduper.duplicateFileMover.MoveFileWithPreservedPath(filePath, fileRoot, deduper.duplicateDestinationDir); err != nil {
+		return "", err
+	}
+	return "identical to " + keptPath, nil
+}
+
+// isDupePolicy determines whether the given name is one of the dupePolicies.
+func isDupePolicy(name string) bool {
+	for _, dupePolicy := range dupePolicies {
+		if name == dupePolicy {
+			return true
+		}
+	}
+	return false
+}
+
+// isDupeAction determines whether the given name is one of the dupeActions.
+func isDupeAction(name string) bool {
+	for _, dupeAction := range dupeActions {
+		if name == dupeAction {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveFileFromIndex removes the specified file from the indexes, e.g. after it's replaced.
+func (deduper Deduper) RemoveFileFromIndex(filePath string) {
+	deduper.fileIndex.RemoveFileFromIndex(filePath)
+	if deduper.perceptualIndex != nil {
+		deduper.perceptualIndex.RemoveFileFromIndex(filePath)
+	}
+}
+
+// IsBetterThan determines whether, according to the policy, the specified file should replace the similar existing file.  Also returns the reason.
+func (deduper Deduper) IsBetterThan(filePath string, existingFilePath string) (bool, string, error) {
+	switch deduper.dupePolicy {
+	case dupePolicyKeepLarger:
+		fileInfo, err := os.Stat(filePath)
+		if err != nil {
+			return false, "", err
+		}
+		existingFileInfo, err := os.Stat(existingFilePath)
+		if err != nil {
+			return false, "", err
+		}
+		reason := "is larger (" + strconv.FormatInt(fileInfo.Size(), 10) + " vs " + strconv.FormatInt(existingFileInfo.Size(), 10) + " bytes)"
+		return fileInfo.Size() > existingFileInfo.Size(), reason, nil
+	case dupePolicyKeepHigherResolution:
+		width, height, err := deduper.perceptualIndex.Dimensions(filePath)
+		if err != nil {
+			return false, "", err
+		}
+		existingWidth, existingHeight, err := deduper.perceptualIndex.Dimensions(existingFilePath)
+		if err != nil {
+			return false, "", err
+		}
+		reason := "has higher resolution (" + strconv.Itoa(width) + "x" + strconv.Itoa(height) + " vs " + strconv.Itoa(existingWidth) + "x" + strconv.Itoa(existingHeight) + ")"
+		return width*height > existingWidth*existingHeight, reason, nil
+	case dupePolicyKeepWithMoreMetadata:
+		fieldCount := NewMediaFile(filePath, nil).MetadataFieldCount()
+		existingFieldCount := NewMediaFile(existingFilePath, nil).MetadataFieldCount()
+		reason := "has more EXIF fields (" + strconv.Itoa(fieldCount) + " vs " + strconv.Itoa(existingFieldCount) + ")"
+		return fieldCount > existingFieldCount, reason, nil
 	}
-	return isPresent, nil
+	return false, "", nil
 }
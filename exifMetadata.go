@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// EXIF 2.31 offset fields, which goexif does not know about.
+const (
+	exifOffsetTime          exif.FieldName = "OffsetTime"
+	exifOffsetTimeOriginal  exif.FieldName = "OffsetTimeOriginal"
+	exifOffsetTimeDigitized exif.FieldName = "OffsetTimeDigitized"
+)
+
+var exifOffsetFields = map[uint16]exif.FieldName{
+	0x9010: exifOffsetTime,
+	0x9011: exifOffsetTimeOriginal,
+	0x9012: exifOffsetTimeDigitized,
+}
+
+func init() {
+	exif.RegisterParsers(exifOffsetParser{})
+}
+
+// exifOffsetParser loads the offset fields from the Exif sub-IFD.
+type exifOffsetParser struct{}
+
+func (parser exifOffsetParser) Parse(x *exif.Exif) error {
+	pointerTag, err := x.Get(exif.ExifIFDPointer)
+	if err != nil {
+		return nil
+	}
+	offset, err := pointerTag.Int64(0)
+	if err != nil {
+		return nil
+	}
+	reader := bytes.NewReader(x.Raw)
+	if _, err := reader.Seek(offset, 0); err != nil {
+		return nil
+	}
+	subDir, _, err := tiff.DecodeDir(reader, x.Tiff.Order)
+	if err != nil {
+		return nil
+	}
+	x.LoadTags(subDir, exifOffsetFields, false)
+	return nil
+}
+
+// decodeExif decodes the EXIF metadata from the given file, which may be a JPEG, TIFF, or HEIF (e.g. HEIC) image.
+func decodeExif(picFile *os.File) (*exif.Exif, error) {
+	if isHeifFile(picFile) {
+		return decodeHeifExif(picFile)
+	}
+	return exif.Decode(picFile)
+}
+
+// extractExifCaptureTime reads DateTimeOriginal (or DateTime) along with its recorded offset, if any.
+func extractExifCaptureTime(metadata *exif.Exif) (CaptureTime, error) {
+	dateTag, offsetTag := exifStringTag(metadata, exif.DateTimeOriginal), exifStringTag(metadata, exifOffsetTimeOriginal)
+	if dateTag == "" {
+		dateTag, offsetTag = exifStringTag(metadata, exif.DateTime), exifStringTag(metadata, exifOffsetTime)
+	}
+	if dateTag == "" {
+		return CaptureTime{}, errors.New("no DateTimeOriginal or DateTime present in EXIF")
+	}
+	wallClock, err := time.Parse("2006:01:02 15:04:05", dateTag)
+	if err != nil {
+		return CaptureTime{}, err
+	}
+	if offsetTag != "" {
+		if offset, err := time.Parse("-07:00", offsetTag); err == nil {
+			_, offsetSeconds := offset.Zone()
+			year, month, day := wallClock.Date()
+			hour, minute, second := wallClock.Clock()
+			return NewZonedCaptureTime(time.Date(year, month, day, hour, minute, second, 0, time.FixedZone("", offsetSeconds))), nil
+		}
+	}
+	return NewLocalCaptureTime(wallClock), nil
+}
+
+func exifStringTag(metadata *exif.Exif, name exif.FieldName) string {
+	tag, err := metadata.Get(name)
+	if err != nil || tag.Format() != tiff.StringVal {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(tag.Val), "\x00"))
+}
+
+// exifFieldCounter counts the fields visited by exif.Walk.
+type exifFieldCounter struct {
+	count int
+}
+
+func (counter *exifFieldCounter) Walk(name exif.FieldName, tag *tiff.Tag) error {
+	counter.count++
+	return nil
+}
+
+// countExifFields counts the fields of the EXIF metadata, as a measure of how much metadata a file has.
+func countExifFields(metadata *exif.Exif) int {
+	counter := new(exifFieldCounter)
+	metadata.Walk(counter)
+	return counter.count
+}
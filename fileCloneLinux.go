@@ -0,0 +1,30 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl request, from linux/fs.h.
+const ficlone = 0x40049409
+
+// cloneFile creates destPath as a copy-on-write clone of sourcePath, sharing its storage until either is modified.  Fails unless both are on the same filesystem, and the filesystem supports it (e.g. Btrfs or XFS).
+func cloneFile(sourcePath string, destPath string) error {
+	sourceFile, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+	destFile, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, destFile.Fd(), ficlone, sourceFile.Fd()); errno != 0 {
+		destFile.Close()
+		os.Remove(destPath)
+		return &os.PathError{Op: "clone", Path: destPath, Err: errno}
+	}
+	return destFile.Close()
+}
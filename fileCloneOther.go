@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// cloneFile would create destPath as a copy-on-write clone of sourcePath, but is only implemented for Linux.
+func cloneFile(sourcePath string, destPath string) error {
+	return errors.New("reflinks are only supported on Linux")
+}
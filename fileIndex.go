@@ -1,81 +1,481 @@
 package main
 
 import (
+	"bytes"
 	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
+	"hash"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"sync"
+
+	"lukechampine.com/blake3"
 )
 
-// FileIndex indexes files by hash and path for directories.
+// hashAlgorithms are the algorithms available for hashing file content, by name.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"blake3": func() hash.Hash { return blake3.New(32, nil) },
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// defaultHashAlgorithm is the algorithm for hashing file content unless otherwise specified.
+const defaultHashAlgorithm = "sha256"
+
+// byteCompareChunkSize is the number of bytes compared at a time when comparing files byte by byte.
+const byteCompareChunkSize = 64 * 1024
+
+// partialHashChunkSize is the number of bytes hashed from each of the head and the tail of a file for its partial hash.
+const partialHashChunkSize = 64 * 1024
+
+// FileIndex indexes files by size and path for directories.  Files are only hashed when their size collides: first partially (head and tail), then fully if the partial hashes match.
 type FileIndex struct {
-	hashToPath        map[string]string
+	sizeToPaths       map[int64][]string
+	fingerprints      map[string]*fileFingerprint // by path, for indexed files and files checked against the index
 	hashedDirectories map[string]bool
+	hashCache         *HashCache
+	hashAlgorithm     string
+	isByteCompare     bool            // confirm matching hashes by comparing content
+	excludedDirs      map[string]bool // directories not to index, e.g. folders of links
+	jobs              int
+	mutex             *sync.Mutex
 }
 
-// NewFileIndex creates a default instance of FileIndex.
-func NewFileIndex() *FileIndex {
+// fileFingerprint holds the size of a file and whichever hashes have been derived for it so far.
+type fileFingerprint struct {
+	fileInfo    os.FileInfo
+	partialHash string
+	hash        string
+	isIndexed   bool
+	comparedTo  map[string]bool // whether identical, byte by byte, to other files by path
+}
+
+// NewFileIndex creates a default instance of FileIndex, hashing with the given algorithm (a key of hashAlgorithms), taking hashes of unchanged files from the given cache (which may be nil), optionally confirming matching hashes byte by byte, skipping the given directories when scanning, and scanning up to the given number of files concurrently.
+func NewFileIndex(hashAlgorithm string, hashCache *HashCache, isByteCompare bool, excludedDirs []string, jobs int) *FileIndex {
 	result := new(FileIndex)
-	result.hashToPath = make(map[string]string)
+	result.sizeToPaths = make(map[int64][]string)
+	result.fingerprints = make(map[string]*fileFingerprint)
 	result.hashedDirectories = make(map[string]bool)
+	result.hashCache = hashCache
+	result.hashAlgorithm = hashAlgorithm
+	result.isByteCompare = isByteCompare
+	result.excludedDirs = newDirectorySet(excludedDirs)
+	result.jobs = jobs
+	result.mutex = new(sync.Mutex)
 	return result
 }
 
 // IsDirectoryIndexed determines whether the specified directory has been indexed by BuildIndexForDirectory.
 func (fileIndex FileIndex) IsDirectoryIndexed(dirPath string) bool {
+	fileIndex.mutex.Lock()
+	defer fileIndex.mutex.Unlock()
 	_, isPresent := fileIndex.hashedDirectories[dirPath]
 	return isPresent
 }
 
-// BuildIndexForDirectory recursively scans the given directory and indexes all the files contained within.
+// BuildIndexForDirectory recursively scans the given directory and indexes all the files contained within, concurrently.
 func (fileIndex FileIndex) BuildIndexForDirectory(dirPath string) error {
 	log.Println("[DEBUG]", "Building index for path:", dirPath)
+	filePaths := make(chan string, fileIndex.jobs)
+	var waitGroup sync.WaitGroup
+	for i := 0; i < fileIndex.jobs; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for filePath := range filePaths {
+				err := fileIndex.AddFileToIndex(filePath)
+				if err != nil {
+					log.Println("[WARN]", "Skipping", filePath, ":", err)
+				}
+			}
+		}()
+	}
 	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if fileIndex.hashCache != nil && fileIndex.hashCache.IsCacheFile(path) {
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			// e.g. a link in a favorites folder, which would otherwise be mistaken for a duplicate
+			return nil
+		}
+		if info.IsDir() && fileIndex.excludedDirs[filepath.Clean(path)] {
+			log.Println("[DEBUG]", "Not indexing", path)
+			return filepath.SkipDir
+		}
 		if !info.IsDir() {
-			err := fileIndex.AddFileToIndex(path)
-			if err != nil {
-				log.Println("[WARN]", "Skipping", path, ":", err)
-			}
+			filePaths <- path
 		} else {
-			fileIndex.hashedDirectories[path] = true
+			fileIndex.markDirectoryIndexed(path)
 		}
 		return nil
 	})
+	close(filePaths)
+	waitGroup.Wait()
 	if err != nil {
 		return err
 	}
-	fileIndex.hashedDirectories[dirPath] = true
+	fileIndex.markDirectoryIndexed(dirPath)
 	return nil
 }
 
-// AddFileToIndex adds the specified file to the index.
+// newDirectorySet returns the set of the given directory paths, cleaned for lookup.
+func newDirectorySet(dirPaths []string) map[string]bool {
+	result := make(map[string]bool)
+	for _, dirPath := range dirPaths {
+		result[filepath.Clean(dirPath)] = true
+	}
+	return result
+}
+
+func (fileIndex FileIndex) markDirectoryIndexed(dirPath string) {
+	fileIndex.mutex.Lock()
+	defer fileIndex.mutex.Unlock()
+	fileIndex.hashedDirectories[dirPath] = true
+}
+
+// AddFileToIndex adds the specified file to the index.  This only reads the file's size; hashes are derived when needed.
 func (fileIndex FileIndex) AddFileToIndex(filePath string) error {
-	hash, err := deriveHashFromFile(filePath)
+	fingerprint, err := fileIndex.fingerprint(filePath)
 	if err != nil {
 		return err
 	}
-	log.Println("[DEBUG]", "Adding to index:", hash, filePath)
-	fileIndex.hashToPath[hash] = filePath
+	fileIndex.addToIndex(filePath, fingerprint)
 	return nil
 }
 
-// IsFilePresent determines whether the specified file has been indexed.
-func (fileIndex FileIndex) IsFilePresent(filePath string) (bool, error) {
-	hash, err := deriveHashFromFile(filePath)
+// AddMovedFileToIndex adds the specified file, just moved from sourcePath, to the index, keeping any hashes already derived for it.
+func (fileIndex FileIndex) AddMovedFileToIndex(sourcePath string, destPath string) error {
+	fileInfo, err := os.Stat(destPath)
+	if err != nil {
+		return err
+	}
+	fingerprint := &fileFingerprint{fileInfo: fileInfo}
+	fileIndex.mutex.Lock()
+	if sourceFingerprint, isPresent := fileIndex.fingerprints[sourcePath]; isPresent && sourceFingerprint.fileInfo.Size() == fileInfo.Size() {
+		fingerprint.partialHash = sourceFingerprint.partialHash
+		fingerprint.hash = sourceFingerprint.hash
+	}
+	delete(fileIndex.fingerprints, sourcePath)
+	fileIndex.fingerprints[destPath] = fingerprint
+	fileIndex.mutex.Unlock()
+	if fileIndex.hashCache != nil {
+		fileIndex.hashCache.Put(destPath, fileInfo, hashCacheEntry{Hash: fingerprint.hash, PartialHash: fingerprint.partialHash})
+	}
+	fileIndex.addToIndex(destPath, fingerprint)
+	return nil
+}
+
+func (fileIndex FileIndex) addToIndex(filePath string, fingerprint *fileFingerprint) {
+	log.Println("[DEBUG]", "Adding to index:", filePath)
+	fileIndex.mutex.Lock()
+	defer fileIndex.mutex.Unlock()
+	if fingerprint.isIndexed {
+		return
+	}
+	fingerprint.isIndexed = true
+	size := fingerprint.fileInfo.Size()
+	fileIndex.sizeToPaths[size] = append(fileIndex.sizeToPaths[size], filePath)
+}
+
+// RemoveFileFromIndex removes the specified file from the index, e.g. after it's replaced.
+func (fileIndex FileIndex) RemoveFileFromIndex(filePath string) {
+	fileIndex.mutex.Lock()
+	defer fileIndex.mutex.Unlock()
+	fingerprint, isPresent := fileIndex.fingerprints[filePath]
+	if !isPresent {
+		return
+	}
+	delete(fileIndex.fingerprints, filePath)
+	if !fingerprint.isIndexed {
+		return
+	}
+	size := fingerprint.fileInfo.Size()
+	paths := fileIndex.sizeToPaths[size]
+	for i, path := range paths {
+		if path == filePath {
+			fileIndex.sizeToPaths[size] = append(paths[:i:i], paths[i+1:]...)
+			break
+		}
+	}
+}
+
+// FindDuplicate returns the path of an indexed file with the same content as the specified file, or "" if there is none.  Only indexed files of the same size are hashed, and only fully if their partial hashes match.
+func (fileIndex FileIndex) FindDuplicate(filePath string) (string, error) {
+	fingerprint, err := fileIndex.fingerprint(filePath)
+	if err != nil {
+		return "", err
+	}
+	candidatePaths := fileIndex.pathsOfSize(fingerprint.fileInfo.Size())
+	if len(candidatePaths) == 0 {
+		return "", nil
+	}
+	// Fail for an unreadable file, rather than skipping every candidate.
+	if _, err := fileIndex.derivePartialHash(filePath, fingerprint); err != nil {
+		return "", err
+	}
+	for _, candidatePath := range candidatePaths {
+		if candidatePath == filePath {
+			continue
+		}
+		isIdentical, err := fileIndex.isIdentical(filePath, candidatePath)
+		if err != nil {
+			log.Println("[WARN]", "Skipping", candidatePath, ":", err)
+		} else if isIdentical {
+			return candidatePath, nil
+		}
+	}
+	return "", nil
+}
+
+// FindDuplicateGroups returns the groups of indexed files with identical content, each group and the list of groups sorted by path.
+func (fileIndex FileIndex) FindDuplicateGroups() [][]string {
+	fileIndex.mutex.Lock()
+	var sizeGroups [][]string
+	for _, paths := range fileIndex.sizeToPaths {
+		if len(paths) > 1 {
+			sizeGroups = append(sizeGroups, append([]string(nil), paths...))
+		}
+	}
+	fileIndex.mutex.Unlock()
+	return fileIndex.groupByContent(sizeGroups)
+}
+
+// FindDuplicateGroupsWithin returns the groups of files with identical content within the specified directory, whether or not they're indexed, each group and the list of groups sorted by path.  The files are not added to the index.
+func (fileIndex FileIndex) FindDuplicateGroupsWithin(dirPath string) ([][]string, error) {
+	sizeToPaths := make(map[int64][]string)
+	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			fingerprint, err := fileIndex.fingerprint(path)
+			if err != nil {
+				log.Println("[WARN]", "Skipping", path, ":", err)
+				return nil
+			}
+			size := fingerprint.fileInfo.Size()
+			sizeToPaths[size] = append(sizeToPaths[size], path)
+		}
+		return nil
+	})
 	if err != nil {
+		return nil, err
+	}
+	var sizeGroups [][]string
+	for _, paths := range sizeToPaths {
+		if len(paths) > 1 {
+			sizeGroups = append(sizeGroups, paths)
+		}
+	}
+	return fileIndex.groupByContent(sizeGroups), nil
+}
+
+// groupByContent splits groups of files of the same size into groups of identical content, concurrently.
+func (fileIndex FileIndex) groupByContent(sizeGroups [][]string) [][]string {
+	sizeGroupChannel := make(chan []string, fileIndex.jobs)
+	var result [][]string
+	var resultMutex sync.Mutex
+	var waitGroup sync.WaitGroup
+	for i := 0; i < fileIndex.jobs; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for sizeGroup := range sizeGroupChannel {
+				duplicateGroups := fileIndex.splitByContent(sizeGroup)
+				resultMutex.Lock()
+				result = append(result, duplicateGroups...)
+				resultMutex.Unlock()
+			}
+		}()
+	}
+	for _, sizeGroup := range sizeGroups {
+		sizeGroupChannel <- sizeGroup
+	}
+	close(sizeGroupChannel)
+	waitGroup.Wait()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i][0] < result[j][0]
+	})
+	return result
+}
+
+// splitByContent splits files of the same size into groups of identical content, dropping files without duplicates.
+func (fileIndex FileIndex) splitByContent(paths []string) [][]string {
+	sort.Strings(paths)
+	var result [][]string
+	isGrouped := make(map[string]bool)
+	for i, path := range paths {
+		if isGrouped[path] {
+			continue
+		}
+		group := []string{path}
+		for _, otherPath := range paths[i+1:] {
+			if isGrouped[otherPath] {
+				continue
+			}
+			isIdentical, err := fileIndex.isIdentical(path, otherPath)
+			if err != nil {
+				log.Println("[WARN]", "Skipping", otherPath, ":", err)
+				isGrouped[otherPath] = true
+			} else if isIdentical {
+				group = append(group, otherPath)
+				isGrouped[otherPath] = true
+			}
+		}
+		if len(group) > 1 {
+			result = append(result, group)
+		}
+	}
+	return result
+}
+
+// isIdentical compares two files of the same size by partial hash, then full hash, then optionally byte by byte.
+func (fileIndex FileIndex) isIdentical(filePath string, otherFilePath string) (bool, error) {
+	fingerprint, err := fileIndex.fingerprint(filePath)
+	if err != nil {
+		return false, err
+	}
+	otherFingerprint, err := fileIndex.fingerprint(otherFilePath)
+	if err != nil {
+		return false, err
+	}
+	partialHash, err := fileIndex.derivePartialHash(filePath, fingerprint)
+	if err != nil {
+		return false, err
+	}
+	otherPartialHash, err := fileIndex.derivePartialHash(otherFilePath, otherFingerprint)
+	if err != nil || otherPartialHash != partialHash {
 		return false, err
 	}
-	_, isPresent := fileIndex.hashToPath[hash]
-	return isPresent, nil
+	hash, err := fileIndex.deriveHash(filePath, fingerprint)
+	if err != nil {
+		return false, err
+	}
+	otherHash, err := fileIndex.deriveHash(otherFilePath, otherFingerprint)
+	if err != nil || otherHash != hash {
+		return false, err
+	}
+	if fileIndex.isByteCompare {
+		isEqual, err := fileIndex.compareFileContents(filePath, fingerprint, otherFilePath)
+		if err != nil {
+			return false, err
+		} else if !isEqual {
+			log.Println("[WARN]", "Hash collision between", filePath, "and", otherFilePath, "; treating them as different")
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// DeriveHash derives the full hash of the file, taking it from the cache if the file is unchanged.
+func (fileIndex FileIndex) DeriveHash(filePath string) (string, error) {
+	fingerprint, err := fileIndex.fingerprint(filePath)
+	if err != nil {
+		return "", err
+	}
+	return fileIndex.deriveHash(filePath, fingerprint)
 }
 
-func deriveHashFromFile(filePath string) (string, error) {
+// DeriveHashes derives both the partial and the full hash of the file, so that it can be compared to without being read again.
+func (fileIndex FileIndex) DeriveHashes(filePath string) error {
+	fingerprint, err := fileIndex.fingerprint(filePath)
+	if err != nil {
+		return err
+	}
+	if _, err := fileIndex.derivePartialHash(filePath, fingerprint); err != nil {
+		return err
+	}
+	_, err = fileIndex.deriveHash(filePath, fingerprint)
+	return err
+}
+
+func (fileIndex FileIndex) pathsOfSize(size int64) []string {
+	fileIndex.mutex.Lock()
+	defer fileIndex.mutex.Unlock()
+	return append([]string(nil), fileIndex.sizeToPaths[size]...)
+}
+
+// fingerprint returns the fingerprint of the file, reading its size and any cached hashes on first use.
+func (fileIndex FileIndex) fingerprint(filePath string) (*fileFingerprint, error) {
+	fileIndex.mutex.Lock()
+	fingerprint, isPresent := fileIndex.fingerprints[filePath]
+	fileIndex.mutex.Unlock()
+	if isPresent {
+		return fingerprint, nil
+	}
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint = &fileFingerprint{fileInfo: fileInfo}
+	if fileIndex.hashCache != nil {
+		cachedHashes := fileIndex.hashCache.Get(filePath, fileInfo)
+		fingerprint.hash = cachedHashes.Hash
+		fingerprint.partialHash = cachedHashes.PartialHash
+	}
+	fileIndex.mutex.Lock()
+	defer fileIndex.mutex.Unlock()
+	if existingFingerprint, isPresent := fileIndex.fingerprints[filePath]; isPresent {
+		return existingFingerprint, nil
+	}
+	fileIndex.fingerprints[filePath] = fingerprint
+	return fingerprint, nil
+}
+
+func (fileIndex FileIndex) derivePartialHash(filePath string, fingerprint *fileFingerprint) (string, error) {
+	fileIndex.mutex.Lock()
+	partialHash := fingerprint.partialHash
+	fileIndex.mutex.Unlock()
+	if len(partialHash) > 0 {
+		return partialHash, nil
+	}
+	partialHash, err := derivePartialHashFromFile(filePath, fileIndex.hashAlgorithm)
+	if err != nil {
+		return "", err
+	}
+	fileIndex.mutex.Lock()
+	fingerprint.partialHash = partialHash
+	fileIndex.mutex.Unlock()
+	if fileIndex.hashCache != nil {
+		fileIndex.hashCache.Put(filePath, fingerprint.fileInfo, hashCacheEntry{PartialHash: partialHash})
+	}
+	return partialHash, nil
+}
+
+func (fileIndex FileIndex) deriveHash(filePath string, fingerprint *fileFingerprint) (string, error) {
+	fileIndex.mutex.Lock()
+	hash := fingerprint.hash
+	fileIndex.mutex.Unlock()
+	if len(hash) > 0 {
+		return hash, nil
+	}
+	hash, err := deriveHashFromFile(filePath, fileIndex.hashAlgorithm)
+	if err != nil {
+		return "", err
+	}
+	fileIndex.mutex.Lock()
+	fingerprint.hash = hash
+	fileIndex.mutex.Unlock()
+	if fileIndex.hashCache != nil {
+		fileIndex.hashCache.Put(filePath, fingerprint.fileInfo, hashCacheEntry{Hash: hash})
+	}
+	return hash, nil
+}
+
+func deriveHashFromFile(filePath string, hashAlgorithm string) (string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return "", err
@@ -89,11 +489,91 @@ func deriveHashFromFile(filePath string) (string, error) {
 	}
 
 	defer file.Close()
-	hash := md5.New()
+	hash := hashAlgorithms[hashAlgorithm]()
 	if _, err := io.Copy(hash, file); err != nil {
 		return "", err
 	}
-	hashInBytes := hash.Sum(nil)[:16]
-	result := hex.EncodeToString(hashInBytes) + fileSizeExtension
+	result := hex.EncodeToString(hash.Sum(nil)) + fileSizeExtension
+	return result, nil
+}
+
+// derivePartialHashFromFile hashes the head and the tail of the file, which is enough to tell apart most files of the same size without reading them entirely.
+func derivePartialHashFromFile(filePath string, hashAlgorithm string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	hash := hashAlgorithms[hashAlgorithm]()
+	if _, err := io.CopyN(hash, file, partialHashChunkSize); err != nil && err != io.EOF {
+		return "", err
+	}
+	if tailOffset := fileInfo.Size() - partialHashChunkSize; tailOffset > partialHashChunkSize {
+		if _, err := io.Copy(hash, io.NewSectionReader(file, tailOffset, partialHashChunkSize)); err != nil {
+			return "", err
+		}
+	} else if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	result := hex.EncodeToString(hash.Sum(nil)) + "-" + strconv.FormatInt(fileInfo.Size(), 10)
 	return result, nil
 }
+
+// compareFileContents compares the files byte by byte, remembering the result for the first file.
+func (fileIndex FileIndex) compareFileContents(filePath string, fingerprint *fileFingerprint, otherFilePath string) (bool, error) {
+	fileIndex.mutex.Lock()
+	isEqual, isCompared := fingerprint.comparedTo[otherFilePath]
+	fileIndex.mutex.Unlock()
+	if isCompared {
+		return isEqual, nil
+	}
+	isEqual, err := compareFileContents(filePath, otherFilePath)
+	if err != nil {
+		return false, err
+	}
+	fileIndex.mutex.Lock()
+	defer fileIndex.mutex.Unlock()
+	if fingerprint.comparedTo == nil {
+		fingerprint.comparedTo = make(map[string]bool)
+	}
+	fingerprint.comparedTo[otherFilePath] = isEqual
+	return isEqual, nil
+}
+
+// compareFileContents determines whether the two files have identical content, byte by byte.
+func compareFileContents(filePath1 string, filePath2 string) (bool, error) {
+	file1, err := os.Open(filePath1)
+	if err != nil {
+		return false, err
+	}
+	defer file1.Close()
+	file2, err := os.Open(filePath2)
+	if err != nil {
+		return false, err
+	}
+	defer file2.Close()
+
+	buffer1 := make([]byte, byteCompareChunkSize)
+	buffer2 := make([]byte, byteCompareChunkSize)
+	for {
+		count1, err1 := io.ReadFull(file1, buffer1)
+		count2, err2 := io.ReadFull(file2, buffer2)
+		if !bytes.Equal(buffer1[:count1], buffer2[:count2]) {
+			return false, nil
+		}
+		isEnd1 := err1 == io.EOF || err1 == io.ErrUnexpectedEOF
+		isEnd2 := err2 == io.EOF || err2 == io.ErrUnexpectedEOF
+		if err1 != nil && !isEnd1 {
+			return false, err1
+		} else if err2 != nil && !isEnd2 {
+			return false, err2
+		} else if isEnd1 || isEnd2 {
+			return isEnd1 && isEnd2, nil
+		}
+	}
+}
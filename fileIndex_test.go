@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestIndexSkipsLibraryLinkDirs checks that hard links in the favorites and albums folders are neither indexed nor found as duplicates, so that a sort never rejects or replaces them in place of the sorted file.
+func TestIndexSkipsLibraryLinkDirs(t *testing.T) {
+	libDir := t.TempDir()
+	sortedPath := filepath.Join(libDir, "2019", "a.jpg")
+	writeTestFile(t, sortedPath, "photo")
+	for _, linkDir := range libraryLinkDirs(libDir) {
+		linkPath := filepath.Join(linkDir, "Trip", "a.jpg")
+		if err := os.MkdirAll(filepath.Dir(linkPath), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Link(sortedPath, linkPath); err != nil {
+			t.Skip("hard links not supported:", err)
+		}
+	}
+	incomingPath := filepath.Join(t.TempDir(), "a.jpg")
+	writeTestFile(t, incomingPath, "photo")
+
+	fileIndex := NewFileIndex(defaultHashAlgorithm, nil, false, libraryLinkDirs(libDir), 1)
+	if err := fileIndex.BuildIndexForDirectory(libDir); err != nil {
+		t.Fatal(err)
+	}
+	if groups := fileIndex.FindDuplicateGroups(); len(groups) != 0 {
+		t.Errorf("FindDuplicateGroups = %v, expected none", groups)
+	}
+	duplicatePath, err := fileIndex.FindDuplicate(incomingPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duplicatePath != sortedPath {
+		t.Errorf("FindDuplicate = %q, expected %q", duplicatePath, sortedPath)
+	}
+}
+
+func TestDeriveHashFromFile(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "a.txt")
+	writeTestFile(t, filePath, "abc")
+	tests := map[string]string{
+		"blake3": "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85",
+		"md5":    "900150983cd24fb0d6963f7d28e17f72",
+		"sha256": "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+	}
+	for hashAlgorithm, expected := range tests {
+		hash, err := deriveHashFromFile(filePath, hashAlgorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash != expected+"-3" {
+			t.Errorf("%s hash = %s, expected %s-3", hashAlgorithm, hash, expected)
+		}
+	}
+}
@@ -1,27 +1,32 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 // FileMover moves files, with capability of "dry run".
 type FileMover struct {
-	isDryRun           bool
-	undoScriptFilePath string
+	isDryRun bool
+	journal  *UndoJournal
 }
 
-// NewFileMover creates a new FileMover with given dryrun state.
-func NewFileMover(isDryRun bool, undoScriptFilePath string) *FileMover {
+// NewFileMover creates a new FileMover with given dryrun state, recording operations in the given journal (which may be nil for a dry run).
+func NewFileMover(isDryRun bool, journal *UndoJournal) *FileMover {
 	result := new(FileMover)
 	result.isDryRun = isDryRun
-	result.undoScriptFilePath = undoScriptFilePath
+	result.journal = journal
 	return result
 }
 
@@ -29,23 +34,19 @@ func NewFileMover(isDryRun bool, undoScriptFilePath string) *FileMover {
 func (fileMover FileMover) MoveFileWithRename(sourcePath string, destPath string) (string, error) {
 	if !fileMover.isDryRun {
 		destDir := filepath.Dir(destPath)
-		if err := fileMover.writeUndoCommandForDirCreate(destDir); err != nil {
+		if err := fileMover.makeDirectories(destDir); err != nil {
 			return "", err
 		}
-		if err := os.MkdirAll(destDir, os.ModePerm); err != nil {
-			return "", err
-		}
-		destPath, err := getNonCollidingPath(destPath)
+		nonCollidingPath, err := getNonCollidingPath(destPath)
 		if err != nil {
 			return "", err
 		}
+		destPath = nonCollidingPath
 		log.Println("[INFO]", "Moving file", sourcePath, "to", destPath)
-		if err := fileMover.writeUndoCommandForFileMove(sourcePath, destPath); err != nil {
+		if err := fileMover.journal.RecordMove(sourcePath, destPath); err != nil {
 			return "", err
 		}
-		// I frequently get "invalid cross-device link" with os.Rename even on same partition.
-		//if err := os.Rename(sourcePath, destPath); err != nil {
-		if err := fileMover.moveFile(sourcePath, destPath); err != nil {
+		if err := moveFile(sourcePath, destPath); err != nil {
 			return "", err
 		}
 	} else {
@@ -54,19 +55,160 @@ func (fileMover FileMover) MoveFileWithRename(sourcePath string, destPath string
 	return destPath, nil
 }
 
-// MoveFileWithPreservedPath moves the specified source file (which must have the given root) to the specified destination root.  Returns the destination path.
+// MoveFileWithPreservedPath moves the specified source file (which must have the given root) to the specified destination root.  Returns the destination path, as renamed to avoid collision.
 func (fileMover FileMover) MoveFileWithPreservedPath(sourcePath string, sourceRoot string, destRoot string) (string, error) {
 	relPath, err := filepath.Rel(sourceRoot, sourcePath)
 	if err != nil {
 		return "", err
 	}
-	destPath := filepath.Join(destRoot, relPath)
-	if _, err = fileMover.MoveFileWithRename(sourcePath, destPath); err != nil {
+	return fileMover.MoveFileWithRename(sourcePath, filepath.Join(destRoot, relPath))
+}
+
+// CreateFile writes the content to a new file at the specified path, creating the directory if needed, and renaming the file if needed to avoid collision.  The file is synced to disk before it appears, with the given modification time.  Returns the path of the file.
+func (fileMover FileMover) CreateFile(destPath string, content io.Reader, modTime time.Time) (string, error) {
+	if fileMover.isDryRun {
+		log.Println("[INFO]", "Dryrun creating file", destPath)
+		return destPath, nil
+	}
+	if err := fileMover.makeDirectories(filepath.Dir(destPath)); err != nil {
+		return "", err
+	}
+	destPath, err := getNonCollidingPath(destPath)
+	if err != nil {
+		return "", err
+	}
+	tempFilePath := destPath + ".picsort-partial"
+	tempFile, err := os.OpenFile(tempFilePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	isComplete := false
+	defer func() {
+		if !isComplete {
+			tempFile.Close()
+			os.Remove(tempFilePath)
+		}
+	}()
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tempFile, hash), content); err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", tempFilePath, err)
+	}
+	if err := tempFile.Sync(); err != nil {
+		return "", fmt.Errorf("failed to sync %s: %w", tempFilePath, err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return "", fmt.Errorf("failed to close %s: %w", tempFilePath, err)
+	}
+	if !modTime.IsZero() {
+		if err := os.Chtimes(tempFilePath, modTime, modTime); err != nil {
+			return "", fmt.Errorf("failed to set modification time on %s: %w", tempFilePath, err)
+		}
+	}
+	log.Println("[DEBUG]", "Creating file", destPath)
+	if err := fileMover.journal.RecordCreate(destPath, hash.Sum(nil)); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tempFilePath, destPath); err != nil {
 		return "", err
 	}
+	isComplete = true
 	return destPath, nil
 }
 
+// LinkFile replaces the specified file with a hard link to the identical target file, or with a reflink (a copy-on-write clone, on filesystems such as Btrfs and XFS) if isReflink, so that their content is stored once.  The file is replaced atomically, and only once verified to be identical.
+func (fileMover FileMover) LinkFile(filePath string, targetPath string, isReflink bool) error {
+	if fileMover.isDryRun {
+		log.Println("[INFO]", "Dryrun linking file", filePath, "to", targetPath)
+		return nil
+	}
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	targetInfo, err := os.Stat(targetPath)
+	if err != nil {
+		return err
+	}
+	if os.SameFile(fileInfo, targetInfo) {
+		log.Println("[INFO]", "File", filePath, "is already linked to", targetPath)
+		return nil
+	}
+
+	tempFilePath := filePath + ".picsort-partial"
+	if isReflink {
+		err = cloneFile(targetPath, tempFilePath)
+	} else {
+		err = os.Link(targetPath, tempFilePath)
+	}
+	if err != nil {
+		return err
+	}
+	isComplete := false
+	defer func() {
+		if !isComplete {
+			os.Remove(tempFilePath)
+		}
+	}()
+	if isIdentical, err := compareFileContents(filePath, tempFilePath); err != nil {
+		return err
+	} else if !isIdentical {
+		return fmt.Errorf("%s differs from %s", filePath, targetPath)
+	}
+	if isReflink {
+		// A clone is a file of its own, so it can keep the attributes of the file it replaces.
+		if err := os.Chmod(tempFilePath, fileInfo.Mode().Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(tempFilePath, fileInfo.ModTime(), fileInfo.ModTime()); err != nil {
+			return err
+		}
+	}
+	log.Println("[INFO]", "Linking file", filePath, "to", targetPath)
+	if err := fileMover.journal.RecordLink(filePath, targetPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tempFilePath, filePath); err != nil {
+		return err
+	}
+	isComplete = true
+	return nil
+}
+
+// CreateLink creates a symbolic link (relative, so that the library can be moved) or a hard link at the specified path to the target file, creating the directory if needed, and renaming the link if needed to avoid collision.  Returns the path of the link.
+func (fileMover FileMover) CreateLink(linkPath string, targetPath string, isSymlink bool) (string, error) {
+	if fileMover.isDryRun {
+		log.Println("[INFO]", "Dryrun linking", linkPath, "to", targetPath)
+		return linkPath, nil
+	}
+	if err := fileMover.makeDirectories(filepath.Dir(linkPath)); err != nil {
+		return "", err
+	}
+	linkPath, err := getNonCollidingPath(linkPath)
+	if err != nil {
+		return "", err
+	}
+	log.Println("[INFO]", "Linking", linkPath, "to", targetPath)
+	if err := fileMover.journal.RecordCreateLink(linkPath, targetPath); err != nil {
+		return "", err
+	}
+	if !isSymlink {
+		return linkPath, os.Link(targetPath, linkPath)
+	}
+	absLinkDir, err := filepath.Abs(filepath.Dir(linkPath))
+	if err != nil {
+		return "", err
+	}
+	absTargetPath, err := filepath.Abs(targetPath)
+	if err != nil {
+		return "", err
+	}
+	relTargetPath, err := filepath.Rel(absLinkDir, absTargetPath)
+	if err != nil {
+		return "", err
+	}
+	return linkPath, os.Symlink(relTargetPath, linkPath)
+}
+
 // DeleteEmptyDirectories deletes any empty directories that can be deleted, rooted at the specified directory.
 func (fileMover FileMover) DeleteEmptyDirectories(dirPath string) error {
 	if !fileMover.isDryRun {
@@ -84,45 +226,144 @@ func (fileMover FileMover) DeleteEmptyDirectories(dirPath string) error {
 			}
 		}
 		log.Println("[INFO]", "Attempting to delete directory ", dirPath)
-		if err := fileMover.writeUndoCommandForDirDelete(dirPath); err != nil {
-			return err
+		if err := os.Remove(dirPath); err == nil {
+			if err := fileMover.journal.RecordRmdir(dirPath); err != nil {
+				return err
+			}
 		}
-		os.Remove(dirPath)
 	} else {
 		log.Println("[INFO]", "Dryrun deleting directory", dirPath)
 	}
 	return nil
 }
 
-func (fileMover FileMover) moveFile(sourceFilePath string, destFilePath string) error {
-	_, err := exec.Command("rsync", "-a", "--remove-source-files", sourceFilePath, destFilePath).Output()
-	return err
+// makeDirectories creates the given directory and any missing parents, journaling each one created.
+func (fileMover FileMover) makeDirectories(dirPath string) error {
+	var missingDirPaths []string
+	for missingDirPath := dirPath; ; missingDirPath = filepath.Dir(missingDirPath) {
+		if _, err := os.Stat(missingDirPath); err == nil {
+			break
+		}
+		missingDirPaths = append(missingDirPaths, missingDirPath)
+		if filepath.Dir(missingDirPath) == missingDirPath {
+			break
+		}
+	}
+	for i := len(missingDirPaths) - 1; i >= 0; i-- {
+		if err := fileMover.journal.RecordMkdir(missingDirPaths[i]); err != nil {
+			return err
+		}
+		if err := os.Mkdir(missingDirPaths[i], os.ModePerm); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return nil
 }
 
-func (fileMover FileMover) writeUndoCommandForFileMove(sourceFilePath string, destFilePath string) error {
-	return fileMover.writeUndoCommand("rsync -avh --progress --remove-source-files \"" + destFilePath + "\" \"" + sourceFilePath + "\"")
+// moveFile renames the file, falling back to a verified copy when the destination is on another device.
+func moveFile(sourceFilePath string, destFilePath string) error {
+	err := os.Rename(sourceFilePath, destFilePath)
+	if err == nil {
+		return nil
+	}
+	// I frequently get "invalid cross-device link" with os.Rename even on same partition.
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	log.Println("[DEBUG]", "Copying across devices", sourceFilePath, "to", destFilePath)
+	if err := copyFileVerified(sourceFilePath, destFilePath); err != nil {
+		return err
+	}
+	if err := os.Remove(sourceFilePath); err != nil {
+		return fmt.Errorf("copied %s to %s but failed to remove the source: %w", sourceFilePath, destFilePath, err)
+	}
+	return nil
 }
 
-func (fileMover FileMover) writeUndoCommandForDirDelete(dirPath string) error {
-	return fileMover.writeUndoCommand("mkdir \"" + dirPath + "\"")
-}
+// copyFileVerified copies the file via a temporary file in the destination directory, syncs it to disk, verifies its checksum, and preserves permissions and modification time.  Does not overwrite an existing destination.
+func copyFileVerified(sourceFilePath string, destFilePath string) error {
+	sourceFile, err := os.Open(sourceFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to open source %s: %w", sourceFilePath, err)
+	}
+	defer sourceFile.Close()
+	sourceInfo, err := sourceFile.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat source %s: %w", sourceFilePath, err)
+	}
 
-func (fileMover FileMover) writeUndoCommandForDirCreate(dirPath string) error {
-	return fileMover.writeUndoCommand("rmdir \"" + dirPath + "\"")
-}
+	tempFilePath := destFilePath + ".picsort-partial"
+	tempFile, err := os.OpenFile(tempFilePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, sourceInfo.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file %s: %w", tempFilePath, err)
+	}
+	isComplete := false
+	defer func() {
+		if !isComplete {
+			tempFile.Close()
+			os.Remove(tempFilePath)
+		}
+	}()
 
-func (fileMover FileMover) writeUndoCommand(undoCommand string) error {
-	f, err := os.OpenFile(fileMover.undoScriptFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0744)
+	sourceHash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tempFile, sourceHash), sourceFile); err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %w", sourceFilePath, tempFilePath, err)
+	}
+	if err := tempFile.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", tempFilePath, err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", tempFilePath, err)
+	}
+
+	destHash, err := hashFileSha256(tempFilePath)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to verify %s: %w", tempFilePath, err)
 	}
-	defer f.Close()
-	if _, err := f.WriteString(undoCommand + "\n"); err != nil {
-		return err
+	if !bytes.Equal(sourceHash.Sum(nil), destHash) {
+		return fmt.Errorf("checksum mismatch after copying %s to %s", sourceFilePath, tempFilePath)
 	}
+	if err := os.Chmod(tempFilePath, sourceInfo.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to preserve permissions on %s: %w", tempFilePath, err)
+	}
+	if err := os.Chtimes(tempFilePath, sourceInfo.ModTime(), sourceInfo.ModTime()); err != nil {
+		return fmt.Errorf("failed to preserve modification time on %s: %w", tempFilePath, err)
+	}
+
+	if _, err := os.Lstat(destFilePath); !os.IsNotExist(err) {
+		return fmt.Errorf("destination %s appeared during copy", destFilePath)
+	}
+	if err := os.Rename(tempFilePath, destFilePath); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", tempFilePath, destFilePath, err)
+	}
+	isComplete = true
+	syncDir(filepath.Dir(destFilePath))
 	return nil
 }
 
+func hashFileSha256(filePath string) ([]byte, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// syncDir flushes directory entries to disk, where supported.
+func syncDir(dirPath string) {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+	dir.Sync()
+}
+
 func getNonCollidingPath(path string) (string, error) {
 	var i int
 	var resultPath = path
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestMoveFileWithPreservedPathReturnsRenamedPath checks that the path returned is where the file was moved, when an earlier file took the preserved path.
+func TestMoveFileWithPreservedPathReturnsRenamedPath(t *testing.T) {
+	dirPath := t.TempDir()
+	incomingDir := filepath.Join(dirPath, "in")
+	destRoot := filepath.Join(dirPath, "originals")
+	writeTestFile(t, filepath.Join(destRoot, "Takeout", "a.jpg"), "earlier")
+	writeTestFile(t, filepath.Join(incomingDir, "Takeout", "a.jpg"), "photo")
+	fileMover, _ := newTestFileMover(t, dirPath, false)
+
+	destPath, err := fileMover.MoveFileWithPreservedPath(filepath.Join(incomingDir, "Takeout", "a.jpg"), incomingDir, destRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := filepath.Join(destRoot, "Takeout", "a.1.jpg"); destPath != expected {
+		t.Errorf("MoveFileWithPreservedPath = %q, expected %q", destPath, expected)
+	}
+	assertFileContent(t, destPath, "photo")
+	assertFileContent(t, filepath.Join(destRoot, "Takeout", "a.jpg"), "earlier")
+}
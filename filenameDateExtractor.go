@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// filenameDatePattern is a regex for a filename convention, using the named groups "year", "month", "day", and optionally "hour", "minute", "second".
+type filenameDatePattern struct {
+	name  string
+	regex *regexp.Regexp
+	isUTC bool // whether the time in the filename is UTC rather than local
+}
+
+// builtInFilenameDatePatterns are the well-known filename conventions, matched against the base filename.
+var builtInFilenameDatePatterns = []filenameDatePattern{
+	// IMG-20190710-WA0003.jpg
+	{name: "whatsapp", regex: regexp.MustCompile(`^(?:IMG|VID|AUD|PTT|STK|DOC)-(?P<year>\d{4})(?P<month>\d{2})(?P<day>\d{2})-WA\d+`)},
+	// PXL_20210101_123456789.jpg
+	{name: "pixel", regex: regexp.MustCompile(`^PXL_(?P<year>\d{4})(?P<month>\d{2})(?P<day>\d{2})_(?P<hour>\d{2})(?P<minute>\d{2})(?P<second>\d{2})`), isUTC: true},
+	// IMG_20190710_142419.jpg, VID_20190710_142419.mp4
+	{name: "android", regex: regexp.MustCompile(`^(?:IMG|VID|MVIMG|PANO|BURST\d*)_(?P<year>\d{4})(?P<month>\d{2})(?P<day>\d{2})_(?P<hour>\d{2})(?P<minute>\d{2})(?P<second>\d{2})`)},
+	// 20190710_142419.jpg
+	{name: "samsung", regex: regexp.MustCompile(`^(?P<year>\d{4})(?P<month>\d{2})(?P<day>\d{2})_(?P<hour>\d{2})(?P<minute>\d{2})(?P<second>\d{2})`)},
+	// Screenshot_2020-05-01-10-22-33.png, Screenshot_20200501-102233.png
+	{name: "screenshot", regex: regexp.MustCompile(`^Screenshot[_ -](?P<year>\d{4})-?(?P<month>\d{2})-?(?P<day>\d{2})[-_ ](?P<hour>\d{2})[-.]?(?P<minute>\d{2})[-.]?(?P<second>\d{2})`)},
+	// signal-2020-05-01-102233.jpg, signal-2021-03-04-10-22-33-123.jpg
+	{name: "signal", regex: regexp.MustCompile(`^signal-(?P<year>\d{4})-(?P<month>\d{2})-(?P<day>\d{2})-(?P<hour>\d{2})-?(?P<minute>\d{2})-?(?P<second>\d{2})`)},
+	// 2019-07-10 14.24.19.jpg (e.g. Dropbox camera uploads)
+	{name: "iso", regex: regexp.MustCompile(`^(?P<year>\d{4})-(?P<month>\d{2})-(?P<day>\d{2})[ _T](?P<hour>\d{2})[.:-](?P<minute>\d{2})[.:-](?P<second>\d{2})`)},
+}
+
+// FilenameDateExtractor extracts the capture date from well-known filename conventions, plus user-defined patterns.
+type FilenameDateExtractor struct {
+	patterns []filenameDatePattern
+}
+
+// NewFilenameDateExtractor creates a FilenameDateExtractor with the built-in patterns preceded by the given user-defined regexes.
+func NewFilenameDateExtractor(userPatterns []string) (*FilenameDateExtractor, error) {
+	result := new(FilenameDateExtractor)
+	for i, userPattern := range userPatterns {
+		regex, err := regexp.Compile(userPattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range []string{"year", "month", "day"} {
+			if regex.SubexpIndex(group) < 0 {
+				return nil, errors.New("filename pattern '" + userPattern + "' is missing the named group (?P<" + group + ">...)")
+			}
+		}
+		result.patterns = append(result.patterns, filenameDatePattern{name: "user" + strconv.Itoa(i+1), regex: regex})
+	}
+	result.patterns = append(result.patterns, builtInFilenameDatePatterns...)
+	return result, nil
+}
+
+// Name identifies the source.
+func (extractor FilenameDateExtractor) Name() string {
+	return "filename"
+}
+
+// ExtractDate extracts the date from the first pattern that matches the filename with a plausible date.
+func (extractor FilenameDateExtractor) ExtractDate(mediaFile *MediaFile) (CaptureTime, error) {
+	filename := filepath.Base(mediaFile.Path)
+	for _, pattern := range extractor.patterns {
+		match := pattern.regex.FindStringSubmatch(filename)
+		if match == nil {
+			continue
+		}
+		timestamp, err := parseFilenameDateMatch(pattern, match)
+		if err != nil {
+			continue
+		}
+		return timestamp, nil
+	}
+	return CaptureTime{}, errors.New("no date pattern matches filename")
+}
+
+func parseFilenameDateMatch(pattern filenameDatePattern, match []string) (CaptureTime, error) {
+	var parts [6]int
+	for i, group := range []string{"year", "month", "day", "hour", "minute", "second"} {
+		index := pattern.regex.SubexpIndex(group)
+		if index < 0 || match[index] == "" {
+			continue
+		}
+		value, err := strconv.Atoi(strings.TrimSpace(match[index]))
+		if err != nil {
+			return CaptureTime{}, err
+		}
+		parts[i] = value
+	}
+	result := time.Date(parts[0], time.Month(parts[1]), parts[2], parts[3], parts[4], parts[5], 0, time.UTC)
+	// Reject dates that time.Date had to normalize (e.g. month 13), and implausible years.
+	if result.Year() != parts[0] || int(result.Month()) != parts[1] || result.Day() != parts[2] ||
+		result.Hour() != parts[3] || result.Minute() != parts[4] || result.Second() != parts[5] {
+		return CaptureTime{}, errors.New("invalid date in filename")
+	}
+	if result.Year() < 1900 || result.After(time.Now().Add(24*time.Hour)) {
+		return CaptureTime{}, errors.New("implausible date in filename")
+	}
+	if pattern.isUTC {
+		return NewInstantCaptureTime(result), nil
+	}
+	return NewLocalCaptureTime(result), nil
+}
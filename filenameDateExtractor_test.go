@@ -0,0 +1,114 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFilenameDateExtractorBuiltInPatterns(t *testing.T) {
+	extractor, err := NewFilenameDateExtractor(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2019, 7, 10, 0, 0, 0, 0, time.UTC)
+	timestamp := time.Date(2019, 7, 10, 14, 24, 19, 0, time.UTC)
+	tests := []struct {
+		filename string
+		expected CaptureTime
+	}{
+		// whatsapp, which has no time of day
+		{"IMG-20190710-WA0003.jpg", NewLocalCaptureTime(day)},
+		{"VID-20190710-WA0012.mp4", NewLocalCaptureTime(day)},
+		{"PTT-20190710-WA0001.opus", NewLocalCaptureTime(day)},
+		// pixel, whose time is UTC
+		{"PXL_20190710_142419123.jpg", NewInstantCaptureTime(timestamp)},
+		{"PXL_20190710_142419123.MP.jpg", NewInstantCaptureTime(timestamp)},
+		// android
+		{"IMG_20190710_142419.jpg", NewLocalCaptureTime(timestamp)},
+		{"VID_20190710_142419.mp4", NewLocalCaptureTime(timestamp)},
+		{"MVIMG_20190710_142419.jpg", NewLocalCaptureTime(timestamp)},
+		{"PANO_20190710_142419.jpg", NewLocalCaptureTime(timestamp)},
+		{"BURST001_20190710_142419.jpg", NewLocalCaptureTime(timestamp)},
+		// samsung
+		{"20190710_142419.jpg", NewLocalCaptureTime(timestamp)},
+		{"20190710_142419(0).jpg", NewLocalCaptureTime(timestamp)},
+		// screenshot
+		{"Screenshot_2019-07-10-14-24-19.png", NewLocalCaptureTime(timestamp)},
+		{"Screenshot_20190710-142419.png", NewLocalCaptureTime(timestamp)},
+		{"Screenshot 2019-07-10 14.24.19.png", NewLocalCaptureTime(timestamp)},
+		// signal
+		{"signal-2019-07-10-142419.jpg", NewLocalCaptureTime(timestamp)},
+		{"signal-2019-07-10-14-24-19-123.jpg", NewLocalCaptureTime(timestamp)},
+		// iso
+		{"2019-07-10 14.24.19.jpg", NewLocalCaptureTime(timestamp)},
+		{"2019-07-10_14-24-19.jpg", NewLocalCaptureTime(timestamp)},
+		{"2019-07-10T14:24:19.jpg", NewLocalCaptureTime(timestamp)},
+		// no match, or an invalid or implausible date
+		{"IMG_1234.jpg", CaptureTime{}},
+		{"BURST20190710142419_COVER.jpg", CaptureTime{}},
+		{"holiday IMG_20190710_142419.jpg", CaptureTime{}},
+		{"IMG_20191310_142419.jpg", CaptureTime{}},
+		{"IMG_20190710_246019.jpg", CaptureTime{}},
+		{"IMG_18990710_142419.jpg", CaptureTime{}},
+		{"IMG_29990710_142419.jpg", CaptureTime{}},
+	}
+	for _, test := range tests {
+		t.Run(test.filename, func(t *testing.T) {
+			captureTime, err := extractor.ExtractDate(NewMediaFile(filepath.Join("incoming", test.filename), nil))
+			if test.expected.Time.IsZero() {
+				if err == nil {
+					t.Errorf("ExtractDate = %+v, expected an error", captureTime)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if captureTime.Kind != test.expected.Kind || !captureTime.Time.Equal(test.expected.Time) {
+				t.Errorf("ExtractDate = %+v, expected %+v", captureTime, test.expected)
+			}
+		})
+	}
+}
+
+func TestFilenameDateExtractorUserPatterns(t *testing.T) {
+	extractor, err := NewFilenameDateExtractor([]string{`^Photo (?P<day>\d{2})\.(?P<month>\d{2})\.(?P<year>\d{4})`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		filename string
+		expected CaptureTime
+	}{
+		{"Photo 10.07.2019.jpg", NewLocalCaptureTime(time.Date(2019, 7, 10, 0, 0, 0, 0, time.UTC))},
+		{"Photo 31.02.2019.jpg", CaptureTime{}},
+		// built-in patterns still apply after the user-defined ones
+		{"IMG_20190710_142419.jpg", NewLocalCaptureTime(time.Date(2019, 7, 10, 14, 24, 19, 0, time.UTC))},
+	}
+	for _, test := range tests {
+		t.Run(test.filename, func(t *testing.T) {
+			captureTime, err := extractor.ExtractDate(NewMediaFile(test.filename, nil))
+			if test.expected.Time.IsZero() {
+				if err == nil {
+					t.Errorf("ExtractDate = %+v, expected an error", captureTime)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if captureTime.Kind != test.expected.Kind || !captureTime.Time.Equal(test.expected.Time) {
+				t.Errorf("ExtractDate = %+v, expected %+v", captureTime, test.expected)
+			}
+		})
+	}
+
+	for _, userPattern := range []string{`(?P<year>\d{4})(?P<month>\d{2})`, `(?P<year>\d{4}`} {
+		t.Run(userPattern, func(t *testing.T) {
+			if _, err := NewFilenameDateExtractor([]string{userPattern}); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"path/filepath"
@@ -11,66 +14,217 @@ import (
 	"time"
 )
 
-// GooglePhotoMetadata represents the metadata stored in a Google Photos JSON file.
+// GooglePhotoMetadata represents the metadata stored in a Google Photos JSON file.  Fields absent from the file are zero.
 type GooglePhotoMetadata struct {
-	IsTrashed      bool
+	Title          string // the original file name
+	Description    string
 	PhotoTakenTime time.Time
+	CreationTime   time.Time      // when uploaded
+	GeoData        *GoogleGeoData // nil if absent or unknown
+	GeoDataExif    *GoogleGeoData // nil if absent or unknown
+	Latitude       float64        // from "geoData", else "geoDataExif"; Google uses 0.0 for unknown
+	Longitude      float64
+	People         []string // names of the people tagged
+	IsTrashed      bool
+	IsFavorited    bool
+	IsArchived     bool
+	Origin         GooglePhotosOrigin
+	URL            string
+}
+
+// GoogleGeoData is a location in Google Photos metadata.
+type GoogleGeoData struct {
+	Latitude  float64
+	Longitude float64
+	Altitude  float64
 }
 
-// NewGooglePhotoMetadata creates a new metadata instance from the given picture filename.  The convention is <picname>.json
-func NewGooglePhotoMetadata(picFilePath string, matchLivePhotos bool) (*GooglePhotoMetadata, string, error) {
+// GooglePhotosOrigin describes how a photo came to Google Photos, from "googlePhotosOrigin".
+type GooglePhotosOrigin struct {
+	Kind         string // e.g. "mobileUpload", "webUpload", "fromSharedAlbum", "fromPartnerSharing", or "composition"
+	DeviceType   string // for mobile uploads, e.g. "ANDROID_PHONE" or "IOS_PHONE"
+	DeviceFolder string // for mobile uploads, the folder on the device, e.g. "Camera" or "WhatsApp Images"
+	AppPackage   string // for mobile uploads from another app, e.g. "com.whatsapp"
+}
+
+// NewGooglePhotoMetadata creates a new metadata instance for the given picture file, from the sidecar found by the resolver.  Returns the path of the sidecar.
+func NewGooglePhotoMetadata(picFilePath string, resolver *SidecarResolver) (*GooglePhotoMetadata, string, error) {
 	log.Println("[DEBUG] Looking for metadata for", picFilePath)
+	metadataFilePath := resolver.Resolve(picFilePath)
+	if len(metadataFilePath) == 0 {
+		return nil, "(no Google metadata file path found)", errors.New("no Google metadata file found for " + picFilePath)
+	}
+	file, err := ioutil.ReadFile(metadataFilePath)
+	if err != nil {
+		return nil, metadataFilePath, err
+	}
 	result := GooglePhotoMetadata{}
-	metadataFilePaths := getMetadataFilenames(picFilePath, matchLivePhotos)
-	var err error = nil
-	var metadataFilePath string = "(no Google metadata file path found)"
-	if isMetadataUnamgibuous(picFilePath, metadataFilePaths) {
-		var file []byte
-		for _, metadataFilePath = range metadataFilePaths {
-			file, err = ioutil.ReadFile(metadataFilePath)
-			if err == nil {
-				err = json.Unmarshal(file, &result)
-				if err != nil {
-					log.Println("[WARN] Failed to unmarshal Google metadata file:", metadataFilePath, err)
-					return nil, metadataFilePath, err
-				}
-				log.Println("[DEBUG] Using Google metadata file:", metadataFilePath)
-				log.Println("[DEBUG]", picFilePath, "IsTrashed:", result.IsTrashed, "PhotoTakenTime:", result.PhotoTakenTime)
-
-				return &result, metadataFilePath, nil
-			}
+	if err := json.Unmarshal(file, &result); err != nil {
+		log.Println("[WARN] Failed to unmarshal Google metadata file:", metadataFilePath, err)
+		return nil, metadataFilePath, err
+	}
+	log.Println("[DEBUG] Using Google metadata file:", metadataFilePath)
+	log.Println("[DEBUG]", picFilePath, "IsTrashed:", result.IsTrashed, "PhotoTakenTime:", result.PhotoTakenTime)
+	return &result, metadataFilePath, nil
+}
+
+// googlePhotoMetadataJSON mirrors the JSON format.
+type googlePhotoMetadataJSON struct {
+	Title          *string                `json:"title"`
+	Description    *string                `json:"description"`
+	PhotoTakenTime *googleTimestampJSON   `json:"photoTakenTime"`
+	CreationTime   *googleTimestampJSON   `json:"creationTime"`
+	GeoData        *googleGeoDataJSON     `json:"geoData"`
+	GeoDataExif    *googleGeoDataJSON     `json:"geoDataExif"`
+	People         []googlePersonJSON     `json:"people"`
+	Trashed        *bool                  `json:"trashed"`
+	Favorited      *bool                  `json:"favorited"`
+	Archived       *bool                  `json:"archived"`
+	Origin         map[string]interface{} `json:"googlePhotosOrigin"`
+	URL            *string                `json:"url"`
+}
+
+type googleTimestampJSON struct {
+	Timestamp googleTimestampValue `json:"timestamp"`
+}
+
+// googleTimestampValue is a Unix time in seconds, written by Takeout as a string (e.g. "1562768659"), occasionally as a number, and sometimes empty when unknown.
+type googleTimestampValue string
+
+// UnmarshalJSON accepts a string, which may be empty, a number, or null.
+func (value *googleTimestampValue) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	if len(b) > 0 && b[0] == '"' {
+		var text string
+		if err := json.Unmarshal(b, &text); err != nil {
+			return err
 		}
-	} else {
-		log.Println("[WARN] Skipping Google metadata for", picFilePath, "because it could not be matched to the file with full confidence.")
+		*value = googleTimestampValue(strings.TrimSpace(text))
+		return nil
 	}
-	return nil, metadataFilePath, err
+	var number json.Number
+	if err := json.Unmarshal(b, &number); err != nil {
+		return err
+	}
+	*value = googleTimestampValue(number)
+	return nil
+}
+
+type googleGeoDataJSON struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude"`
+}
+
+type googlePersonJSON struct {
+	Name string `json:"name"`
 }
 
-// UnmarshalJSON unmarshalls the Google Metadata format into the values of interest.
+// UnmarshalJSON unmarshalls the Google Metadata format.  Returns an error, rather than guessing, if the document or any known field has an unexpected shape.
 func (metadata *GooglePhotoMetadata) UnmarshalJSON(b []byte) error {
+	var raw googlePhotoMetadataJSON
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		// The error names the field, e.g. "cannot unmarshal string into Go struct field googlePhotoMetadataJSON.trashed of type bool".
+		return fmt.Errorf("malformed Google metadata: %w", err)
+	}
 
-	var f interface{}
-	json.Unmarshal(b, &f)
-
-	allProps := f.(map[string]interface{})
-	photoTakenTimeMap := allProps["photoTakenTime"]
-	if photoTakenTimeMap != nil {
-		photoTakenTimeProps := photoTakenTimeMap.(map[string]interface{})
-		unixTimeString := photoTakenTimeProps["timestamp"].(string)
-		if unixTimeString != "" {
-			unixTimeInt64, err := strconv.ParseInt(unixTimeString, 10, 64)
-			if err == nil {
-				metadata.PhotoTakenTime = time.Unix(unixTimeInt64, 0)
-			}
+	result := GooglePhotoMetadata{}
+	if raw.Title != nil {
+		result.Title = *raw.Title
+	}
+	if raw.Description != nil {
+		result.Description = *raw.Description
+	}
+	var err error
+	if result.PhotoTakenTime, err = raw.PhotoTakenTime.parse(); err != nil {
+		return fmt.Errorf("malformed \"photoTakenTime\" in Google metadata: %w", err)
+	}
+	if result.CreationTime, err = raw.CreationTime.parse(); err != nil {
+		return fmt.Errorf("malformed \"creationTime\" in Google metadata: %w", err)
+	}
+	result.GeoData = raw.GeoData.toGeoData()
+	result.GeoDataExif = raw.GeoDataExif.toGeoData()
+	for _, geoData := range []*GoogleGeoData{result.GeoData, result.GeoDataExif} {
+		if geoData != nil {
+			result.Latitude = geoData.Latitude
+			result.Longitude = geoData.Longitude
+			break
 		}
 	}
+	for _, person := range raw.People {
+		if len(person.Name) > 0 {
+			result.People = append(result.People, person.Name)
+		}
+	}
+	result.IsTrashed = raw.Trashed != nil && *raw.Trashed
+	result.IsFavorited = raw.Favorited != nil && *raw.Favorited
+	result.IsArchived = raw.Archived != nil && *raw.Archived
+	if result.Origin, err = parseGooglePhotosOrigin(raw.Origin); err != nil {
+		return fmt.Errorf("malformed \"googlePhotosOrigin\" in Google metadata: %w", err)
+	}
+	if raw.URL != nil {
+		result.URL = *raw.URL
+	}
+	*metadata = result
+	return nil
+}
 
-	isTrashed := allProps["trashed"]
-	if isTrashed != nil {
-		metadata.IsTrashed = isTrashed.(bool)
+// parse returns the time of the timestamp, or the zero time if absent.
+func (timestamp *googleTimestampJSON) parse() (time.Time, error) {
+	if timestamp == nil || timestamp.Timestamp == "" {
+		return time.Time{}, nil
+	}
+	unixTime, err := strconv.ParseInt(string(timestamp.Timestamp), 10, 64)
+	if err != nil {
+		return time.Time{}, err
 	}
+	if unixTime == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(unixTime, 0), nil
+}
 
-	return nil
+// toGeoData returns the location, or nil if absent or unknown (Google uses 0.0 for unknown).
+func (geoData *googleGeoDataJSON) toGeoData() *GoogleGeoData {
+	if geoData == nil || (geoData.Latitude == 0 && geoData.Longitude == 0) {
+		return nil
+	}
+	return &GoogleGeoData{Latitude: geoData.Latitude, Longitude: geoData.Longitude, Altitude: geoData.Altitude}
+}
+
+// parseGooglePhotosOrigin interprets "googlePhotosOrigin", which holds a single object named for the kind of origin, e.g. {"mobileUpload": {"deviceType": "ANDROID_PHONE"}}.
+func parseGooglePhotosOrigin(origin map[string]interface{}) (GooglePhotosOrigin, error) {
+	var result GooglePhotosOrigin
+	for kind, details := range origin {
+		if len(result.Kind) > 0 {
+			return GooglePhotosOrigin{}, errors.New("more than one kind of origin")
+		}
+		result.Kind = kind
+		detailProps, ok := details.(map[string]interface{})
+		if !ok {
+			if details != nil {
+				return GooglePhotosOrigin{}, fmt.Errorf("%q is not an object", kind)
+			}
+			continue
+		}
+		result.DeviceType, _ = detailProps["deviceType"].(string)
+		if deviceFolderProps, ok := detailProps["deviceFolder"].(map[string]interface{}); ok {
+			result.DeviceFolder, _ = deviceFolderProps["localFolderName"].(string)
+		}
+		if appSourceProps, ok := detailProps["appSource"].(map[string]interface{}); ok {
+			result.AppPackage, _ = appSourceProps["androidPackageName"].(string)
+		}
+	}
+	return result, nil
+}
+
+// HasLocation determines whether the metadata includes the location where the photo was taken.
+func (metadata *GooglePhotoMetadata) HasLocation() bool {
+	return metadata.Latitude != 0 || metadata.Longitude != 0
 }
 
 func getMetadataFilenames(picFilePath string, matchLivePhotos bool) []string {
@@ -93,7 +247,8 @@ func getMetadataFilenames(picFilePath string, matchLivePhotos bool) []string {
 	return possibilities
 }
 
-func isMetadataUnamgibuous(picFilePath string, filenames []string) bool {
+// isMetadataUnamgibuous checks the names of the files in the directory of picFilePath, as listed before any were moved, for names that indicate ambiguity.
+func isMetadataUnamgibuous(picFilePath string, filenames []string, dirFileNames []string) bool {
 	// Situation:
 	// /folder/fileA.jpg
 	// /folder/fileA.JPG.json
@@ -104,13 +259,13 @@ func isMetadataUnamgibuous(picFilePath string, filenames []string) bool {
 	// Consider the metadata unambiguous if there is no indication of duplicate picfile or metadata filenames.
 
 	log.Println("[DEBUG] Checking pic filename for duplicates:", picFilePath)
-	if isFileDuplicated(picFilePath) {
+	if isFileDuplicated(picFilePath, dirFileNames) {
 		log.Println("[DEBUG] Treating metadata as ambiguous because picture file uses a potentially duplicated filename.")
 		return false
 	}
 	for _, filename := range filenames {
 		log.Println("[DEBUG] Checking potential metadata filename for duplicates:", filename)
-		if isFileDuplicated(filename) {
+		if isFileDuplicated(filename, dirFileNames) {
 			log.Println("[DEBUG] Treating metadata as ambiguous because metadata file uses a potentially duplicated filename.")
 			return false
 		}
@@ -118,16 +273,16 @@ func isMetadataUnamgibuous(picFilePath string, filenames []string) bool {
 	return true
 }
 
-func isFileDuplicated(filePath string) bool {
+func isFileDuplicated(filePath string, dirFileNames []string) bool {
 	regex := regexp.MustCompile(`(\([\d]+\))?(` + filepath.Ext(filePath) + "$)") // foo(1).png or foo.png
 	filePattern1 := string(regex.ReplaceAll([]byte(filePath), []byte("(*)$2")))  // foo(1).png -> foo(*).png
-	fileCount1, err := countFiles(filePattern1)
+	fileCount1, err := countFiles(filePattern1, dirFileNames)
 	if err != nil {
 		log.Println("[WARN] Assuming file duplication due to failure to list files for pattern:", filePattern1)
 		return true
 	}
 	filePattern2 := string(regex.ReplaceAll([]byte(filePath), []byte("$2"))) // foo(1).png -> foo.png
-	fileCount2, err := countFiles(filePattern2)
+	fileCount2, err := countFiles(filePattern2, dirFileNames)
 	if err != nil {
 		log.Println("[WARN] Assuming file duplication due to failure to list files for pattern:", filePattern2)
 		return true
@@ -135,11 +290,21 @@ func isFileDuplicated(filePath string) bool {
 	return (fileCount1 + fileCount2) > 1
 }
 
-func countFiles(filePattern string) (int, error) {
-	matches, err := filepath.Glob(filePattern)
-	if err != nil {
+// countFiles counts the file names that match the pattern, in the same directory.
+func countFiles(filePattern string, dirFileNames []string) (int, error) {
+	namePattern := filepath.Base(filePattern)
+	if _, err := filepath.Match(namePattern, ""); err != nil {
 		return 0, err
 	}
+	var matches []string
+	for _, fileName := range dirFileNames {
+		isMatch, err := filepath.Match(namePattern, fileName)
+		if err != nil {
+			return 0, err
+		} else if isMatch {
+			matches = append(matches, fileName)
+		}
+	}
 	log.Println("[TRACE] Checked files for pattern", filePattern, matches)
 	return len(matches), nil
 }
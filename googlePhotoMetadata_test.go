@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestGooglePhotoMetadataTimestamps(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		expected time.Time
+	}{
+		{"string", `{"photoTakenTime": {"timestamp": "1562768659"}}`, time.Unix(1562768659, 0)},
+		{"number", `{"photoTakenTime": {"timestamp": 1562768659}}`, time.Unix(1562768659, 0)},
+		{"empty string", `{"photoTakenTime": {"timestamp": ""}}`, time.Time{}},
+		{"null", `{"photoTakenTime": {"timestamp": null}}`, time.Time{}},
+		{"zero", `{"photoTakenTime": {"timestamp": "0"}}`, time.Time{}},
+		{"missing timestamp", `{"photoTakenTime": {"formatted": "Jul 10, 2019"}}`, time.Time{}},
+		{"missing photoTakenTime", `{"title": "IMG_1234.jpg"}`, time.Time{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var metadata GooglePhotoMetadata
+			if err := json.Unmarshal([]byte(test.document), &metadata); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !metadata.PhotoTakenTime.Equal(test.expected) {
+				t.Errorf("PhotoTakenTime = %v, expected %v", metadata.PhotoTakenTime, test.expected)
+			}
+		})
+	}
+}
+
+func TestGooglePhotoMetadataEmptyTimestampKeepsOtherFields(t *testing.T) {
+	var metadata GooglePhotoMetadata
+	document := `{"photoTakenTime": {"timestamp": ""}, "creationTime": {"timestamp": "1562768659"}, "trashed": true}`
+	if err := json.Unmarshal([]byte(document), &metadata); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !metadata.IsTrashed {
+		t.Error("IsTrashed = false, expected true")
+	}
+	if !metadata.CreationTime.Equal(time.Unix(1562768659, 0)) {
+		t.Errorf("CreationTime = %v", metadata.CreationTime)
+	}
+}
+
+func TestGooglePhotoMetadataMalformedTimestamp(t *testing.T) {
+	for _, document := range []string{
+		`{"photoTakenTime": {"timestamp": "soon"}}`,
+		`{"photoTakenTime": {"timestamp": true}}`,
+		`{"photoTakenTime": "1562768659"}`,
+	} {
+		var metadata GooglePhotoMetadata
+		if err := json.Unmarshal([]byte(document), &metadata); err == nil {
+			t.Errorf("expected an error for %s", document)
+		}
+	}
+}
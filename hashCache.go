@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// hashCacheVersion identifies the format of the hash cache file.
+const hashCacheVersion = 1
+
+// HashCache persists file hashes (full, partial, and perceptual) keyed by path, size, and modification time, so that unchanged files need not be rehashed on every run.  Only files within the root directory are cached, by path relative to it, so the library may be mounted elsewhere.  Each hash is appended to the file as it's cached, so that an interrupted run keeps the hashes it derived, and the file is compacted by Save.
+type HashCache struct {
+	filePath      string
+	rootDir       string
+	algorithm     string // the hash algorithm, so that a change of algorithm invalidates the cache
+	isReadOnly    bool   // e.g. for a dry run, in which the file is never written
+	entries       map[string]hashCacheEntry
+	isDirty       bool     // whether the file holds superseded or missing entries, to be compacted by Save
+	isFileCurrent bool     // whether the file holds a compatible header and only well-formed lines, so entries may be appended to it
+	appendFile    *os.File // opened on the first Put
+	appendErr     error
+	mutex         *sync.Mutex
+}
+
+type hashCacheHeader struct {
+	Version   int    `json:"version"`
+	Algorithm string `json:"algorithm"`
+}
+
+type hashCacheEntry struct {
+	Path           string `json:"path"`
+	Size           int64  `json:"size"`
+	ModTime        int64  `json:"mtime"` // Unix nanoseconds
+	Hash           string `json:"hash,omitempty"`
+	PartialHash    string `json:"partial,omitempty"`    // of the head and tail
+	PerceptualHash string `json:"perceptual,omitempty"` // of the decoded image, independent of the hash algorithm
+}
+
+// LoadHashCache loads the cache from the given file, or creates an empty cache if the file doesn't exist or is from an incompatible version or hash algorithm.  A read-only cache never writes the file.
+func LoadHashCache(filePath string, rootDir string, algorithm string, isReadOnly bool) (*HashCache, error) {
+	absRootDir, err := filepath.Abs(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	result := new(HashCache)
+	result.filePath = filePath
+	result.rootDir = absRootDir
+	result.algorithm = algorithm
+	result.isReadOnly = isReadOnly
+	result.entries = make(map[string]hashCacheEntry)
+	result.mutex = new(sync.Mutex)
+
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		log.Println("[INFO]", "Creating new hash cache", filePath)
+		return result, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	if !scanner.Scan() {
+		return result, scanner.Err()
+	}
+	var header hashCacheHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Version != hashCacheVersion || header.Algorithm != algorithm {
+		log.Println("[WARN]", "Ignoring incompatible hash cache", filePath)
+		result.isDirty = true
+		return result, nil
+	}
+	result.isFileCurrent = true
+	lineCount := 0
+	for scanner.Scan() {
+		var entry hashCacheEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// e.g. the last line appended by an interrupted run
+			log.Println("[WARN]", "Ignoring malformed entry in hash cache", filePath, ":", err)
+			result.isFileCurrent = false
+			continue
+		}
+		// Entries appended later supersede those before them.
+		result.entries[entry.Path] = entry
+		lineCount++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	result.isDirty = lineCount > len(result.entries)
+	log.Println("[INFO]", "Loaded", len(result.entries), "hashes from", filePath)
+	return result, nil
+}
+
+// Get returns the cached hashes for the given file, if the file is unchanged since they were cached.  Hashes that were not cached are "".
+func (cache *HashCache) Get(filePath string, fileInfo os.FileInfo) hashCacheEntry {
+	key, err := cache.key(filePath)
+	if err != nil {
+		return hashCacheEntry{}
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry, isPresent := cache.entries[key]
+	if !isPresent || entry.Size != fileInfo.Size() || entry.ModTime != fileInfo.ModTime().UnixNano() {
+		return hashCacheEntry{}
+	}
+	return entry
+}
+
+// Put caches the hashes of the given file that are not "", appending them to the file unless they were cached already.  Files outside the root directory are ignored.
+func (cache *HashCache) Put(filePath string, fileInfo os.FileInfo, hashes hashCacheEntry) {
+	key, err := cache.key(filePath)
+	if err != nil {
+		return
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry, isPresent := cache.entries[key]
+	if !isPresent || entry.Size != fileInfo.Size() || entry.ModTime != fileInfo.ModTime().UnixNano() {
+		entry = hashCacheEntry{Path: key, Size: fileInfo.Size(), ModTime: fileInfo.ModTime().UnixNano()}
+	}
+	if len(hashes.Hash) > 0 {
+		entry.Hash = hashes.Hash
+	}
+	if len(hashes.PartialHash) > 0 {
+		entry.PartialHash = hashes.PartialHash
+	}
+	if len(hashes.PerceptualHash) > 0 {
+		entry.PerceptualHash = hashes.PerceptualHash
+	}
+	if previousEntry, isPresent := cache.entries[key]; isPresent && previousEntry == entry {
+		return
+	}
+	if isPresent {
+		cache.isDirty = true
+	}
+	cache.entries[key] = entry
+	cache.appendEntry(entry)
+}
+
+// appendEntry appends the entry to the file, first rewriting the file if it can't be appended to.  Failure is logged once, leaving the entries to be written by Save.  The mutex must be held.
+func (cache *HashCache) appendEntry(entry hashCacheEntry) {
+	if cache.isReadOnly || cache.appendErr != nil {
+		return
+	}
+	if cache.appendFile == nil {
+		if !cache.isFileCurrent {
+			if cache.appendErr = cache.write(); cache.appendErr != nil {
+				log.Println("[WARN]", "Failed to write hash cache", cache.filePath, ":", cache.appendErr)
+				return
+			}
+			// The entry was just written.
+			return
+		}
+		cache.appendFile, cache.appendErr = os.OpenFile(cache.filePath, os.O_WRONLY|os.O_APPEND, 0644)
+		if cache.appendErr != nil {
+			log.Println("[WARN]", "Failed to open hash cache", cache.filePath, ":", cache.appendErr)
+			return
+		}
+	}
+	line, err := json.Marshal(entry)
+	if err == nil {
+		_, err = cache.appendFile.Write(append(line, '\n'))
+	}
+	if err != nil {
+		log.Println("[WARN]", "Failed to append to hash cache", cache.filePath, ":", err)
+		cache.appendErr = err
+	}
+}
+
+// IsCacheFile determines whether the given path is the cache file itself (or its temporary file), which must not be indexed.
+func (cache *HashCache) IsCacheFile(filePath string) bool {
+	absFilePath, err := filepath.Abs(filePath)
+	if err != nil {
+		return false
+	}
+	absCacheFilePath, err := filepath.Abs(cache.filePath)
+	if err != nil {
+		return false
+	}
+	return absFilePath == absCacheFilePath || absFilePath == absCacheFilePath+".tmp"
+}
+
+// Save compacts the file, if it holds superseded entries or entries for files that no longer exist, which are dropped.  The file is replaced atomically.
+func (cache *HashCache) Save() error {
+	if cache.isReadOnly {
+		return nil
+	}
+	// Files are checked without holding the mutex, since the library may be large.
+	cache.mutex.Lock()
+	entries := make([]hashCacheEntry, 0, len(cache.entries))
+	for _, entry := range cache.entries {
+		entries = append(entries, entry)
+	}
+	cache.mutex.Unlock()
+	var missingEntries []hashCacheEntry
+	for _, entry := range entries {
+		if _, err := os.Lstat(filepath.Join(cache.rootDir, filepath.FromSlash(entry.Path))); os.IsNotExist(err) {
+			missingEntries = append(missingEntries, entry)
+		}
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for _, entry := range missingEntries {
+		// Unless cached again meanwhile.
+		if cache.entries[entry.Path] == entry {
+			delete(cache.entries, entry.Path)
+			cache.isDirty = true
+		}
+	}
+	if !cache.isDirty && cache.isFileCurrent {
+		if cache.appendFile != nil {
+			return cache.closeAppendFile()
+		}
+		return nil
+	}
+	return cache.write()
+}
+
+// closeAppendFile closes the file opened for appending, if any.  The mutex must be held.
+func (cache *HashCache) closeAppendFile() error {
+	if cache.appendFile == nil {
+		return nil
+	}
+	err := cache.appendFile.Close()
+	cache.appendFile = nil
+	return err
+}
+
+// write replaces the file with all entries.  The mutex must be held.
+func (cache *HashCache) write() error {
+	if err := cache.closeAppendFile(); err != nil {
+		return err
+	}
+	tempFilePath := cache.filePath + ".tmp"
+	file, err := os.OpenFile(tempFilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFilePath)
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	if err := encoder.Encode(hashCacheHeader{Version: hashCacheVersion, Algorithm: cache.algorithm}); err != nil {
+		file.Close()
+		return err
+	}
+	var keys []string
+	for key := range cache.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := encoder.Encode(cache.entries[key]); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tempFilePath, cache.filePath); err != nil {
+		return err
+	}
+	cache.isDirty = false
+	cache.isFileCurrent = true
+	log.Println("[INFO]", "Saved", len(cache.entries), "hashes to", cache.filePath)
+	return nil
+}
+
+// key returns the path of the file relative to the root directory.
+func (cache *HashCache) key(filePath string) (string, error) {
+	absFilePath, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", err
+	}
+	relPath, err := filepath.Rel(cache.rootDir, absFilePath)
+	if err != nil {
+		return "", err
+	}
+	if relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", errors.New("file is outside the cached directory")
+	}
+	return filepath.ToSlash(relPath), nil
+}
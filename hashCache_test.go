@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestHashCacheKeepsHashesOfInterruptedRun checks that hashes are in the file as soon as they are cached, without Save, and that a truncated last line is dropped rather than appended to.
+func TestHashCacheKeepsHashesOfInterruptedRun(t *testing.T) {
+	libDir := t.TempDir()
+	cacheFilePath := filepath.Join(libDir, defaultIndexFile)
+	filePaths := []string{filepath.Join(libDir, "a.jpg"), filepath.Join(libDir, "b.jpg"), filepath.Join(libDir, "c.jpg")}
+	for _, filePath := range filePaths {
+		writeTestFile(t, filePath, filepath.Base(filePath))
+	}
+	put := func(cache *HashCache, filePath string) {
+		fileInfo, err := os.Stat(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.Put(filePath, fileInfo, hashCacheEntry{Hash: "hash of " + filepath.Base(filePath)})
+	}
+	assertCached := func(filePaths ...string) {
+		t.Helper()
+		cache, err := LoadHashCache(cacheFilePath, libDir, defaultHashAlgorithm, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, filePath := range filePaths {
+			fileInfo, err := os.Stat(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry := cache.Get(filePath, fileInfo); entry.Hash != "hash of "+filepath.Base(filePath) {
+				t.Errorf("%s has cached hash %q", filePath, entry.Hash)
+			}
+		}
+	}
+
+	cache, err := LoadHashCache(cacheFilePath, libDir, defaultHashAlgorithm, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(cache, filePaths[0])
+	put(cache, filePaths[1])
+	assertCached(filePaths[0], filePaths[1])
+
+	// As if interrupted while appending.
+	file, err := os.OpenFile(cacheFilePath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"path":"c.jpg","si`)
+	file.Close()
+	cache, err = LoadHashCache(cacheFilePath, libDir, defaultHashAlgorithm, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(cache, filePaths[2])
+	assertCached(filePaths...)
+
+	// Save drops the files that no longer exist.
+	if err := os.Remove(filePaths[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Save(); err != nil {
+		t.Fatal(err)
+	}
+	cache, err = LoadHashCache(cacheFilePath, libDir, defaultHashAlgorithm, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.entries) != 2 {
+		t.Errorf("entries = %+v, expected b.jpg and c.jpg", cache.entries)
+	}
+	assertCached(filePaths[1:]...)
+}
+
+func TestReadOnlyHashCacheIsNotWritten(t *testing.T) {
+	libDir := t.TempDir()
+	cacheFilePath := filepath.Join(libDir, defaultIndexFile)
+	filePath := filepath.Join(libDir, "a.jpg")
+	writeTestFile(t, filePath, "photo")
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := LoadHashCache(cacheFilePath, libDir, defaultHashAlgorithm, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Put(filePath, fileInfo, hashCacheEntry{Hash: "hash"})
+	if err := cache.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadFile(cacheFilePath); !os.IsNotExist(err) {
+		t.Errorf("cache file written: %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"strconv"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// heifBrands are the "ftyp" brands identifying HEIF still images (including HEIC and AVIF).
+var heifBrands = map[string]bool{
+	"mif1": true,
+	"msf1": true,
+	"heic": true,
+	"heix": true,
+	"heim": true,
+	"heis": true,
+	"hevc": true,
+	"hevx": true,
+	"avif": true,
+}
+
+// maxHeifExifItemSize guards against allocating huge buffers for corrupt "iloc" extents.
+const maxHeifExifItemSize = 16 * 1024 * 1024
+
+// heifItemLocation is an entry in the "iloc" box, locating the data of an item.
+type heifItemLocation struct {
+	constructionMethod uint64
+	baseOffset         uint64
+	extents            []heifExtent
+}
+
+type heifExtent struct {
+	offset uint64
+	length uint64
+}
+
+// isHeifFile determines whether the given file is a HEIF (e.g. HEIC) image, based on its "ftyp" brands.
+func isHeifFile(file *os.File) bool {
+	brands, err := readIsoFileType(file)
+	if err != nil {
+		return false
+	}
+	for _, brand := range brands {
+		if heifBrands[brand] {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeHeifExif finds the Exif item within the given HEIF file and decodes it.
+func decodeHeifExif(file *os.File) (*exif.Exif, error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	boxes, err := readIsoBoxes(file, 0, fileInfo.Size())
+	if err != nil && len(boxes) == 0 {
+		return nil, err
+	}
+	metaBox, isFound := findIsoBox(boxes, "meta")
+	if !isFound {
+		return nil, errors.New("no 'meta' box found in HEIF file")
+	}
+	metaChildren, err := readIsoChildBoxes(file, metaBox, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	iinfBox, isFound := findIsoBox(metaChildren, "iinf")
+	if !isFound {
+		return nil, errors.New("no 'iinf' box found in HEIF file")
+	}
+	exifItemID, err := findHeifExifItemID(file, iinfBox)
+	if err != nil {
+		return nil, err
+	}
+
+	ilocBox, isFound := findIsoBox(metaChildren, "iloc")
+	if !isFound {
+		return nil, errors.New("no 'iloc' box found in HEIF file")
+	}
+	ilocPayload, err := readIsoBoxPayload(file, ilocBox)
+	if err != nil {
+		return nil, err
+	}
+	locations, err := parseHeifItemLocations(ilocPayload)
+	if err != nil {
+		return nil, err
+	}
+	location, isFound := locations[exifItemID]
+	if !isFound {
+		return nil, errors.New("no location found for Exif item " + strconv.FormatUint(exifItemID, 10))
+	}
+
+	var dataOffset int64
+	switch location.constructionMethod {
+	case 0:
+		// Offsets are relative to the file.
+	case 1:
+		// Offsets are relative to the "idat" box.
+		idatBox, isFound := findIsoBox(metaChildren, "idat")
+		if !isFound {
+			return nil, errors.New("no 'idat' box found in HEIF file")
+		}
+		dataOffset = idatBox.offset
+	default:
+		return nil, errors.New("unsupported construction method for Exif item: " + strconv.FormatUint(location.constructionMethod, 10))
+	}
+	var itemData []byte
+	for _, extent := range location.extents {
+		if extent.length > maxHeifExifItemSize {
+			return nil, errors.New("Exif item is too large")
+		}
+		extentData := make([]byte, extent.length)
+		if _, err := file.ReadAt(extentData, dataOffset+int64(location.baseOffset+extent.offset)); err != nil {
+			return nil, err
+		}
+		itemData = append(itemData, extentData...)
+	}
+
+	// The Exif item begins with the offset to the TIFF header, which usually skips an "Exif\0\0" marker.
+	if len(itemData) < 4 {
+		return nil, errors.New("Exif item is too small")
+	}
+	tiffHeaderOffset := uint64(binary.BigEndian.Uint32(itemData[0:4]))
+	if 4+tiffHeaderOffset >= uint64(len(itemData)) {
+		return nil, errors.New("invalid TIFF header offset in Exif item")
+	}
+	return exif.Decode(bytes.NewReader(itemData[4+tiffHeaderOffset:]))
+}
+
+// findHeifExifItemID finds the ID of the Exif item among the "infe" entries of the "iinf" box.
+func findHeifExifItemID(file *os.File, iinfBox isoBox) (uint64, error) {
+	header, err := readIsoBoxPayload(file, isoBox{boxType: "iinf", offset: iinfBox.offset, size: 4})
+	if err != nil {
+		return 0, err
+	}
+	// version, flags, then entry_count which is 16 bits for version 0 or 32 bits otherwise.
+	entryCountSize := int64(2)
+	if header[0] != 0 {
+		entryCountSize = 4
+	}
+	infeBoxes, err := readIsoChildBoxes(file, iinfBox, 4+entryCountSize)
+	if err != nil && len(infeBoxes) == 0 {
+		return 0, err
+	}
+	for _, infeBox := range infeBoxes {
+		if infeBox.boxType != "infe" {
+			continue
+		}
+		payload, err := readIsoBoxPayload(file, infeBox)
+		if err != nil {
+			return 0, err
+		}
+		reader := isoReader{data: payload}
+		version := reader.readUint(1)
+		reader.readUint(3) // flags
+		if version < 2 {
+			// Versions 0 and 1 have no item type.
+			continue
+		}
+		itemIDSize := 2
+		if version >= 3 {
+			itemIDSize = 4
+		}
+		itemID := reader.readUint(itemIDSize)
+		reader.readUint(2) // item_protection_index
+		itemType := reader.readString(4)
+		if reader.err == nil && itemType == "Exif" {
+			return itemID, nil
+		}
+	}
+	return 0, errors.New("no Exif item found in HEIF file")
+}
+
+// parseHeifItemLocations parses the payload of the "iloc" box into locations by item ID.
+func parseHeifItemLocations(payload []byte) (map[uint64]heifItemLocation, error) {
+	reader := isoReader{data: payload}
+	version := reader.readUint(1)
+	reader.readUint(3) // flags
+	sizes := reader.readUint(2)
+	offsetSize := int(sizes >> 12 & 0xF)
+	lengthSize := int(sizes >> 8 & 0xF)
+	baseOffsetSize := int(sizes >> 4 & 0xF)
+	indexSize := 0
+	if version == 1 || version == 2 {
+		indexSize = int(sizes & 0xF)
+	}
+	var itemCount uint64
+	if version < 2 {
+		itemCount = reader.readUint(2)
+	} else {
+		itemCount = reader.readUint(4)
+	}
+
+	result := make(map[uint64]heifItemLocation)
+	for i := uint64(0); i < itemCount && reader.err == nil; i++ {
+		var itemID uint64
+		if version < 2 {
+			itemID = reader.readUint(2)
+		} else {
+			itemID = reader.readUint(4)
+		}
+		location := heifItemLocation{}
+		if version == 1 || version == 2 {
+			location.constructionMethod = reader.readUint(2) & 0xF
+		}
+		reader.readUint(2) // data_reference_index
+		location.baseOffset = reader.readUint(baseOffsetSize)
+		extentCount := reader.readUint(2)
+		for j := uint64(0); j < extentCount && reader.err == nil; j++ {
+			reader.readUint(indexSize) // extent_index
+			extent := heifExtent{}
+			extent.offset = reader.readUint(offsetSize)
+			extent.length = reader.readUint(lengthSize)
+			location.extents = append(location.extents, extent)
+		}
+		result[itemID] = location
+	}
+	if reader.err != nil {
+		return nil, reader.err
+	}
+	return result, nil
+}
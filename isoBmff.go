@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// isoBox is a box (a.k.a. atom) within an ISO base media file, the container format shared by HEIF, MP4, and QuickTime.
+type isoBox struct {
+	boxType string
+	offset  int64 // offset of the box payload (after the header)
+	size    int64 // size of the box payload (excluding the header)
+}
+
+// readIsoBoxes reads the headers of the sibling boxes found between the given offsets.
+func readIsoBoxes(r io.ReaderAt, offset int64, end int64) ([]isoBox, error) {
+	var boxes []isoBox
+	header := make([]byte, 16)
+	for offset+8 <= end {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			return boxes, err
+		}
+		size := int64(binary.BigEndian.Uint32(header[0:4]))
+		boxType := string(header[4:8])
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			// The box extends to the end of its container.
+			size = end - offset
+		case 1:
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				return boxes, err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+		if size < headerSize || offset+size > end {
+			return boxes, errors.New("invalid size for box '" + boxType + "' at offset " + strconv.FormatInt(offset, 10))
+		}
+		boxes = append(boxes, isoBox{boxType: boxType, offset: offset + headerSize, size: size - headerSize})
+		offset += size
+	}
+	return boxes, nil
+}
+
+// readIsoChildBoxes reads the boxes contained in the given box, skipping the specified number of leading payload bytes (e.g. 4 for the version and flags of a "full box").
+func readIsoChildBoxes(r io.ReaderAt, parent isoBox, skip int64) ([]isoBox, error) {
+	if parent.size < skip {
+		return nil, errors.New("box '" + parent.boxType + "' is too small")
+	}
+	return readIsoBoxes(r, parent.offset+skip, parent.offset+parent.size)
+}
+
+// findIsoBox returns the first box of the given type.
+func findIsoBox(boxes []isoBox, boxType string) (isoBox, bool) {
+	for _, box := range boxes {
+		if box.boxType == boxType {
+			return box, true
+		}
+	}
+	return isoBox{}, false
+}
+
+// readIsoBoxPayload reads the entire payload of the given box.
+func readIsoBoxPayload(r io.ReaderAt, box isoBox) ([]byte, error) {
+	payload := make([]byte, box.size)
+	if _, err := r.ReadAt(payload, box.offset); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// readIsoFileType reads the major and compatible brands from the "ftyp" box, which must be the first box in the file.
+func readIsoFileType(r io.ReaderAt) ([]string, error) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if string(header[4:8]) != "ftyp" {
+		return nil, errors.New("not an ISO base media file")
+	}
+	size := int64(binary.BigEndian.Uint32(header[0:4]))
+	if size < 16 || size > 4096 {
+		return nil, errors.New("invalid 'ftyp' box size")
+	}
+	payload, err := readIsoBoxPayload(r, isoBox{boxType: "ftyp", offset: 8, size: size - 8})
+	if err != nil {
+		return nil, err
+	}
+	// major_brand, minor_version, compatible_brands[]
+	brands := []string{string(payload[0:4])}
+	for i := 8; i+4 <= len(payload); i += 4 {
+		brands = append(brands, string(payload[i:i+4]))
+	}
+	return brands, nil
+}
+
+// isoReader reads big-endian fields sequentially from a box payload, tracking the first error.
+type isoReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (reader *isoReader) readUint(byteCount int) uint64 {
+	if reader.err != nil {
+		return 0
+	}
+	if reader.pos+byteCount > len(reader.data) {
+		reader.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	var result uint64
+	for _, b := range reader.data[reader.pos : reader.pos+byteCount] {
+		result = result<<8 | uint64(b)
+	}
+	reader.pos += byteCount
+	return result
+}
+
+func (reader *isoReader) readString(byteCount int) string {
+	if reader.err != nil {
+		return ""
+	}
+	if reader.pos+byteCount > len(reader.data) {
+		reader.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	result := string(reader.data[reader.pos : reader.pos+byteCount])
+	reader.pos += byteCount
+	return result
+}
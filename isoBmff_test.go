@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// isoTestBox encodes a box of the given type holding the concatenated payloads.
+func isoTestBox(boxType string, payloads ...[]byte) []byte {
+	payload := bytes.Join(payloads, nil)
+	var result bytes.Buffer
+	binary.Write(&result, binary.BigEndian, uint32(8+len(payload)))
+	result.WriteString(boxType)
+	result.Write(payload)
+	return result.Bytes()
+}
+
+// isoTestUint encodes the given value big-endian in the given number of bytes.
+func isoTestUint(value uint64, byteCount int) []byte {
+	result := make([]byte, 8)
+	binary.BigEndian.PutUint64(result, value)
+	return result[8-byteCount:]
+}
+
+// openIsoTestFile writes the given content to a temporary file and opens it.
+func openIsoTestFile(t *testing.T, content []byte) *os.File {
+	filePath := filepath.Join(t.TempDir(), "test.mp4")
+	if err := ioutil.WriteFile(filePath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return file
+}
+
+func TestReadIsoBoxes(t *testing.T) {
+	largeBox := append(append(isoTestUint(1, 4), "wide"...), isoTestUint(20, 8)...)
+	largeBox = append(largeBox, "abcd"...)
+	tests := []struct {
+		name     string
+		content  []byte
+		expected []isoBox
+		isError  bool
+	}{
+		{"siblings", append(isoTestBox("free", []byte("ab")), isoTestBox("mdat", []byte("cdef"))...), []isoBox{{"free", 8, 2}, {"mdat", 18, 4}}, false},
+		{"size 0 extends to the end", append(isoTestBox("free"), append(isoTestUint(0, 4), "mdat12345"...)...), []isoBox{{"free", 8, 0}, {"mdat", 16, 5}}, false},
+		{"64-bit size", largeBox, []isoBox{{"wide", 16, 4}}, false},
+		{"trailing bytes ignored", append(isoTestBox("free"), "abc"...), []isoBox{{"free", 8, 0}}, false},
+		{"size smaller than header", append(isoTestBox("free"), append(isoTestUint(4, 4), "moov"...)...), []isoBox{{"free", 8, 0}}, true},
+		{"size beyond the end", append(isoTestBox("free"), append(isoTestUint(100, 4), "moov"...)...), []isoBox{{"free", 8, 0}}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			boxes, err := readIsoBoxes(bytes.NewReader(test.content), 0, int64(len(test.content)))
+			if (err != nil) != test.isError {
+				t.Errorf("error = %v, expected an error %v", err, test.isError)
+			}
+			if len(boxes) != len(test.expected) {
+				t.Fatalf("boxes = %+v, expected %+v", boxes, test.expected)
+			}
+			for i, box := range boxes {
+				if box != test.expected[i] {
+					t.Errorf("box %d = %+v, expected %+v", i, box, test.expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReadIsoChildBoxes(t *testing.T) {
+	content := isoTestBox("meta", isoTestUint(0, 4), isoTestBox("hdlr", []byte("x")), isoTestBox("iinf"))
+	reader := bytes.NewReader(content)
+	boxes, err := readIsoBoxes(reader, 0, int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	children, err := readIsoChildBoxes(reader, boxes[0], 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 2 || children[0] != (isoBox{"hdlr", 20, 1}) || children[1] != (isoBox{"iinf", 29, 0}) {
+		t.Errorf("children = %+v", children)
+	}
+	if box, isFound := findIsoBox(children, "iinf"); !isFound || box != children[1] {
+		t.Errorf("findIsoBox = %+v, %v", box, isFound)
+	}
+	if _, isFound := findIsoBox(children, "iloc"); isFound {
+		t.Error("found a missing box")
+	}
+	if _, err := readIsoChildBoxes(reader, isoBox{"meta", 8, 2}, 4); err == nil {
+		t.Error("expected an error for a box smaller than the skipped bytes")
+	}
+}
+
+func TestReadIsoFileType(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  []byte
+		expected []string
+	}{
+		{"brands", isoTestBox("ftyp", []byte("heic"), isoTestUint(0, 4), []byte("mif1heic")), []string{"heic", "mif1", "heic"}},
+		{"no compatible brands", isoTestBox("ftyp", []byte("isom"), isoTestUint(512, 4)), []string{"isom"}},
+		{"not ftyp", isoTestBox("moov", []byte("heic"), isoTestUint(0, 4)), nil},
+		{"too small", isoTestBox("ftyp", []byte("heic")), nil},
+		{"truncated", isoTestBox("ftyp", []byte("heic"), isoTestUint(0, 4), []byte("mif1"))[:18], nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			brands, err := readIsoFileType(bytes.NewReader(test.content))
+			if test.expected == nil {
+				if err == nil {
+					t.Errorf("brands = %v, expected an error", brands)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(brands) != len(test.expected) {
+				t.Fatalf("brands = %v, expected %v", brands, test.expected)
+			}
+			for i := range brands {
+				if brands[i] != test.expected[i] {
+					t.Errorf("brands = %v, expected %v", brands, test.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestIsoReader(t *testing.T) {
+	reader := isoReader{data: []byte{0x01, 0x02, 0x03, 'E', 'x', 'i', 'f', 0x04}}
+	if value := reader.readUint(0); value != 0 {
+		t.Errorf("readUint(0) = %d", value)
+	}
+	if value := reader.readUint(3); value != 0x010203 {
+		t.Errorf("readUint(3) = %#x", value)
+	}
+	if value := reader.readString(4); value != "Exif" {
+		t.Errorf("readString(4) = %q", value)
+	}
+	if value := reader.readUint(2); value != 0 || reader.err == nil {
+		t.Errorf("readUint past the end = %d, %v, expected an error", value, reader.err)
+	}
+	if value := reader.readUint(1); value != 0 {
+		t.Errorf("readUint after an error = %d, expected 0", value)
+	}
+}
+
+func TestParseHeifItemLocations(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  []byte
+		expected map[uint64]heifItemLocation
+	}{
+		{
+			// Version 0: 4-byte offsets and lengths, no base offset, 16-bit item IDs.
+			name: "version 0",
+			payload: bytes.Join([][]byte{
+				isoTestUint(0, 4), {0x44, 0x00}, isoTestUint(2, 2),
+				isoTestUint(1, 2), isoTestUint(0, 2), isoTestUint(1, 2), isoTestUint(100, 4), isoTestUint(20, 4),
+				isoTestUint(2, 2), isoTestUint(0, 2), isoTestUint(2, 2), isoTestUint(200, 4), isoTestUint(10, 4), isoTestUint(300, 4), isoTestUint(5, 4),
+			}, nil),
+			expected: map[uint64]heifItemLocation{
+				1: {0, 0, []heifExtent{{100, 20}}},
+				2: {0, 0, []heifExtent{{200, 10}, {300, 5}}},
+			},
+		},
+		{
+			// Version 1: construction method, 8-byte base offset, 2-byte extent indexes.
+			name: "version 1",
+			payload: bytes.Join([][]byte{
+				{0x01, 0, 0, 0}, {0x44, 0x82}, isoTestUint(1, 2),
+				isoTestUint(7, 2), isoTestUint(1, 2), isoTestUint(0, 2), isoTestUint(1000, 8), isoTestUint(1, 2), isoTestUint(0, 2), isoTestUint(8, 4), isoTestUint(16, 4),
+			}, nil),
+			expected: map[uint64]heifItemLocation{
+				7: {1, 1000, []heifExtent{{8, 16}}},
+			},
+		},
+		{
+			// Version 2: 32-bit item IDs.
+			name: "version 2",
+			payload: bytes.Join([][]byte{
+				{0x02, 0, 0, 0}, {0x40, 0x00}, isoTestUint(1, 4),
+				isoTestUint(70000, 4), isoTestUint(0, 2), isoTestUint(0, 2), isoTestUint(1, 2), isoTestUint(50, 4),
+			}, nil),
+			expected: map[uint64]heifItemLocation{
+				70000: {0, 0, []heifExtent{{50, 0}}},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			locations, err := parseHeifItemLocations(test.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(locations) != len(test.expected) {
+				t.Fatalf("locations = %+v, expected %+v", locations, test.expected)
+			}
+			for itemID, expected := range test.expected {
+				location := locations[itemID]
+				if location.constructionMethod != expected.constructionMethod || location.baseOffset != expected.baseOffset || len(location.extents) != len(expected.extents) {
+					t.Fatalf("location of %d = %+v, expected %+v", itemID, location, expected)
+				}
+				for i := range location.extents {
+					if location.extents[i] != expected.extents[i] {
+						t.Errorf("location of %d = %+v, expected %+v", itemID, location, expected)
+					}
+				}
+			}
+
+			// Truncated payloads are rejected rather than partly parsed.
+			if _, err := parseHeifItemLocations(test.payload[:len(test.payload)-1]); err == nil {
+				t.Error("expected an error for the truncated payload")
+			}
+		})
+	}
+}
+
+// newTestHeif encodes a HEIF file whose Exif item holds the given TIFF data, either in the "idat" box or in the "mdat" box after the "meta" box.
+func newTestHeif(tiff []byte, isInIdat bool) []byte {
+	itemData := bytes.Join([][]byte{isoTestUint(uint64(len(exifHeader)), 4), exifHeader, tiff}, nil)
+	ftyp := isoTestBox("ftyp", []byte("heic"), isoTestUint(0, 4), []byte("mif1heic"))
+	iinf := isoTestBox("iinf", isoTestUint(0, 4), isoTestUint(2, 2),
+		isoTestBox("infe", []byte{2, 0, 0, 0}, isoTestUint(1, 2), isoTestUint(0, 2), []byte("hvc1\x00")),
+		isoTestBox("infe", []byte{2, 0, 0, 0}, isoTestUint(2, 2), isoTestUint(0, 2), []byte("Exif\x00")),
+	)
+	iloc := func(constructionMethod uint64, offset uint64) []byte {
+		return isoTestBox("iloc", []byte{1, 0, 0, 0}, []byte{0x44, 0x00}, isoTestUint(1, 2),
+			isoTestUint(2, 2), isoTestUint(constructionMethod, 2), isoTestUint(0, 2), isoTestUint(1, 2), isoTestUint(offset, 4), isoTestUint(uint64(len(itemData)), 4))
+	}
+	hdlr := isoTestBox("hdlr", isoTestUint(0, 8), []byte("pict"), make([]byte, 12), []byte{0})
+	if isInIdat {
+		return append(ftyp, isoTestBox("meta", isoTestUint(0, 4), hdlr, iinf, iloc(1, 0), isoTestBox("idat", itemData))...)
+	}
+	metaSize := len(isoTestBox("meta", isoTestUint(0, 4), hdlr, iinf, iloc(0, 0)))
+	meta := isoTestBox("meta", isoTestUint(0, 4), hdlr, iinf, iloc(0, uint64(len(ftyp)+metaSize+8)))
+	return bytes.Join([][]byte{ftyp, meta, isoTestBox("mdat", itemData)}, nil)
+}
+
+func TestDecodeHeifExif(t *testing.T) {
+	tags := ExifTags{DateTimeOriginal: time.Date(2019, 7, 10, 14, 24, 19, 0, time.UTC)}
+	tiff := encodeExifTiff(tags)
+	for name, isInIdat := range map[string]bool{"in mdat": false, "in idat": true} {
+		t.Run(name, func(t *testing.T) {
+			file := openIsoTestFile(t, newTestHeif(tiff, isInIdat))
+			if !isHeifFile(file) {
+				t.Fatal("not identified as HEIF")
+			}
+			x, err := decodeHeifExif(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dateTime, err := x.DateTime(); err != nil || !dateTime.Equal(tags.DateTimeOriginal) {
+				t.Errorf("DateTime = %v, %v, expected %v", dateTime, err, tags.DateTimeOriginal)
+			}
+		})
+	}
+
+	t.Run("no Exif item", func(t *testing.T) {
+		content := newTestHeif(tiff, true)
+		content = bytes.Replace(content, []byte("Exif\x00\x00\x00"), []byte("mime\x00\x00\x00"), 1)
+		if _, err := decodeHeifExif(openIsoTestFile(t, content)); err == nil {
+			t.Error("expected an error")
+		}
+	})
+	t.Run("not HEIF", func(t *testing.T) {
+		file := openIsoTestFile(t, isoTestBox("ftyp", []byte("isom"), isoTestUint(0, 4), []byte("mp41")))
+		if isHeifFile(file) {
+			t.Error("identified as HEIF")
+		}
+	})
+}
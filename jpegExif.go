@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+// JPEG markers.
+const (
+	jpegMarkerSOI  = 0xD8 // start of image
+	jpegMarkerEOI  = 0xD9 // end of image
+	jpegMarkerSOS  = 0xDA // start of scan, after which the image data follows
+	jpegMarkerAPP0 = 0xE0 // JFIF
+	jpegMarkerAPP1 = 0xE1 // EXIF or XMP
+)
+
+// TIFF field types used in EXIF.
+const (
+	tiffTypeByte      = 1
+	tiffTypeASCII     = 2
+	tiffTypeLong      = 4
+	tiffTypeRational  = 5
+	tiffTypeUndefined = 7
+)
+
+// EXIF tags written by embedJpegExif.
+const (
+	exifTagExifIfdPointer     = 0x8769
+	exifTagGpsIfdPointer      = 0x8825
+	exifTagExifVersion        = 0x9000
+	exifTagDateTimeOriginal   = 0x9003
+	exifTagOffsetTimeOriginal = 0x9011
+	exifTagGpsVersionID       = 0x0000
+	exifTagGpsLatitudeRef     = 0x0001
+	exifTagGpsLatitude        = 0x0002
+	exifTagGpsLongitudeRef    = 0x0003
+	exifTagGpsLongitude       = 0x0004
+)
+
+// exifHeader precedes the TIFF data in an APP1 segment.
+var exifHeader = []byte("Exif\x00\x00")
+
+// ExifTags are the tags to embed in a JPEG.
+type ExifTags struct {
+	DateTimeOriginal time.Time // local time of capture
+	HasOffset        bool      // whether the offset of DateTimeOriginal is known, for OffsetTimeOriginal
+	HasLocation      bool
+	Latitude         float64
+	Longitude        float64
+}
+
+// tiffEntry is a field of an IFD, with its value encoded in the byte order of the TIFF data.  The value of a field read from existing TIFF data is its raw 4 bytes, which may be the offset of values elsewhere in that data.
+type tiffEntry struct {
+	tag   uint16
+	kind  uint16
+	count uint32
+	value []byte
+}
+
+// tiffIfd is an IFD read from TIFF data.
+type tiffIfd struct {
+	offset  uint32
+	entries []tiffEntry
+	next    uint32 // offset of the next IFD, or 0
+}
+
+// findJpegExif returns the start and end of the EXIF APP1 segment of the JPEG content, including its marker, or -1 if there is none.  Returns an error if the content is not a well-formed JPEG.
+func findJpegExif(content []byte) (int, int, error) {
+	if len(content) < 2 || content[0] != 0xFF || content[1] != jpegMarkerSOI {
+		return -1, -1, errors.New("not a JPEG")
+	}
+	for i := 2; ; {
+		if i+4 > len(content) || content[i] != 0xFF {
+			return -1, -1, errors.New("malformed JPEG segment")
+		}
+		marker := content[i+1]
+		if marker == 0xFF {
+			// Fill byte
+			i++
+			continue
+		}
+		if marker == jpegMarkerSOS || marker == jpegMarkerEOI {
+			return -1, -1, nil
+		}
+		length := int(binary.BigEndian.Uint16(content[i+2:]))
+		if length < 2 || i+2+length > len(content) {
+			return -1, -1, errors.New("malformed JPEG segment")
+		}
+		if marker == jpegMarkerAPP1 && bytes.HasPrefix(content[i+4:i+2+length], exifHeader) {
+			return i, i + 2 + length, nil
+		}
+		i += 2 + length
+	}
+}
+
+// embedJpegExif returns the JPEG content with the given tags written into its EXIF: into a new APP1 segment, inserted after SOI and any JFIF APP0 segment, if it has none; otherwise only the date, if it has none, and the location, if it has none.  Existing tags are kept, and the image data is untouched.  Returns nil if there is nothing to add.
+func embedJpegExif(content []byte, tags ExifTags) ([]byte, error) {
+	start, end, err := findJpegExif(content)
+	if err != nil {
+		return nil, err
+	}
+	var tiff []byte
+	if start < 0 {
+		tiff = encodeExifTiff(tags)
+		start = 2
+		if content[2] == 0xFF && content[3] == jpegMarkerAPP0 {
+			start += 2 + int(binary.BigEndian.Uint16(content[4:]))
+		}
+		end = start
+	} else {
+		tiff, err = addExifTags(content[start+4+len(exifHeader):end], tags)
+		if err != nil || tiff == nil {
+			return nil, err
+		}
+	}
+	segmentData := append(append([]byte(nil), exifHeader...), tiff...)
+	if len(segmentData)+2 > math.MaxUint16 {
+		return nil, errors.New("EXIF segment too large")
+	}
+
+	var result bytes.Buffer
+	result.Grow(len(content) - (end - start) + 4 + len(segmentData))
+	result.Write(content[:start])
+	result.Write([]byte{0xFF, jpegMarkerAPP1})
+	binary.Write(&result, binary.BigEndian, uint16(len(segmentData)+2))
+	result.Write(segmentData)
+	result.Write(content[end:])
+	return result.Bytes(), nil
+}
+
+// encodeExifTiff encodes the tags as big-endian TIFF data: IFD0 pointing to the Exif IFD for the date, and to the GPS IFD for the location.
+func encodeExifTiff(tags ExifTags) []byte {
+	order := binary.BigEndian
+	exifEntries := exifDateEntries(tags)
+	gpsEntries := exifLocationEntries(tags, order)
+
+	ifd0EntryCount := 1
+	if len(gpsEntries) > 0 {
+		ifd0EntryCount++
+	}
+	exifOffset := uint32(8 + ifdSize(ifd0EntryCount))
+	exifIfd := encodeIfd(exifEntries, exifOffset, order, 0)
+	gpsOffset := exifOffset + uint32(len(exifIfd))
+	ifd0Entries := []tiffEntry{longEntry(exifTagExifIfdPointer, exifOffset, order)}
+	if len(gpsEntries) > 0 {
+		ifd0Entries = append(ifd0Entries, longEntry(exifTagGpsIfdPointer, gpsOffset, order))
+	}
+
+	var result bytes.Buffer
+	result.WriteString("MM")
+	binary.Write(&result, order, uint16(42))
+	binary.Write(&result, order, uint32(8))
+	result.Write(encodeIfd(ifd0Entries, 8, order, 0))
+	result.Write(exifIfd)
+	if len(gpsEntries) > 0 {
+		result.Write(encodeIfd(gpsEntries, gpsOffset, order, 0))
+	}
+	return result.Bytes()
+}
+
+// addExifTags returns the TIFF data with the date added to its Exif IFD if it has no DateTimeOriginal, and the location added to its GPS IFD if it has no coordinates, or nil if it has both.  Each IFD that gains entries is copied, with them, to the end of the data, and the pointer to it is updated, so that no existing value moves.
+func addExifTags(tiff []byte, tags ExifTags) ([]byte, error) {
+	if len(tiff) < 8 {
+		return nil, errors.New("malformed TIFF header")
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("malformed TIFF byte order")
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return nil, errors.New("malformed TIFF header")
+	}
+	ifd0, err := readIfd(tiff, order.Uint32(tiff[4:]), order)
+	if err != nil {
+		return nil, err
+	}
+	exifIfd, err := readSubIfd(tiff, ifd0, exifTagExifIfdPointer, order)
+	if err != nil {
+		return nil, err
+	}
+	gpsIfd, err := readSubIfd(tiff, ifd0, exifTagGpsIfdPointer, order)
+	if err != nil {
+		return nil, err
+	}
+
+	var addedExifEntries, addedGpsEntries []tiffEntry
+	if !exifIfd.has(exifTagDateTimeOriginal) {
+		for _, entry := range exifDateEntries(tags) {
+			if !exifIfd.has(entry.tag) {
+				addedExifEntries = append(addedExifEntries, entry)
+			}
+		}
+	}
+	if !gpsIfd.has(exifTagGpsLatitude) || !gpsIfd.has(exifTagGpsLongitude) {
+		for _, entry := range exifLocationEntries(tags, order) {
+			if !gpsIfd.has(entry.tag) {
+				addedGpsEntries = append(addedGpsEntries, entry)
+			}
+		}
+	}
+	if len(addedExifEntries) == 0 && len(addedGpsEntries) == 0 {
+		return nil, nil
+	}
+
+	result := append([]byte(nil), tiff...)
+	var addedIfd0Entries []tiffEntry
+	for _, added := range []struct {
+		ifd        tiffIfd
+		entries    []tiffEntry
+		pointerTag uint16
+	}{
+		{exifIfd, addedExifEntries, exifTagExifIfdPointer},
+		{gpsIfd, addedGpsEntries, exifTagGpsIfdPointer},
+	} {
+		if len(added.entries) == 0 {
+			continue
+		}
+		var offset uint32
+		result, offset = appendIfd(result, append(added.ifd.entries, added.entries...), order, added.ifd.next)
+		if index := ifd0.indexOf(added.pointerTag); index >= 0 {
+			// Also update the entry, in case IFD0 is copied too.
+			order.PutUint32(ifd0.entries[index].value, offset)
+			order.PutUint32(result[ifd0.offset+2+12*uint32(index)+8:], offset)
+		} else {
+			addedIfd0Entries = append(addedIfd0Entries, longEntry(added.pointerTag, offset, order))
+		}
+	}
+	if len(addedIfd0Entries) > 0 {
+		var offset uint32
+		result, offset = appendIfd(result, append(ifd0.entries, addedIfd0Entries...), order, ifd0.next)
+		order.PutUint32(result[4:], offset)
+	}
+	return result, nil
+}
+
+// readIfd reads the IFD at the given offset within the TIFF data.
+func readIfd(tiff []byte, offset uint32, order binary.ByteOrder) (tiffIfd, error) {
+	if offset < 8 || uint64(offset)+2 > uint64(len(tiff)) {
+		return tiffIfd{}, errors.New("malformed TIFF IFD offset")
+	}
+	entryCount := uint32(order.Uint16(tiff[offset:]))
+	if uint64(offset)+uint64(ifdSize(int(entryCount))) > uint64(len(tiff)) {
+		return tiffIfd{}, errors.New("malformed TIFF IFD")
+	}
+	result := tiffIfd{offset: offset}
+	for i := uint32(0); i < entryCount; i++ {
+		field := tiff[offset+2+12*i:]
+		result.entries = append(result.entries, tiffEntry{
+			tag:   order.Uint16(field),
+			kind:  order.Uint16(field[2:]),
+			count: order.Uint32(field[4:]),
+			value: append([]byte(nil), field[8:12]...),
+		})
+	}
+	result.next = order.Uint32(tiff[offset+2+12*entryCount:])
+	return result, nil
+}
+
+// readSubIfd reads the IFD that the given tag of the parent IFD points to, or returns an empty IFD if there is no such tag.
+func readSubIfd(tiff []byte, parent tiffIfd, pointerTag uint16, order binary.ByteOrder) (tiffIfd, error) {
+	index := parent.indexOf(pointerTag)
+	if index < 0 {
+		return tiffIfd{}, nil
+	}
+	return readIfd(tiff, order.Uint32(parent.entries[index].value), order)
+}
+
+// indexOf returns the index of the entry with the given tag, or -1 if there is none.
+func (ifd tiffIfd) indexOf(tag uint16) int {
+	for i, entry := range ifd.entries {
+		if entry.tag == tag {
+			return i
+		}
+	}
+	return -1
+}
+
+func (ifd tiffIfd) has(tag uint16) bool {
+	return ifd.indexOf(tag) >= 0
+}
+
+// appendIfd appends the entries, as an IFD starting on a word boundary, to the TIFF data.  Returns the data and the offset of the IFD.
+func appendIfd(tiff []byte, entries []tiffEntry, order binary.ByteOrder, next uint32) ([]byte, uint32) {
+	if len(tiff)%2 == 1 {
+		tiff = append(tiff, 0)
+	}
+	offset := uint32(len(tiff))
+	return append(tiff, encodeIfd(entries, offset, order, next)...), offset
+}
+
+// exifDateEntries returns the entries of the Exif IFD for the date of the tags.
+func exifDateEntries(tags ExifTags) []tiffEntry {
+	result := []tiffEntry{
+		{tag: exifTagExifVersion, kind: tiffTypeUndefined, count: 4, value: []byte("0231")},
+		asciiEntry(exifTagDateTimeOriginal, tags.DateTimeOriginal.Format("2006:01:02 15:04:05")),
+	}
+	if tags.HasOffset {
+		result = append(result, asciiEntry(exifTagOffsetTimeOriginal, tags.DateTimeOriginal.Format("-07:00")))
+	}
+	return result
+}
+
+// exifLocationEntries returns the entries of the GPS IFD for the location of the tags, if any.
+func exifLocationEntries(tags ExifTags, order binary.ByteOrder) []tiffEntry {
+	if !tags.HasLocation {
+		return nil
+	}
+	latitudeRef, longitudeRef := "N", "E"
+	if tags.Latitude < 0 {
+		latitudeRef = "S"
+	}
+	if tags.Longitude < 0 {
+		longitudeRef = "W"
+	}
+	return []tiffEntry{
+		{tag: exifTagGpsVersionID, kind: tiffTypeByte, count: 4, value: []byte{2, 2, 0, 0}},
+		asciiEntry(exifTagGpsLatitudeRef, latitudeRef),
+		degreesEntry(exifTagGpsLatitude, tags.Latitude, order),
+		asciiEntry(exifTagGpsLongitudeRef, longitudeRef),
+		degreesEntry(exifTagGpsLongitude, tags.Longitude, order),
+	}
+}
+
+// ifdSize returns the size of an IFD with the given number of entries, excluding values that don't fit in an entry.
+func ifdSize(entryCount int) int {
+	return 2 + 12*entryCount + 4
+}
+
+// encodeIfd encodes the entries, sorted by tag, as an IFD at the given offset within the TIFF data, followed by the values that don't fit in an entry.
+func encodeIfd(entries []tiffEntry, offset uint32, order binary.ByteOrder, next uint32) []byte {
+	entries = append([]tiffEntry(nil), entries...)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+	var ifd, values bytes.Buffer
+	valuesOffset := offset + uint32(ifdSize(len(entries)))
+	binary.Write(&ifd, order, uint16(len(entries)))
+	for _, entry := range entries {
+		binary.Write(&ifd, order, entry.tag)
+		binary.Write(&ifd, order, entry.kind)
+		binary.Write(&ifd, order, entry.count)
+		if len(entry.value) <= 4 {
+			ifd.Write(entry.value)
+			ifd.Write(make([]byte, 4-len(entry.value)))
+			continue
+		}
+		binary.Write(&ifd, order, valuesOffset+uint32(values.Len()))
+		values.Write(entry.value)
+		if values.Len()%2 == 1 {
+			// Values start on a word boundary.
+			values.WriteByte(0)
+		}
+	}
+	binary.Write(&ifd, order, next)
+	ifd.Write(values.Bytes())
+	return ifd.Bytes()
+}
+
+func asciiEntry(tag uint16, value string) tiffEntry {
+	return tiffEntry{tag: tag, kind: tiffTypeASCII, count: uint32(len(value) + 1), value: append([]byte(value), 0)}
+}
+
+func longEntry(tag uint16, value uint32, order binary.ByteOrder) tiffEntry {
+	encoded := make([]byte, 4)
+	order.PutUint32(encoded, value)
+	return tiffEntry{tag: tag, kind: tiffTypeLong, count: 1, value: encoded}
+}
+
+// degreesEntry encodes the absolute value of a coordinate as degrees, minutes, and seconds (to 1/10000), as rationals.
+func degreesEntry(tag uint16, value float64, order binary.ByteOrder) tiffEntry {
+	value = math.Abs(value)
+	degrees := math.Floor(value)
+	minutes := math.Floor((value - degrees) * 60)
+	tenThousandthSeconds := math.Round(((value-degrees)*60 - minutes) * 60 * 10000)
+	encoded := make([]byte, 24)
+	for i, rational := range [][2]uint32{{uint32(degrees), 1}, {uint32(minutes), 1}, {uint32(tenThousandthSeconds), 10000}} {
+		order.PutUint32(encoded[i*8:], rational[0])
+		order.PutUint32(encoded[i*8+4:], rational[1])
+	}
+	return tiffEntry{tag: tag, kind: tiffTypeRational, count: 3, value: encoded}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// newTestJpeg returns a small JPEG without EXIF.
+func newTestJpeg(t *testing.T) []byte {
+	var result bytes.Buffer
+	if err := jpeg.Encode(&result, image.NewGray(image.Rect(0, 0, 16, 16)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return result.Bytes()
+}
+
+// newTestJpegWithTiff returns a small JPEG with an EXIF segment holding the given TIFF data.
+func newTestJpegWithTiff(t *testing.T, tiff []byte) []byte {
+	content := newTestJpeg(t)
+	var result bytes.Buffer
+	result.Write(content[:2])
+	result.Write([]byte{0xFF, jpegMarkerAPP1})
+	binary.Write(&result, binary.BigEndian, uint16(2+len(exifHeader)+len(tiff)))
+	result.Write(exifHeader)
+	result.Write(tiff)
+	result.Write(content[2:])
+	return result.Bytes()
+}
+
+// newTestTiff encodes TIFF data in the given byte order with IFD0 holding the camera make, and pointing to an Exif IFD holding the given entries, if any.
+func newTestTiff(order binary.ByteOrder, exifEntries []tiffEntry) []byte {
+	var result bytes.Buffer
+	if order == binary.ByteOrder(binary.LittleEndian) {
+		result.WriteString("II")
+	} else {
+		result.WriteString("MM")
+	}
+	binary.Write(&result, order, uint16(42))
+	binary.Write(&result, order, uint32(8))
+	ifd0Entries := []tiffEntry{asciiEntry(0x010F, "Picsort Camera")} // Make
+	if len(exifEntries) > 0 {
+		ifd0Entries = append(ifd0Entries, longEntry(exifTagExifIfdPointer, 0, order))
+	}
+	exifOffset := uint32(8 + len(encodeIfd(ifd0Entries, 8, order, 0)))
+	if len(exifEntries) > 0 {
+		ifd0Entries[1] = longEntry(exifTagExifIfdPointer, exifOffset, order)
+	}
+	result.Write(encodeIfd(ifd0Entries, 8, order, 0))
+	if len(exifEntries) > 0 {
+		result.Write(encodeIfd(exifEntries, exifOffset, order, 0))
+	}
+	return result.Bytes()
+}
+
+func TestEmbedJpegExif(t *testing.T) {
+	location := time.FixedZone("", 2*60*60)
+	tags := ExifTags{
+		DateTimeOriginal: time.Date(2019, 7, 10, 14, 24, 19, 0, location),
+		HasOffset:        true,
+		HasLocation:      true,
+		Latitude:         48.8584,
+		Longitude:        -2.2945,
+	}
+	withoutDate := []tiffEntry{{tag: exifTagExifVersion, kind: tiffTypeUndefined, count: 4, value: []byte("0230")}}
+	tests := []struct {
+		name        string
+		content     []byte
+		hasMake     bool
+		exifVersion string
+	}{
+		{"no EXIF", newTestJpeg(t), false, "0231"},
+		{"little-endian EXIF without Exif IFD", newTestJpegWithTiff(t, newTestTiff(binary.LittleEndian, nil)), true, "0231"},
+		{"big-endian EXIF without Exif IFD", newTestJpegWithTiff(t, newTestTiff(binary.BigEndian, nil)), true, "0231"},
+		{"little-endian EXIF without date", newTestJpegWithTiff(t, newTestTiff(binary.LittleEndian, withoutDate)), true, "0230"},
+		{"big-endian EXIF without date", newTestJpegWithTiff(t, newTestTiff(binary.BigEndian, withoutDate)), true, "0230"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			embeddedContent, err := embedJpegExif(test.content, tags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := jpeg.Decode(bytes.NewReader(embeddedContent)); err != nil {
+				t.Fatalf("embedded content is not a JPEG: %v", err)
+			}
+			if !bytes.HasSuffix(embeddedContent, test.content[len(test.content)-100:]) {
+				t.Error("image data changed")
+			}
+			x, err := exif.Decode(bytes.NewReader(embeddedContent))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dateTime, err := x.Get(exif.DateTimeOriginal); err != nil {
+				t.Errorf("no DateTimeOriginal: %v", err)
+			} else if value, _ := dateTime.StringVal(); value != "2019:07:10 14:24:19" {
+				t.Errorf("DateTimeOriginal = %q", value)
+			}
+			if latitude, longitude, err := x.LatLong(); err != nil {
+				t.Errorf("no location: %v", err)
+			} else if math.Abs(latitude-tags.Latitude) > 0.0001 || math.Abs(longitude-tags.Longitude) > 0.0001 {
+				t.Errorf("location = %v, %v", latitude, longitude)
+			}
+			if cameraMake, err := x.Get(exif.Make); (err == nil) != test.hasMake {
+				t.Errorf("Make = %v, %v", cameraMake, err)
+			}
+			if versionTag, err := x.Get(exif.ExifVersion); err != nil {
+				t.Errorf("no ExifVersion: %v", err)
+			} else if string(versionTag.Val) != test.exifVersion {
+				t.Errorf("ExifVersion = %q, expected %q", versionTag.Val, test.exifVersion)
+			}
+
+			// Embedding again finds nothing to add.
+			if content, err := embedJpegExif(embeddedContent, tags); err != nil || content != nil {
+				t.Errorf("embedding again = %d bytes, %v, expected nothing", len(content), err)
+			}
+		})
+	}
+}
+
+func TestEmbedJpegExifKeepsExistingTags(t *testing.T) {
+	existingTags := ExifTags{DateTimeOriginal: time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC), HasLocation: true, Latitude: 1, Longitude: 2}
+	content, err := embedJpegExif(newTestJpeg(t), existingTags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := ExifTags{DateTimeOriginal: time.Date(2019, 7, 10, 14, 24, 19, 0, time.UTC), HasLocation: true, Latitude: 48.8584, Longitude: 2.2945}
+	if embeddedContent, err := embedJpegExif(content, tags); err != nil || embeddedContent != nil {
+		t.Errorf("embedJpegExif = %d bytes, %v, expected nothing", len(embeddedContent), err)
+	}
+
+	// A date without a location only gains the location.
+	content, err = embedJpegExif(newTestJpeg(t), ExifTags{DateTimeOriginal: existingTags.DateTimeOriginal})
+	if err != nil {
+		t.Fatal(err)
+	}
+	embeddedContent, err := embedJpegExif(content, tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := exif.Decode(bytes.NewReader(embeddedContent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dateTime, err := x.DateTime(); err != nil || dateTime.Year() != 2001 {
+		t.Errorf("DateTime = %v, %v, expected the existing date", dateTime, err)
+	}
+	if latitude, _, err := x.LatLong(); err != nil || math.Abs(latitude-tags.Latitude) > 0.0001 {
+		t.Errorf("latitude = %v, %v", latitude, err)
+	}
+}
+
+func TestEmbedJpegExifRejectsMalformedContent(t *testing.T) {
+	tags := ExifTags{DateTimeOriginal: time.Date(2019, 7, 10, 14, 24, 19, 0, time.UTC)}
+	for name, content := range map[string][]byte{
+		"not a JPEG":       []byte("GIF89a"),
+		"truncated":        newTestJpeg(t)[:3],
+		"bad byte order":   newTestJpegWithTiff(t, []byte("XX\x00\x2a\x00\x00\x00\x08")),
+		"bad IFD0 offset":  newTestJpegWithTiff(t, []byte("MM\x00\x2a\x00\x00\xFF\xFF")),
+		"truncated header": newTestJpegWithTiff(t, []byte("MM")),
+	} {
+		if _, err := embedJpegExif(content, tags); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultLayout is the original Picsort format: yyyy/yyyy-mm-dd/yyyy-mm-dd_hh-mm-ss_original-filename
+const defaultLayout = "{year}/{date}/{date}_{time}_{name}{ext}"
+
+// layoutTokens describes the tokens available in a layout template.
+var layoutTokens = map[string]string{
+	"year":      "four-digit year, e.g. 2019",
+	"month":     "two-digit month, e.g. 07",
+	"monthname": "month name, e.g. July",
+	"day":       "two-digit day of month, e.g. 10",
+	"date":      "date, e.g. 2019-07-10",
+	"time":      "time, e.g. 14-24-19",
+	"hour":      "two-digit hour (24-hour clock)",
+	"minute":    "two-digit minute",
+	"second":    "two-digit second",
+	"camera":    "camera make and model, e.g. Apple iPhone XS",
+	"make":      "camera make, e.g. Apple",
+	"model":     "camera model, e.g. iPhone XS",
+	"mediatype": "photo, video, or other",
+	"source":    "the source of the date, e.g. exif",
+	"hash":      "the first 8 characters of the content hash",
+	"reldir":    "the directory of the incoming file, relative to the incoming directory",
+	"name":      "the original filename without extension, verbatim",
+	"ext":       "the original extension, including the dot",
+}
+
+// unknownLayoutValue replaces tokens that have no value for a file, e.g. the camera of a screenshot.
+const unknownLayoutValue = "Unknown"
+
+var layoutTokenRegex = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// Layout is a validated template for the path of a sorted file within the library, e.g. "{year}/{date}/{date}_{time}_{name}{ext}".
+type Layout struct {
+	template string
+	tokens   map[string]bool
+}
+
+// LayoutFields holds the values for the tokens of a Layout.
+type LayoutFields struct {
+	Timestamp time.Time // already localized
+	Make      string
+	Model     string
+	MediaType string
+	Source    string
+	Hash      string
+	RelDir    string
+	Name      string
+	Ext       string
+}
+
+// NewLayout validates the given template.
+func NewLayout(template string) (*Layout, error) {
+	if strings.TrimSpace(template) == "" {
+		return nil, errors.New("layout is empty")
+	}
+	result := new(Layout)
+	result.template = template
+	result.tokens = make(map[string]bool)
+	for _, match := range layoutTokenRegex.FindAllStringSubmatch(template, -1) {
+		token := match[1]
+		if _, isKnown := layoutTokens[token]; !isKnown {
+			return nil, errors.New("unknown token {" + token + "} in layout")
+		}
+		result.tokens[token] = true
+	}
+	if strings.ContainsAny(layoutTokenRegex.ReplaceAllString(template, ""), "{}") {
+		return nil, errors.New("unbalanced braces in layout")
+	}
+	if path.IsAbs(template) || filepath.IsAbs(template) {
+		return nil, errors.New("layout must be relative to the library")
+	}
+	segments := strings.Split(template, "/")
+	for _, segment := range segments {
+		if segment == ".." || segment == "." {
+			return nil, errors.New("layout must not contain '.' or '..' directories")
+		}
+	}
+	if strings.TrimSpace(segments[len(segments)-1]) == "" {
+		return nil, errors.New("layout must end with a filename")
+	}
+	return result, nil
+}
+
+// describeLayoutTokens lists the available tokens for the usage message.
+func describeLayoutTokens() string {
+	var names []string
+	for name := range layoutTokens {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var descriptions []string
+	for _, name := range names {
+		descriptions = append(descriptions, "{"+name+"} = "+layoutTokens[name])
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// Uses determines whether the layout contains the given token, e.g. to avoid computing expensive values.
+func (layout Layout) Uses(token string) bool {
+	return layout.tokens[token]
+}
+
+// Render builds the relative path for the given fields, using the OS path separator.
+func (layout Layout) Render(fields LayoutFields) string {
+	timestamp := fields.Timestamp
+	values := map[string]string{
+		"year":      timestamp.Format("2006"),
+		"month":     timestamp.Format("01"),
+		"monthname": timestamp.Format("January"),
+		"day":       timestamp.Format("02"),
+		"date":      timestamp.Format("2006-01-02"),
+		"time":      timestamp.Format("15-04-05"),
+		"hour":      timestamp.Format("15"),
+		"minute":    timestamp.Format("04"),
+		"second":    timestamp.Format("05"),
+		"camera":    sanitizeLayoutValue(deriveCameraName(fields.Make, fields.Model)),
+		"make":      sanitizeLayoutValue(fields.Make),
+		"model":     sanitizeLayoutValue(fields.Model),
+		"mediatype": sanitizeLayoutValue(fields.MediaType),
+		"source":    sanitizeLayoutValue(fields.Source),
+		"hash":      sanitizeLayoutValue(fields.Hash),
+		"name":      sanitizeLayoutName(fields.Name),
+		"ext":       fields.Ext,
+	}
+	// The relative directory is the only value that may introduce directories.
+	var relDirSegments []string
+	for _, segment := range strings.Split(filepath.ToSlash(fields.RelDir), "/") {
+		if segment != "" && segment != "." && segment != ".." {
+			relDirSegments = append(relDirSegments, sanitizeLayoutValue(segment))
+		}
+	}
+	values["reldir"] = strings.Join(relDirSegments, "/")
+
+	result := layoutTokenRegex.ReplaceAllStringFunc(layout.template, func(token string) string {
+		value := values[strings.Trim(token, "{}")]
+		if value == "" && token != "{name}" && token != "{ext}" && token != "{reldir}" {
+			return unknownLayoutValue
+		}
+		return value
+	})
+	return filepath.FromSlash(path.Clean(result))
+}
+
+// deriveCameraName combines the make and model, avoiding repetition such as "Canon Canon EOS 5D".
+func deriveCameraName(cameraMake string, cameraModel string) string {
+	cameraMake = strings.TrimSpace(cameraMake)
+	cameraModel = strings.TrimSpace(cameraModel)
+	if cameraMake != "" && strings.HasPrefix(strings.ToLower(cameraModel), strings.ToLower(cameraMake)) {
+		return cameraModel
+	}
+	return strings.TrimSpace(cameraMake + " " + cameraModel)
+}
+
+// sanitizeLayoutValue replaces characters that are invalid in filenames on common filesystems.
+func sanitizeLayoutValue(value string) string {
+	value = strings.TrimSpace(strings.TrimRight(value, "\x00"))
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+// sanitizeLayoutName keeps the original filename verbatim, as the default layout always has, other than any path separator, which could only come from a malformed archive entry.
+func sanitizeLayoutName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == filepath.Separator || r == 0 {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// deriveMediaType classifies a file as "photo", "video", or "other" by its extension.
+func deriveMediaType(filePath string) string {
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".heic", ".heif", ".avif", ".webp", ".tif", ".tiff", ".bmp", ".dng", ".cr2", ".cr3", ".nef", ".arw", ".orf", ".rw2", ".raf":
+		return "photo"
+	case ".mp4", ".m4v", ".mov", ".3gp", ".3g2", ".avi", ".mkv", ".mts", ".m2ts", ".wmv", ".webm", ".mpg", ".mpeg":
+		return "video"
+	}
+	return "other"
+}
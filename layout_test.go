@@ -0,0 +1,56 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDefaultLayoutMatchesOriginalFormat checks that the default layout reproduces the path that Picsort always derived: the year, the date, and the timestamp prefixed to the original filename.
+func TestDefaultLayoutMatchesOriginalFormat(t *testing.T) {
+	layout, err := NewLayout(defaultLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Date(2019, 7, 10, 14, 24, 19, 0, time.UTC)
+	for _, filename := range []string{
+		"IMG_1234.jpg",
+		".bashrc",
+		"no extension",
+		" leading space.jpg",
+		"trailing space .jpg",
+		"colon: and question?.jpg",
+		"Ümlaut (1).JPG",
+		"archive.tar.gz",
+	} {
+		t.Run(filename, func(t *testing.T) {
+			ext := filepath.Ext(filename)
+			fields := LayoutFields{Timestamp: timestamp, Name: strings.TrimSuffix(filename, ext), Ext: ext}
+			expected := filepath.Join("2019", "2019-07-10", "2019-07-10_14-24-19_"+filename)
+			if actual := layout.Render(fields); actual != expected {
+				t.Errorf("Render = %q, expected %q", actual, expected)
+			}
+		})
+	}
+}
+
+func TestLayoutSanitizesOtherValues(t *testing.T) {
+	layout, err := NewLayout("{camera}/{reldir}/{name}{ext}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		fields   LayoutFields
+		expected string
+	}{
+		{LayoutFields{Make: "Canon", Model: "Canon EOS 5D", RelDir: "Trip", Name: "a", Ext: ".jpg"}, "Canon EOS 5D/Trip/a.jpg"},
+		{LayoutFields{Model: "A/B: C", RelDir: "x/../y", Name: "a", Ext: ".jpg"}, "A_B_ C/x/y/a.jpg"},
+		{LayoutFields{Name: "a", Ext: ".jpg"}, "Unknown/a.jpg"},
+	}
+	for _, test := range tests {
+		if actual := layout.Render(test.fields); actual != filepath.FromSlash(test.expected) {
+			t.Errorf("Render = %q, expected %q", actual, test.expected)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// MediaFile represents an incoming file being sorted, along with the metadata gathered for it so far.
+type MediaFile struct {
+	Path           string
+	GoogleMetadata *GooglePhotoMetadata
+	exifMetadata   *exif.Exif
+	exifErr        error
+	isExifDecoded  bool
+}
+
+// NewMediaFile creates a new MediaFile for the given path and (optional) Google metadata.
+func NewMediaFile(path string, googleMetadata *GooglePhotoMetadata) *MediaFile {
+	result := new(MediaFile)
+	result.Path = path
+	result.GoogleMetadata = googleMetadata
+	return result
+}
+
+// Exif decodes the EXIF metadata of the file on first use.
+func (mediaFile *MediaFile) Exif() (*exif.Exif, error) {
+	if !mediaFile.isExifDecoded {
+		mediaFile.isExifDecoded = true
+		picFile, err := os.Open(mediaFile.Path)
+		if err != nil {
+			mediaFile.exifErr = err
+			return nil, err
+		}
+		defer picFile.Close()
+		mediaFile.exifMetadata, mediaFile.exifErr = decodeExif(picFile)
+	}
+	return mediaFile.exifMetadata, mediaFile.exifErr
+}
+
+// Camera returns the camera make and model from the EXIF metadata, or empty strings if absent.
+func (mediaFile *MediaFile) Camera() (string, string) {
+	metadata, err := mediaFile.Exif()
+	if err != nil {
+		return "", ""
+	}
+	return exifStringTag(metadata, exif.Make), exifStringTag(metadata, exif.Model)
+}
+
+// Coordinates returns the location where the file was captured, from the EXIF GPS or else the Google metadata.
+func (mediaFile *MediaFile) Coordinates() (float64, float64, error) {
+	if metadata, err := mediaFile.Exif(); err == nil {
+		if latitude, longitude, err := metadata.LatLong(); err == nil {
+			return latitude, longitude, nil
+		}
+	}
+	if mediaFile.GoogleMetadata != nil && mediaFile.GoogleMetadata.HasLocation() {
+		return mediaFile.GoogleMetadata.Latitude, mediaFile.GoogleMetadata.Longitude, nil
+	}
+	return 0, 0, errors.New("no coordinates present")
+}
+
+// MetadataFieldCount counts the EXIF fields of the file, or returns 0 if it has none.
+func (mediaFile *MediaFile) MetadataFieldCount() int {
+	metadata, err := mediaFile.Exif()
+	if err != nil {
+		return 0
+	}
+	return countExifFields(metadata)
+}
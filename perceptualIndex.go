@@ -0,0 +1,356 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg" // for image.Decode
+	_ "image/png"  // for image.Decode
+	"io"
+	"log"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// defaultSimilarityThreshold is the maximum number of differing bits between the perceptual hashes of similar images, unless otherwise specified.
+const defaultSimilarityThreshold = 6
+
+// maxAspectRatioDifference is the maximum relative difference between the aspect ratios of similar images, e.g. to tell apart a photo from a crop of it.
+const maxAspectRatioDifference = 0.02
+
+// perceptualHash is a difference hash (dHash) of an image, which changes little when the image is recompressed or resized, along with its dimensions.  Both are of the image as displayed, i.e. after applying its EXIF orientation.
+type perceptualHash struct {
+	hash   uint64
+	width  int
+	height int
+}
+
+// indexedPerceptualHash is the perceptual hash of an indexed image.
+type indexedPerceptualHash struct {
+	path string
+	hash perceptualHash
+}
+
+// PerceptualIndex indexes images by perceptual hash, to find near-duplicates such as recompressed copies, which differ in content hash.  Only JPEG and PNG files are supported.
+type PerceptualIndex struct {
+	indexedPaths        map[string]bool
+	hashes              map[string]perceptualHash // by path, for indexed images and images checked against the index
+	hashCache           *HashCache
+	similarityThreshold int
+	excludedDirs        map[string]bool // directories not to index, e.g. folders of links
+	jobs                int
+	mutex               *sync.Mutex
+}
+
+// NewPerceptualIndex creates an empty PerceptualIndex, treating images as similar if their hashes differ by at most the given number of bits, taking hashes of unchanged files from the given cache (which may be nil), skipping the given directories when scanning, and hashing up to the given number of images concurrently.
+func NewPerceptualIndex(similarityThreshold int, hashCache *HashCache, excludedDirs []string, jobs int) *PerceptualIndex {
+	result := new(PerceptualIndex)
+	result.indexedPaths = make(map[string]bool)
+	result.hashes = make(map[string]perceptualHash)
+	result.hashCache = hashCache
+	result.similarityThreshold = similarityThreshold
+	result.excludedDirs = newDirectorySet(excludedDirs)
+	result.jobs = jobs
+	result.mutex = new(sync.Mutex)
+	return result
+}
+
+// BuildIndexForDirectory recursively scans the given directory and indexes all the supported images contained within, concurrently.
+func (perceptualIndex PerceptualIndex) BuildIndexForDirectory(dirPath string) error {
+	log.Println("[DEBUG]", "Building perceptual index for path:", dirPath)
+	filePaths := make(chan string, perceptualIndex.jobs)
+	var waitGroup sync.WaitGroup
+	for i := 0; i < perceptualIndex.jobs; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for filePath := range filePaths {
+				err := perceptualIndex.AddFileToIndex(filePath)
+				if err != nil {
+					log.Println("[WARN]", "Skipping", filePath, "in perceptual index:", err)
+				}
+			}
+		}()
+	}
+	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && perceptualIndex.excludedDirs[filepath.Clean(path)] {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() && isPerceptualHashSupported(path) {
+			filePaths <- path
+		}
+		return nil
+	})
+	close(filePaths)
+	waitGroup.Wait()
+	return err
+}
+
+// AddFileToIndex adds the specified image to the index.  Unsupported files are ignored.
+func (perceptualIndex PerceptualIndex) AddFileToIndex(filePath string) error {
+	if !isPerceptualHashSupported(filePath) {
+		return nil
+	}
+	if _, err := perceptualIndex.derivePerceptualHash(filePath); err != nil {
+		return err
+	}
+	perceptualIndex.mutex.Lock()
+	defer perceptualIndex.mutex.Unlock()
+	perceptualIndex.indexedPaths[filePath] = true
+	return nil
+}
+
+// AddMovedFileToIndex adds the specified image, just moved from sourcePath, to the index, keeping its hash if already derived.
+func (perceptualIndex PerceptualIndex) AddMovedFileToIndex(sourcePath string, destPath string) error {
+	perceptualIndex.mutex.Lock()
+	hash, isPresent := perceptualIndex.hashes[sourcePath]
+	if isPresent {
+		delete(perceptualIndex.hashes, sourcePath)
+		perceptualIndex.hashes[destPath] = hash
+	}
+	perceptualIndex.mutex.Unlock()
+	if isPresent && perceptualIndex.hashCache != nil {
+		if fileInfo, err := os.Stat(destPath); err == nil {
+			perceptualIndex.hashCache.Put(destPath, fileInfo, hashCacheEntry{PerceptualHash: hash.String()})
+		}
+	}
+	return perceptualIndex.AddFileToIndex(destPath)
+}
+
+// RemoveFileFromIndex removes the specified image from the index, e.g. after it's replaced.
+func (perceptualIndex PerceptualIndex) RemoveFileFromIndex(filePath string) {
+	perceptualIndex.mutex.Lock()
+	defer perceptualIndex.mutex.Unlock()
+	delete(perceptualIndex.indexedPaths, filePath)
+	delete(perceptualIndex.hashes, filePath)
+}
+
+// Dimensions returns the width and height of the specified image.
+func (perceptualIndex PerceptualIndex) Dimensions(filePath string) (int, int, error) {
+	hash, err := perceptualIndex.derivePerceptualHash(filePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	return hash.width, hash.height, nil
+}
+
+// FindSimilar returns the path of an indexed image that looks like the specified image, or "" if there is none (or the file is not a supported image).
+func (perceptualIndex PerceptualIndex) FindSimilar(filePath string) (string, error) {
+	if !isPerceptualHashSupported(filePath) {
+		return "", nil
+	}
+	hash, err := perceptualIndex.derivePerceptualHash(filePath)
+	if err != nil {
+		return "", err
+	}
+	bestPath := ""
+	bestDistance := perceptualIndex.similarityThreshold + 1
+	for _, indexed := range perceptualIndex.snapshot() {
+		if indexed.path == filePath || !hash.hasSimilarAspectRatio(indexed.hash) {
+			continue
+		}
+		distance := bits.OnesCount64(hash.hash ^ indexed.hash.hash)
+		if distance < bestDistance || (distance == bestDistance && indexed.path < bestPath) {
+			bestPath = indexed.path
+			bestDistance = distance
+		}
+	}
+	if len(bestPath) > 0 {
+		log.Println("[DEBUG]", filePath, "differs from", bestPath, "by", bestDistance, "bits of perceptual hash")
+	}
+	return bestPath, nil
+}
+
+// snapshot copies the hashes of the indexed images, so that they can be scanned without holding the lock while other workers hash and index images.
+func (perceptualIndex PerceptualIndex) snapshot() []indexedPerceptualHash {
+	perceptualIndex.mutex.Lock()
+	defer perceptualIndex.mutex.Unlock()
+	result := make([]indexedPerceptualHash, 0, len(perceptualIndex.indexedPaths))
+	for indexedPath := range perceptualIndex.indexedPaths {
+		result = append(result, indexedPerceptualHash{path: indexedPath, hash: perceptualIndex.hashes[indexedPath]})
+	}
+	return result
+}
+
+func (perceptualIndex PerceptualIndex) derivePerceptualHash(filePath string) (perceptualHash, error) {
+	perceptualIndex.mutex.Lock()
+	hash, isPresent := perceptualIndex.hashes[filePath]
+	perceptualIndex.mutex.Unlock()
+	if isPresent {
+		return hash, nil
+	}
+
+	var fileInfo os.FileInfo
+	if perceptualIndex.hashCache != nil {
+		var err error
+		fileInfo, err = os.Stat(filePath)
+		if err != nil {
+			return perceptualHash{}, err
+		}
+		if cachedHash, err := parsePerceptualHash(perceptualIndex.hashCache.Get(filePath, fileInfo).PerceptualHash); err == nil {
+			hash = cachedHash
+			isPresent = true
+		}
+	}
+	if !isPresent {
+		var err error
+		hash, err = derivePerceptualHashFromFile(filePath)
+		if err != nil {
+			return perceptualHash{}, err
+		}
+		if perceptualIndex.hashCache != nil {
+			perceptualIndex.hashCache.Put(filePath, fileInfo, hashCacheEntry{PerceptualHash: hash.String()})
+		}
+	}
+	perceptualIndex.mutex.Lock()
+	defer perceptualIndex.mutex.Unlock()
+	perceptualIndex.hashes[filePath] = hash
+	return hash, nil
+}
+
+// isPerceptualHashSupported determines by its extension whether the file is an image that can be decoded for a perceptual hash.
+func isPerceptualHashSupported(filePath string) bool {
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".jpg", ".jpeg", ".png":
+		return true
+	}
+	return false
+}
+
+func derivePerceptualHashFromFile(filePath string) (perceptualHash, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return perceptualHash{}, err
+	}
+	defer file.Close()
+	orientation := readExifOrientation(file)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return perceptualHash{}, err
+	}
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return perceptualHash{}, err
+	}
+	return derivePerceptualHashFromImage(img, orientation)
+}
+
+// readExifOrientation reads the EXIF orientation of an image, 1 (as stored) if it has none.
+func readExifOrientation(reader io.Reader) int {
+	x, err := exif.Decode(reader)
+	if err != nil {
+		return 1
+	}
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+	orientation, err := tag.Int(0)
+	if err != nil || orientation < 1 || orientation > 8 {
+		return 1
+	}
+	return orientation
+}
+
+// derivePerceptualHashFromImage computes a dHash of the image as displayed with the given EXIF orientation, so that a rotated original matches a copy with the rotation applied: the image is reduced to 9x8 cells of average luminance, and each bit records whether a cell is darker than its right neighbour.
+func derivePerceptualHashFromImage(img image.Image, orientation int) (perceptualHash, error) {
+	const columns, rows = 9, 8
+	bounds := img.Bounds()
+	storedWidth, storedHeight := bounds.Dx(), bounds.Dy()
+	width, height := storedWidth, storedHeight
+	if orientation >= 5 {
+		width, height = storedHeight, storedWidth
+	}
+	if width < columns || height < rows {
+		return perceptualHash{}, errors.New("image is too small")
+	}
+
+	luminance := func(x int, y int) float64 {
+		r, g, b, _ := img.At(x, y).RGBA()
+		return 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+	}
+	switch typedImage := img.(type) {
+	case *image.YCbCr:
+		luminance = func(x int, y int) float64 {
+			return float64(typedImage.Y[typedImage.YOffset(x, y)])
+		}
+	case *image.Gray:
+		luminance = func(x int, y int) float64 {
+			return float64(typedImage.Pix[typedImage.PixOffset(x, y)])
+		}
+	}
+
+	var sums [rows][columns]float64
+	var counts [rows][columns]int
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			displayedX, displayedY := orientPoint(x-bounds.Min.X, y-bounds.Min.Y, storedWidth, storedHeight, orientation)
+			row := displayedY * rows / height
+			column := displayedX * columns / width
+			sums[row][column] += luminance(x, y)
+			counts[row][column]++
+		}
+	}
+	var hash uint64
+	for row := 0; row < rows; row++ {
+		for column := 0; column < columns-1; column++ {
+			hash <<= 1
+			if sums[row][column]/float64(counts[row][column]) < sums[row][column+1]/float64(counts[row][column+1]) {
+				hash |= 1
+			}
+		}
+	}
+	return perceptualHash{hash: hash, width: width, height: height}, nil
+}
+
+// orientPoint maps a point of a stored image of the given size to where it's displayed with the given EXIF orientation.
+func orientPoint(x int, y int, width int, height int, orientation int) (int, int) {
+	switch orientation {
+	case 2: // mirrored horizontally
+		return width - 1 - x, y
+	case 3: // rotated 180°
+		return width - 1 - x, height - 1 - y
+	case 4: // mirrored vertically
+		return x, height - 1 - y
+	case 5: // transposed
+		return y, x
+	case 6: // rotated 90° clockwise
+		return height - 1 - y, x
+	case 7: // transversed
+		return height - 1 - y, width - 1 - x
+	case 8: // rotated 90° counterclockwise
+		return y, width - 1 - x
+	}
+	return x, y
+}
+
+// hasSimilarAspectRatio determines whether the images have nearly the same aspect ratio, allowing for rounding when resized.
+func (hash perceptualHash) hasSimilarAspectRatio(other perceptualHash) bool {
+	aspectRatio := float64(hash.width) / float64(hash.height)
+	otherAspectRatio := float64(other.width) / float64(other.height)
+	return math.Abs(aspectRatio-otherAspectRatio)/aspectRatio <= maxAspectRatioDifference
+}
+
+// String formats the hash for the hash cache, e.g. "f0e1d2c3b4a59687-4032x3024".
+func (hash perceptualHash) String() string {
+	return fmt.Sprintf("%016x-%dx%d", hash.hash, hash.width, hash.height)
+}
+
+func parsePerceptualHash(value string) (perceptualHash, error) {
+	var result perceptualHash
+	if _, err := fmt.Sscanf(value, "%016x-%dx%d", &result.hash, &result.width, &result.height); err != nil {
+		return perceptualHash{}, err
+	}
+	if result.width <= 0 || result.height <= 0 {
+		return perceptualHash{}, errors.New("invalid dimensions in perceptual hash '" + value + "'")
+	}
+	return result, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"path/filepath"
+	"testing"
+)
+
+// newTestImage returns a landscape image with features that a dHash picks up.
+func newTestImage() *image.Gray {
+	result := image.NewGray(image.Rect(0, 0, 96, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 96; x++ {
+			result.SetGray(x, y, color.Gray{Y: uint8((x*x/40 + y*3 + (x/12)*(y/8)*9) % 256)})
+		}
+	}
+	return result
+}
+
+// rotateTestImage returns the image rotated by 90°, clockwise or not.
+func rotateTestImage(img *image.Gray, isClockwise bool) *image.Gray {
+	bounds := img.Bounds()
+	result := image.NewGray(image.Rect(0, 0, bounds.Dy(), bounds.Dx()))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			if isClockwise {
+				result.SetGray(bounds.Dy()-1-y, x, img.GrayAt(x, y))
+			} else {
+				result.SetGray(y, bounds.Dx()-1-x, img.GrayAt(x, y))
+			}
+		}
+	}
+	return result
+}
+
+// newTestJpegWithOrientation encodes the image as a JPEG with an EXIF orientation.
+func newTestJpegWithOrientation(t *testing.T, img image.Image, orientation uint16) []byte {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	var tiff bytes.Buffer
+	tiff.WriteString("MM")
+	binary.Write(&tiff, binary.BigEndian, uint16(42))
+	binary.Write(&tiff, binary.BigEndian, uint32(8))
+	value := make([]byte, 2)
+	binary.BigEndian.PutUint16(value, orientation)
+	tiff.Write(encodeIfd([]tiffEntry{{tag: 0x0112, kind: 3, count: 1, value: value}}, 8, binary.BigEndian, 0)) // Orientation, SHORT
+	var result bytes.Buffer
+	result.Write(encoded.Bytes()[:2])
+	result.Write([]byte{0xFF, jpegMarkerAPP1})
+	binary.Write(&result, binary.BigEndian, uint16(2+len(exifHeader)+tiff.Len()))
+	result.Write(exifHeader)
+	result.Write(tiff.Bytes())
+	result.Write(encoded.Bytes()[2:])
+	return result.Bytes()
+}
+
+func TestDerivePerceptualHashFromImageAppliesOrientation(t *testing.T) {
+	upright := newTestImage()
+	want, err := derivePerceptualHashFromImage(upright, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		stored      image.Image
+		orientation int
+	}{
+		{"stored rotated counterclockwise", rotateTestImage(upright, false), 6},
+		{"stored rotated clockwise", rotateTestImage(upright, true), 8},
+		{"stored upside down", rotateTestImage(rotateTestImage(upright, true), true), 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := derivePerceptualHashFromImage(test.stored, test.orientation)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			asStored, err := derivePerceptualHashFromImage(test.stored, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if asStored == want {
+				t.Errorf("got %v ignoring orientation, want a different hash", asStored)
+			}
+		})
+	}
+}
+
+func TestFindSimilarMatchesRotatedOriginal(t *testing.T) {
+	dirPath := t.TempDir()
+	uprightPath := filepath.Join(dirPath, "upright.jpg")
+	rotatedPath := filepath.Join(dirPath, "rotated.jpg")
+	writeTestFile(t, uprightPath, string(newTestJpegWithOrientation(t, newTestImage(), 1)))
+	writeTestFile(t, rotatedPath, string(newTestJpegWithOrientation(t, rotateTestImage(newTestImage(), false), 6)))
+
+	perceptualIndex := NewPerceptualIndex(defaultSimilarityThreshold, nil, nil, 1)
+	if err := perceptualIndex.AddFileToIndex(uprightPath); err != nil {
+		t.Fatal(err)
+	}
+	got, err := perceptualIndex.FindSimilar(rotatedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != uprightPath {
+		t.Errorf("got %q, want %q", got, uprightPath)
+	}
+	width, height, err := perceptualIndex.Dimensions(rotatedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if width != 96 || height != 64 {
+		t.Errorf("got %dx%d, want 96x64", width, height)
+	}
+}
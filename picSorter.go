@@ -1,133 +1,601 @@
 package main
 
 import (
+	"bytes"
 	"errors"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"sync"
 	"time"
+)
+
+// Routes for files archived in Google Photos.
+const (
+	archivedRouteLibrary = "library" // sort it like any other file
+	archivedRouteSubtree = "subtree" // sort it into the archived subdirectory of the library
+	archivedRouteReject  = "reject"  // move it to the archived directory of the rejects
+)
+
+// archivedRoutes lists the routes for the usage message.
+var archivedRoutes = []string{archivedRouteLibrary, archivedRouteSubtree, archivedRouteReject}
+
+// isArchivedRoute determines whether the given name is one of the archivedRoutes.
+func isArchivedRoute(name string) bool {
+	for _, archivedRoute := range archivedRoutes {
+		if name == archivedRoute {
+			return true
+		}
+	}
+	return false
+}
 
-	"github.com/rwcarlsen/goexif/exif"
+// Types of link created in the library for collections such as favorites.
+const (
+	linkTypeSymlink  = "symlink"
+	linkTypeHardlink = "hardlink"
 )
 
+// linkTypes lists the link types for the usage message.
+var linkTypes = []string{linkTypeSymlink, linkTypeHardlink}
+
+// isLinkType determines whether the given name is one of the linkTypes.
+func isLinkType(name string) bool {
+	for _, linkType := range linkTypes {
+		if name == linkType {
+			return true
+		}
+	}
+	return false
+}
+
 // PicSorter sorts pictures into a library, while extracting incoming duplicates, unsupported files, etc.
 type PicSorter struct {
 	isDryRun        bool
 	deduper         *Deduper
 	fileMover       *FileMover
+	dateExtractors  []DateExtractor
+	layout          *Layout
+	report          *SortReport
 	libDir          string
-	duplicateDir    string
+	similarDir      string
+	replacedDir     string // for library files replaced by better incoming files
 	trashedDir      string
 	unsupportedDir  string
-	matchLivePhotos bool // e.g. match video IMG_7299.MP4 as live photo to metadata from IMG_7299.HEIC.json
-	local           *time.Location
+	archiveDir      string // for archives once extracted
+	sidecarResolver *SidecarResolver
+	isWritingXmp    bool   // write Google metadata to XMP sidecars of sorted files
+	isEmbeddingExif bool   // embed the date and location in JPEG files without EXIF
+	originalsDir    string // for the originals of files modified before sorting
+	archivedRoute   string // for files archived in Google Photos
+	archivedDir     string // for archived files, in the library or the rejects depending on the route
+	favoritesDir    string // for links to files favorited in Google Photos, or "" if not linking them
+	albumsDir       string // for folders of links recreating Google Photos albums, or "" if not recreating them
+	linkType        string
+	location        *time.Location
+	timeZoneLookup  *TimeZoneLookup // nil unless localizing by GPS coordinates
+	jobs            int             // number of files to prepare concurrently
+}
+
+// SortDirs are the directories to which a PicSorter moves files.
+type SortDirs struct {
+	LibDir         string
+	SimilarDir     string
+	ReplacedDir    string // for library files replaced by better incoming files
+	TrashedDir     string
+	UnsupportedDir string
+	ArchiveDir     string // for archives once extracted
+	OriginalsDir   string // for the originals of files modified before sorting
+	ArchivedDir    string // for archived files, in the library or the rejects depending on the route
+	FavoritesDir   string // for links to files favorited in Google Photos, or "" if not linking them
+	AlbumsDir      string // for folders of links recreating Google Photos albums, or "" if not recreating them
 }
 
-// NewPicSorter creates a new PicSorter with the given Deduper and FileMover.
-func NewPicSorter(isDryRun bool, deduper *Deduper, fileMover *FileMover, libDir string, duplicateDir string, trashedDir string, unsupportedDir string, matchLivePhotos bool) *PicSorter {
+// PicSorterConfig is the configuration of a PicSorter, set from the command-line options.
+type PicSorterConfig struct {
+	Dirs            SortDirs
+	IsDryRun        bool
+	ArchivedRoute   string // for files archived in Google Photos
+	LinkType        string
+	MatchLivePhotos bool
+	IsWritingXmp    bool // write Google metadata to XMP sidecars of sorted files
+	IsEmbeddingExif bool // embed the date and location in JPEG files without EXIF
+	Location        *time.Location
+	TimeZoneLookup  *TimeZoneLookup // nil unless localizing by GPS coordinates
+	Jobs            int             // number of files to prepare concurrently
+}
+
+// NewPicSorter creates a new PicSorter with the given Deduper, FileMover, date extractors (in order of precedence), layout, report, and configuration.
+func NewPicSorter(deduper *Deduper, fileMover *FileMover, dateExtractors []DateExtractor, layout *Layout, report *SortReport, config PicSorterConfig) *PicSorter {
 	result := new(PicSorter)
-	result.isDryRun = isDryRun
+	result.isDryRun = config.IsDryRun
 	result.deduper = deduper
 	result.fileMover = fileMover
-	result.libDir = libDir
-	result.duplicateDir = duplicateDir
-	result.trashedDir = trashedDir
-	result.unsupportedDir = unsupportedDir
-	result.matchLivePhotos = matchLivePhotos
-	// Workaround to get "local" location. "Time.Local()" does not pick the right offset for DST state.
-	zoneName, offset := time.Now().Zone()
-	result.local = time.FixedZone(zoneName, offset)
+	result.dateExtractors = dateExtractors
+	result.layout = layout
+	result.report = report
+	result.libDir = config.Dirs.LibDir
+	result.similarDir = config.Dirs.SimilarDir
+	result.replacedDir = config.Dirs.ReplacedDir
+	result.trashedDir = config.Dirs.TrashedDir
+	result.unsupportedDir = config.Dirs.UnsupportedDir
+	result.archiveDir = config.Dirs.ArchiveDir
+	result.sidecarResolver = NewSidecarResolver(config.MatchLivePhotos)
+	result.isWritingXmp = config.IsWritingXmp
+	result.isEmbeddingExif = config.IsEmbeddingExif
+	result.originalsDir = config.Dirs.OriginalsDir
+	result.archivedRoute = config.ArchivedRoute
+	result.archivedDir = config.Dirs.ArchivedDir
+	result.favoritesDir = config.Dirs.FavoritesDir
+	result.albumsDir = config.Dirs.AlbumsDir
+	result.linkType = config.LinkType
+	result.location = config.Location
+	result.timeZoneLookup = config.TimeZoneLookup
+	result.jobs = config.Jobs
 	return result
 }
 
-// Sort sorts pictures in the specified directory into the library.  Extracts duplicates, trashed, and unsupported files to a special location.
+// sortTask is an incoming file queued for preparation, whose candidate is delivered on the result channel.
+type sortTask struct {
+	path   string
+	result chan sortCandidate
+}
+
+// sortCandidate is an incoming file with its metadata extracted, ready for the decision of where to move it.
+type sortCandidate struct {
+	path           string
+	isIncomingCopy bool // identical to another incoming file, which is kept instead
+	isUnsupported  bool // by extension
+	googleMetadata *GooglePhotoMetadata
+	captureTime    CaptureTime
+	localTimestamp time.Time // the capture time in the location derived for the file, by which it's filed
+	dateSource     string
+	dateErr        error
+	newPath        string
+	newPathErr     error
+}
+
+// Sort sorts pictures in the specified directory into the library.  Extracts duplicates, trashed, and unsupported files to a special location.  Metadata extraction and hashing run concurrently, while files are moved one at a time in scan order, so that the index and undo journal remain consistent.  Archives are sorted afterwards, a file at a time as it is extracted.
 func (sorter PicSorter) Sort(dirPath string) error {
 	var unsupportedPaths []string
-	log.Println("[INFO]", "Scanning incoming files from", dirPath)
-	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+	var incomingCopyPaths []string
+	extractRoot := dirPath
+	if sorter.isDryRun {
+		// Nothing is written in a dry run, so archives are extracted to a scratch directory instead.
+		scratchDir, err := ioutil.TempDir("", "picsort-dryrun-")
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() {
-			if isUnsupportedFileByExtension(path) {
-				log.Println("[INFO] Treating file as 'unsupported' based on its extension", path)
-				unsupportedPaths = append(unsupportedPaths, path)
-				return nil
-			}
-
-			googleMetadata := sorter.getGooglePhotoMetadata(path)
-			if googleMetadata != nil && googleMetadata.IsTrashed {
-				log.Println("[INFO] Treating file as 'trashed' based on the metadata", path)
-				err = sorter.handleTrashed(path, dirPath)
-				if err != nil {
-					log.Println("[WARN]", path, "Failed to check/handle trashed:", err)
-				}
-				return nil
-			}
-
-			newPath, err := sorter.deriveNewPathFromFileMetadata(path)
+		defer os.RemoveAll(scratchDir)
+		extractRoot = scratchDir
+	}
+	archiveGroups, err := findArchiveGroups(dirPath, extractRoot)
+	if err != nil {
+		log.Println("[WARN]", "Failed to find archives:", err)
+	}
+	stagedPaths := make(map[string]bool)
+	for _, group := range archiveGroups {
+		sorter.extractArchiveSidecars(group)
+		for _, sidecarPath := range group.sidecarPaths {
+			stagedPaths[sidecarPath] = true
+		}
+	}
+	roots := []string{dirPath}
+	if extractRoot != dirPath {
+		roots = append(roots, extractRoot)
+	}
+	var albums []Album
+	if len(sorter.albumsDir) > 0 {
+		for _, albumRoot := range roots {
+			rootAlbums, err := findAlbums(albumRoot)
 			if err != nil {
-				if googleMetadata != nil {
-					newPath, err = sorter.deriveNewPathFromGoogleMetadata(path, googleMetadata)
-				}
-				if err != nil {
-					// The file is unsupported.  Nevertheless, check for duplicates.
-					// This is realy only useful with eager deduping, but it could save us from having to care about why the file is unsupported.
-					isDuplicate, err := sorter.checkAndHandleIndexedDupes(path, dirPath)
-					if err != nil {
-						log.Println("[WARN]", path, "Failed to check/handle indexed duplicates:", err)
-					} else if isDuplicate {
-						log.Println("[INFO] Treating file as 'duplicate' (unsupported)", path)
-					} else {
-						log.Println("[INFO] Treating file as 'unsupported' due to lack of metadata (file or Google)", path)
-						unsupportedPaths = append(unsupportedPaths, path)
-					}
-					return nil
-				}
+				log.Println("[WARN]", "Failed to find albums:", err)
 			}
+			albums = append(albums, rootAlbums...)
+		}
+	}
+	// Resolve sidecars from the files as they are now, since sorting moves them.
+	for _, indexRoot := range roots {
+		if err := sorter.sidecarResolver.IndexDirectory(indexRoot); err != nil {
+			log.Println("[WARN]", "Failed to list sidecars:", err)
+		}
+	}
+	log.Println("[INFO]", "Finding identical incoming files in", dirPath)
+	incomingCopies := sorter.findIncomingCopies(dirPath)
+	log.Println("[INFO]", "Scanning incoming files from", dirPath)
 
-			isDuplicate, err := sorter.checkAndHandleDupes(path, dirPath, newPath)
-			if err != nil {
-				log.Println("[WARN]", path, "Failed to check/handle duplicates:", err)
-				return nil
-			} else if isDuplicate {
-				log.Println("[INFO] Treating file as 'duplicate'", path)
-				return nil
+	tasks := make(chan *sortTask, sorter.jobs)
+	orderedTasks := make(chan *sortTask, sorter.jobs)
+	var waitGroup sync.WaitGroup
+	for i := 0; i < sorter.jobs; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for task := range tasks {
+				if _, isCopy := incomingCopies[task.path]; isCopy {
+					task.result <- sortCandidate{path: task.path, isIncomingCopy: true}
+					continue
+				}
+				task.result <- sorter.prepare(task.path, dirPath)
 			}
-
-			log.Println("[INFO] Relocating file", path)
-			destPath, err := sorter.fileMover.MoveFileWithRename(path, newPath)
+		}()
+	}
+	go func() {
+		err = filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
 			if err != nil {
-				log.Println("[WARN]", path, "Failed to sort file:", err)
-				return nil
+				return err
 			}
-
-			err = sorter.deduper.AddFileToIndex(destPath)
-			if err != nil {
-				if !sorter.isDryRun {
-					log.Println("[WARN]", path, "Failed to index file:", err)
-				}
-				return nil
+			// The files extracted from archives are sorted along with the rest of the archive.
+			if !info.IsDir() && !isTakeoutArchive(path) && !stagedPaths[path] {
+				task := &sortTask{path: path, result: make(chan sortCandidate, 1)}
+				tasks <- task
+				orderedTasks <- task
 			}
+			return nil
+		})
+		close(tasks)
+		close(orderedTasks)
+	}()
+	for task := range orderedTasks {
+		candidate := <-task.result
+		if candidate.isIncomingCopy {
+			incomingCopyPaths = append(incomingCopyPaths, candidate.path)
+		} else if candidate.isUnsupported {
+			unsupportedPaths = append(unsupportedPaths, candidate.path)
+		} else if !sorter.decide(candidate, dirPath) {
+			log.Println("[INFO] Treating file as 'unsupported' due to lack of a date from any source", candidate.path)
+			unsupportedPaths = append(unsupportedPaths, candidate.path)
 		}
-		return nil
-	})
+	}
+	waitGroup.Wait()
+
+	for _, group := range archiveGroups {
+		sorter.sortArchive(group)
+	}
 
 	log.Println("[INFO]", "Cleaning up unsupported files.")
 	for _, unsupportedPath := range unsupportedPaths {
-		_, err := sorter.fileMover.MoveFileWithPreservedPath(unsupportedPath, dirPath, sorter.unsupportedDir)
+		sorter.moveUnsupported(unsupportedPath, dirPath)
+	}
+
+	log.Println("[INFO]", "Cleaning up identical incoming files.")
+	keptEntries := sorter.report.EntriesByPath()
+	for _, copyPath := range incomingCopyPaths {
+		keptPath := incomingCopies[copyPath]
+		keptEntry, isPresent := keptEntries[keptPath]
+		if !isPresent || keptEntry.Outcome == outcomeFailed {
+			log.Println("[WARN]", copyPath, "Leaving identical file in place, since", keptPath, "failed")
+			sorter.report.Add(SortReportEntry{Path: copyPath, Outcome: outcomeFailed, Detail: "identical to " + keptPath + ", which failed"})
+			continue
+		}
+		log.Println("[INFO] Treating file as 'duplicate' of incoming file", keptPath, copyPath)
+		if len(keptEntry.Destination) > 0 {
+			// Link to the kept file where it now is, in the library.
+			keptPath = keptEntry.Destination
+		} else if len(keptEntry.Kept) > 0 {
+			// The kept file was itself a duplicate of a library file.
+			keptPath = keptEntry.Kept
+		}
+		detail, err := sorter.deduper.HandleDuplicate(copyPath, dirPath, keptPath)
 		if err != nil {
-			log.Println("[WARN]", unsupportedPath, "Failed to move unsupported file:", err)
+			log.Println("[WARN]", copyPath, "Failed to move duplicate file:", err)
+			sorter.report.Add(SortReportEntry{Path: copyPath, Outcome: outcomeFailed, Detail: err.Error()})
+		} else {
+			sorter.report.Add(SortReportEntry{Path: copyPath, Outcome: outcomeDuplicate, Kept: keptPath, Detail: detail})
 		}
 	}
+	if len(albums) > 0 {
+		log.Println("[INFO]", "Linking", len(albums), "albums.")
+		sorter.linkAlbums(albums)
+	}
 	sorter.fileMover.DeleteEmptyDirectories(dirPath)
 
 	return err
 }
 
+// moveUnsupported moves the file, relative to the given root, to the unsupported directory.
+func (sorter PicSorter) moveUnsupported(filePath string, fileRoot string) {
+	_, err := sorter.fileMover.MoveFileWithPreservedPath(filePath, fileRoot, sorter.unsupportedDir)
+	if err != nil {
+		log.Println("[WARN]", filePath, "Failed to move unsupported file:", err)
+		sorter.report.Add(SortReportEntry{Path: filePath, Outcome: outcomeFailed, Detail: err.Error()})
+	} else {
+		sorter.report.Add(SortReportEntry{Path: filePath, Outcome: outcomeUnsupported})
+	}
+}
+
+// findIncomingCopies finds identical incoming files, and chooses one of each to keep: preferably one with Google metadata that isn't trashed, otherwise the first by path.  Returns the path of the file to keep, by the path of each other copy.
+func (sorter PicSorter) findIncomingCopies(dirPath string) map[string]string {
+	result := make(map[string]string)
+	groups, err := sorter.deduper.FindDuplicatesWithin(dirPath)
+	if err != nil {
+		log.Println("[WARN]", "Failed to find identical incoming files:", err)
+		return result
+	}
+	for _, group := range groups {
+		var paths []string
+		for _, path := range group {
+			if !isUnsupportedFileByExtension(path) {
+				paths = append(paths, path)
+			}
+		}
+		if len(paths) < 2 {
+			continue
+		}
+		keptPath := paths[0]
+		keptRank := sorter.rankIncomingCopy(keptPath)
+		for _, path := range paths[1:] {
+			if rank := sorter.rankIncomingCopy(path); rank > keptRank {
+				keptPath = path
+				keptRank = rank
+			}
+		}
+		log.Println("[INFO]", "Keeping", keptPath, "of identical incoming files", strings.Join(paths, ", "))
+		for _, path := range paths {
+			if path != keptPath {
+				result[path] = keptPath
+			}
+		}
+	}
+	return result
+}
+
+// rankIncomingCopy ranks a copy of an incoming file by its metadata, higher being preferable to keep.
+func (sorter PicSorter) rankIncomingCopy(filePath string) int {
+	googleMetadata := sorter.getGooglePhotoMetadata(filePath)
+	if googleMetadata == nil {
+		return 1
+	} else if googleMetadata.IsTrashed {
+		return 0
+	}
+	return 2
+}
+
+// prepare extracts the metadata of the given file, derives its destination, indexes the destination directory (if not yet indexed), and derives the hashes needed to check the file for duplicates there.  It's safe to call concurrently, and moves nothing.
+func (sorter PicSorter) prepare(path string, fileRoot string) sortCandidate {
+	candidate := sortCandidate{path: path}
+	if isUnsupportedFileByExtension(path) {
+		log.Println("[INFO] Treating file as 'unsupported' based on its extension", path)
+		candidate.isUnsupported = true
+		return candidate
+	}
+
+	candidate.googleMetadata = sorter.getGooglePhotoMetadata(path)
+	if candidate.googleMetadata != nil && candidate.googleMetadata.IsTrashed {
+		return candidate
+	}
+
+	defer sorter.deduper.PrehashFile(path)
+	mediaFile := NewMediaFile(path, candidate.googleMetadata)
+	candidate.captureTime, candidate.dateSource, candidate.dateErr = sorter.extractDate(mediaFile)
+	if candidate.dateErr != nil {
+		return candidate
+	}
+	candidate.localTimestamp = candidate.captureTime.Localize(sorter.deriveLocation(mediaFile, candidate.captureTime))
+	candidate.newPath, candidate.newPathErr = sorter.deriveNewPath(mediaFile, fileRoot, candidate.captureTime, candidate.localTimestamp, candidate.dateSource)
+	if candidate.newPathErr == nil {
+		// Index the destination before prehashing, since the file is only hashed if an indexed file has the same size.
+		if err := sorter.deduper.AddDirectoryToIndex(filepath.Dir(candidate.newPath)); err != nil {
+			log.Println("[DEBUG]", "Failed to index", filepath.Dir(candidate.newPath), ":", err)
+		}
+	}
+	return candidate
+}
+
+// decide moves the prepared file to the library, or to the rejects if it's trashed or a duplicate.  Returns false if the file is unsupported, for the caller to move later.
+func (sorter PicSorter) decide(candidate sortCandidate, fileRoot string) bool {
+	path := candidate.path
+	if candidate.googleMetadata != nil && candidate.googleMetadata.IsTrashed {
+		log.Println("[INFO] Treating file as 'trashed' based on the metadata", path)
+		err := sorter.handleTrashed(path, fileRoot)
+		if err != nil {
+			log.Println("[WARN]", path, "Failed to check/handle trashed:", err)
+			sorter.report.Add(SortReportEntry{Path: path, Outcome: outcomeFailed, Detail: err.Error()})
+		} else {
+			sorter.report.Add(SortReportEntry{Path: path, Outcome: outcomeTrashed})
+		}
+		return true
+	}
+
+	if candidate.googleMetadata != nil && candidate.googleMetadata.IsArchived && sorter.archivedRoute == archivedRouteReject {
+		log.Println("[INFO] Treating file as 'archived' based on the metadata", path)
+		_, err := sorter.fileMover.MoveFileWithPreservedPath(path, fileRoot, sorter.archivedDir)
+		if err != nil {
+			log.Println("[WARN]", path, "Failed to move archived file:", err)
+			sorter.report.Add(SortReportEntry{Path: path, Outcome: outcomeFailed, Detail: err.Error()})
+		} else {
+			sorter.report.Add(SortReportEntry{Path: path, Outcome: outcomeArchived})
+		}
+		return true
+	}
+
+	if candidate.dateErr != nil {
+		// The file is unsupported.  Nevertheless, check for duplicates.
+		// This is realy only useful with eager deduping, but it could save us from having to care about why the file is unsupported.
+		duplicatePath, detail, err := sorter.checkAndHandleIndexedDupes(path, fileRoot)
+		if err != nil {
+			log.Println("[WARN]", path, "Failed to check/handle indexed duplicates:", err)
+			sorter.report.Add(SortReportEntry{Path: path, Outcome: outcomeFailed, Detail: err.Error()})
+			return true
+		} else if len(duplicatePath) > 0 {
+			log.Println("[INFO] Treating file as 'duplicate' (unsupported)", path)
+			sorter.report.Add(SortReportEntry{Path: path, Outcome: outcomeDuplicate, Kept: duplicatePath, Detail: detail})
+			return true
+		}
+		return false
+	}
+	dateSource := candidate.dateSource
+	if candidate.newPathErr != nil {
+		log.Println("[WARN]", path, "Failed to derive destination path:", candidate.newPathErr)
+		sorter.report.Add(SortReportEntry{Path: path, Outcome: outcomeFailed, DateSource: dateSource, Detail: candidate.newPathErr.Error()})
+		return true
+	}
+
+	duplicatePath, dupeDetail, err := sorter.checkAndHandleDupes(path, fileRoot, candidate.newPath)
+	if err != nil {
+		log.Println("[WARN]", path, "Failed to check/handle duplicates:", err)
+		sorter.report.Add(SortReportEntry{Path: path, Outcome: outcomeFailed, DateSource: dateSource, Detail: err.Error()})
+		return true
+	} else if len(duplicatePath) > 0 {
+		log.Println("[INFO] Treating file as 'duplicate'", path)
+		sorter.report.Add(SortReportEntry{Path: path, Outcome: outcomeDuplicate, Kept: duplicatePath, DateSource: dateSource, Detail: dupeDetail})
+		return true
+	}
+
+	var embeddedContent []byte
+	if sorter.isEmbeddingExif {
+		embeddedContent, err = sorter.deriveEmbeddedExif(candidate)
+		if err != nil {
+			log.Println("[WARN]", path, "Failed to embed EXIF, sorting it unchanged:", err)
+			embeddedContent = nil
+		}
+	}
+	if embeddedContent != nil {
+		// A copy sorted by an earlier run has the same EXIF embedded, so it's only identical once embedded.
+		duplicatePath, dupeDetail, err := sorter.checkAndHandleEmbeddedDupes(path, fileRoot, embeddedContent)
+		if err != nil {
+			log.Println("[WARN]", path, "Failed to check/handle duplicates with EXIF embedded:", err)
+			sorter.report.Add(SortReportEntry{Path: path, Outcome: outcomeFailed, DateSource: dateSource, Detail: err.Error()})
+			return true
+		} else if len(duplicatePath) > 0 {
+			log.Println("[INFO] Treating file as 'duplicate' once EXIF is embedded", path)
+			sorter.report.Add(SortReportEntry{Path: path, Outcome: outcomeDuplicate, Kept: duplicatePath, DateSource: dateSource, Detail: dupeDetail})
+			return true
+		}
+	}
+
+	similarPath, isReplaced, err := sorter.checkAndHandleSimilar(path, fileRoot)
+	if err != nil {
+		log.Println("[WARN]", path, "Failed to check/handle similar images:", err)
+		sorter.report.Add(SortReportEntry{Path: path, Outcome: outcomeFailed, DateSource: dateSource, Detail: err.Error()})
+		return true
+	} else if len(similarPath) > 0 && !isReplaced {
+		log.Println("[INFO] Treating file as 'similar' to", similarPath, path)
+		sorter.report.Add(SortReportEntry{Path: path, Outcome: outcomeSimilar, Kept: similarPath, DateSource: dateSource, Detail: "similar to " + similarPath})
+		return true
+	}
+
+	if embeddedContent != nil {
+		if err := sorter.embedExif(path, fileRoot, embeddedContent); err != nil {
+			log.Println("[WARN]", path, "Failed to embed EXIF, sorting it unchanged:", err)
+		}
+	}
+
+	log.Println("[INFO] Relocating file", path)
+	destPath, err := sorter.fileMover.MoveFileWithRename(path, candidate.newPath)
+	if err != nil {
+		log.Println("[WARN]", path, "Failed to sort file:", err)
+		sorter.report.Add(SortReportEntry{Path: path, Outcome: outcomeFailed, DateSource: dateSource, Detail: err.Error()})
+		return true
+	}
+	detail := ""
+	if isReplaced {
+		detail = "replaced similar " + similarPath
+	}
+	sorter.report.Add(SortReportEntry{Path: path, Outcome: outcomeSorted, Destination: destPath, DateSource: dateSource, Detail: detail})
+	if sorter.isDryRun {
+		// The file wasn't moved, but index it anyway to find duplicates among the incoming files.
+		err = sorter.deduper.AddFileToIndex(path)
+	} else {
+		err = sorter.deduper.AddMovedFileToIndex(path, destPath)
+	}
+	if err != nil {
+		log.Println("[WARN]", path, "Failed to index file:", err)
+	}
+	if len(sorter.favoritesDir) > 0 && candidate.googleMetadata != nil && candidate.googleMetadata.IsFavorited {
+		if _, err := sorter.fileMover.CreateLink(filepath.Join(sorter.favoritesDir, filepath.Base(destPath)), destPath, sorter.linkType == linkTypeSymlink); err != nil {
+			log.Println("[WARN]", path, "Failed to link favorite:", err)
+		}
+	}
+	if sorter.isWritingXmp && candidate.googleMetadata != nil {
+		if err := sorter.writeXmpSidecar(destPath, candidate); err != nil {
+			log.Println("[WARN]", path, "Failed to write XMP sidecar:", err)
+		}
+	}
+	return true
+}
+
+// deriveEmbeddedExif returns the content of a JPEG file with the capture date, and the Google location if any, written into its EXIF, so that it's found by any photo manager.  Tags the file already has are kept.  Returns nil if the file isn't a JPEG or has nothing to add.
+func (sorter PicSorter) deriveEmbeddedExif(candidate sortCandidate) ([]byte, error) {
+	path := candidate.path
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".jpg" && ext != ".jpeg" {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	mediaFile := NewMediaFile(path, candidate.googleMetadata)
+	tags := ExifTags{
+		DateTimeOriginal: candidate.localTimestamp,
+		HasOffset:        candidate.captureTime.Kind != CaptureTimeLocal,
+	}
+	if latitude, longitude, err := mediaFile.Coordinates(); err == nil {
+		tags.HasLocation = true
+		tags.Latitude = latitude
+		tags.Longitude = longitude
+	}
+	return embedJpegExif(content, tags)
+}
+
+// embedExif replaces the file with the given content, derived by deriveEmbeddedExif.  The original is moved to the originals directory first, so the change can be undone.
+func (sorter PicSorter) embedExif(path string, fileRoot string, embeddedContent []byte) error {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	log.Println("[INFO] Embedding EXIF in", path)
+	originalPath, err := sorter.fileMover.MoveFileWithPreservedPath(path, fileRoot, sorter.originalsDir)
+	if err != nil {
+		return err
+	}
+	if _, err := sorter.fileMover.CreateFile(path, bytes.NewReader(embeddedContent), fileInfo.ModTime()); err != nil {
+		if _, restoreErr := sorter.fileMover.MoveFileWithRename(originalPath, path); restoreErr != nil {
+			log.Println("[WARN]", "Failed to restore original", originalPath, ":", restoreErr)
+		}
+		return err
+	}
+	// The content changed, so its hashes must be derived afresh.
+	sorter.deduper.RemoveFileFromIndex(path)
+	return nil
+}
+
+// writeXmpSidecar writes the Google metadata of the candidate, with the capture time by which it was filed, to an XMP sidecar next to the sorted file, unless it already has one.
+func (sorter PicSorter) writeXmpSidecar(filePath string, candidate sortCandidate) error {
+	content := renderXmpSidecar(candidate.googleMetadata, candidate.localTimestamp, candidate.captureTime.Kind != CaptureTimeLocal)
+	if content == nil {
+		return nil
+	}
+	xmpFilePath := filePath + xmpSidecarExtension
+	if _, err := os.Lstat(xmpFilePath); err == nil {
+		log.Println("[INFO]", "Keeping existing XMP sidecar", xmpFilePath)
+		return nil
+	}
+	_, err := sorter.fileMover.CreateFile(xmpFilePath, bytes.NewReader(content), time.Time{})
+	return err
+}
+
+// extractDate consults the date extractors in order of precedence, returning the first date found and the name of its source.
+func (sorter PicSorter) extractDate(mediaFile *MediaFile) (CaptureTime, string, error) {
+	for _, extractor := range sorter.dateExtractors {
+		captureTime, err := extractor.ExtractDate(mediaFile)
+		if err != nil {
+			log.Println("[DEBUG] No date from", extractor.Name(), "for", mediaFile.Path, ":", err)
+			continue
+		}
+		log.Println("[INFO] Using date from", extractor.Name(), "for", mediaFile.Path)
+		return captureTime, extractor.Name(), nil
+	}
+	return CaptureTime{}, "", errors.New("no date found from any source")
+}
+
 func (sorter PicSorter) getGooglePhotoMetadata(filePath string) *GooglePhotoMetadata {
-	metadata, _, err := NewGooglePhotoMetadata(filePath, sorter.matchLivePhotos)
+	metadata, _, err := NewGooglePhotoMetadata(filePath, sorter.sidecarResolver)
 	if err != nil {
 		// probably no metadata
 		return nil
@@ -143,68 +611,133 @@ func (sorter PicSorter) handleTrashed(filePath string, fileRoot string) error {
 	return nil
 }
 
-func (sorter PicSorter) checkAndHandleDupes(filePath string, fileRoot string, newPath string) (bool, error) {
+func (sorter PicSorter) checkAndHandleDupes(filePath string, fileRoot string, newPath string) (string, string, error) {
 	newPathDir := filepath.Dir(newPath)
 	err := sorter.deduper.AddDirectoryToIndex(newPathDir)
 	if err != nil {
-		return false, err
+		return "", "", err
 	}
 	return sorter.checkAndHandleIndexedDupes(filePath, fileRoot)
 }
 
-func (sorter PicSorter) checkAndHandleIndexedDupes(filePath string, fileRoot string) (bool, error) {
-	isDuplicate, err := sorter.deduper.IsDuplicate(filePath)
-	if err != nil {
-		return false, err
-	} else if isDuplicate {
-		_, err := sorter.fileMover.MoveFileWithPreservedPath(filePath, fileRoot, sorter.duplicateDir)
-		if err != nil {
-			return true, err
-		}
+// checkAndHandleIndexedDupes handles a file that is identical to an indexed file, returning the path of that file (or "" if there is none) and a description of what was done with it.
+func (sorter PicSorter) checkAndHandleIndexedDupes(filePath string, fileRoot string) (string, string, error) {
+	duplicatePath, err := sorter.deduper.FindDuplicate(filePath)
+	if err != nil || len(duplicatePath) == 0 {
+		return "", "", err
 	}
-	return isDuplicate, nil
+	detail, err := sorter.deduper.HandleDuplicate(filePath, fileRoot, duplicatePath)
+	return duplicatePath, detail, err
 }
 
-func (sorter PicSorter) deriveNewPathFromFileMetadata(filePath string) (string, error) {
-	picFile, err := os.Open(filePath)
+// checkAndHandleEmbeddedDupes handles a file whose content, once EXIF is embedded, is identical to an indexed file, e.g. one sorted with -embedexif by an earlier run.  Returns the path of that file (or "" if there is none) and a description of what was done with the file, which is moved unchanged since it can't be linked to a file with different content.
+func (sorter PicSorter) checkAndHandleEmbeddedDupes(filePath string, fileRoot string, embeddedContent []byte) (string, string, error) {
+	tempFile, err := ioutil.TempFile("", "picsort-*"+filepath.Ext(filePath))
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(embeddedContent)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
 	}
-
-	metadata, err := exif.Decode(picFile)
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+	duplicatePath, err := sorter.deduper.FindDuplicate(tempFile.Name())
+	sorter.deduper.RemoveFileFromIndex(tempFile.Name())
+	if err != nil || len(duplicatePath) == 0 {
+		return "", "", err
 	}
+	detail, err := sorter.deduper.MoveDuplicate(filePath, fileRoot, duplicatePath)
+	return duplicatePath, detail + " once EXIF is embedded", err
+}
 
-	timestamp, err := metadata.DateTime()
+// checkAndHandleSimilar handles a file that looks like an indexed image, returning the path of that image.  Depending on the policy, either the file is moved to the similar directory, or the image is moved to the replaced directory (returning true) for the file to take its place.
+func (sorter PicSorter) checkAndHandleSimilar(filePath string, fileRoot string) (string, bool, error) {
+	similarPath, err := sorter.deduper.FindSimilar(filePath)
 	if err != nil {
-		return "", err
+		if isPerceptualHashSupported(filePath) {
+			log.Println("[WARN]", filePath, "Unable to compare image for similarity:", err)
+		}
+		return "", false, nil
+	} else if len(similarPath) == 0 {
+		return "", false, nil
 	}
 
-	result := sorter.deriveNewPathFromTimestamp(filePath, timestamp)
-	return result, nil
+	isBetter, reason, err := sorter.deduper.IsBetterThan(filePath, similarPath)
+	if err != nil {
+		log.Println("[WARN]", filePath, "Keeping similar library file", similarPath, "due to failure to compare them:", err)
+	} else if isBetter {
+		log.Println("[INFO] Replacing similar library file", similarPath, "with", filePath, "since the incoming file", reason)
+		if _, err := sorter.fileMover.MoveFileWithPreservedPath(similarPath, sorter.libDir, sorter.replacedDir); err != nil {
+			return similarPath, false, err
+		}
+		sorter.deduper.RemoveFileFromIndex(similarPath)
+		return similarPath, true, nil
+	}
+	if _, err := sorter.fileMover.MoveFileWithPreservedPath(filePath, fileRoot, sorter.similarDir); err != nil {
+		return similarPath, false, err
+	}
+	return similarPath, false, nil
 }
 
-func (sorter PicSorter) deriveNewPathFromGoogleMetadata(filePath string, metadata *GooglePhotoMetadata) (string, error) {
-	if metadata.PhotoTakenTime.IsZero() {
-		return "", errors.New("no 'PhotoTakenTime' present in Google metadata")
+// deriveLocation determines the location in which to file the given capture time, from the GPS coordinates if enabled, else the configured location.
+func (sorter PicSorter) deriveLocation(mediaFile *MediaFile, captureTime CaptureTime) *time.Location {
+	if sorter.timeZoneLookup == nil || captureTime.Kind == CaptureTimeZoned {
+		return sorter.location
 	}
-
-	result := sorter.deriveNewPathFromTimestamp(filePath, metadata.PhotoTakenTime)
-	return result, nil
+	latitude, longitude, err := mediaFile.Coordinates()
+	if err != nil {
+		log.Println("[DEBUG] Using default time zone for", mediaFile.Path, ":", err)
+		return sorter.location
+	}
+	location, err := sorter.timeZoneLookup.Lookup(latitude, longitude)
+	if err != nil {
+		log.Println("[WARN] Using default time zone for", mediaFile.Path, "due to failure to look up time zone:", err)
+		return sorter.location
+	}
+	log.Println("[DEBUG] Using time zone", location.String(), "from coordinates", latitude, longitude, "for", mediaFile.Path)
+	return location
 }
 
-func (sorter PicSorter) deriveNewPathFromTimestamp(filePath string, timestamp time.Time) string {
-	localTimestamp := timestamp.In(sorter.local)
-	filename := filepath.Base(filePath)
-	yeardir := localTimestamp.Format("2006")
-	datedir := localTimestamp.Format("2006-01-02")
-	fileprefix := localTimestamp.Format("2006-01-02_15-04-05_")
+// deriveNewPath builds the destination path within the library from the layout, filing the capture time at the given local timestamp.
+func (sorter PicSorter) deriveNewPath(mediaFile *MediaFile, fileRoot string, captureTime CaptureTime, localTimestamp time.Time, dateSource string) (string, error) {
+	filename := filepath.Base(mediaFile.Path)
+	ext := filepath.Ext(filename)
+	fields := LayoutFields{
+		Timestamp: localTimestamp,
+		MediaType: deriveMediaType(mediaFile.Path),
+		Source:    dateSource,
+		Name:      strings.TrimSuffix(filename, ext),
+		Ext:       ext,
+	}
+	if sorter.layout.Uses("camera") || sorter.layout.Uses("make") || sorter.layout.Uses("model") {
+		fields.Make, fields.Model = mediaFile.Camera()
+	}
+	if sorter.layout.Uses("hash") {
+		hash, err := sorter.deduper.DeriveHash(mediaFile.Path)
+		if err != nil {
+			return "", err
+		}
+		fields.Hash = hash[:8]
+	}
+	if sorter.layout.Uses("reldir") {
+		relDir, err := filepath.Rel(fileRoot, filepath.Dir(mediaFile.Path))
+		if err != nil {
+			return "", err
+		}
+		fields.RelDir = relDir
+	}
 
-	result := filepath.Join(sorter.libDir, yeardir, datedir, fileprefix+filename)
-	log.Println("[DEBUG] Derived path", result, "from timestamp", timestamp.String(), "localized to", localTimestamp.String())
+	rootDir := sorter.libDir
+	if mediaFile.GoogleMetadata != nil && mediaFile.GoogleMetadata.IsArchived && sorter.archivedRoute == archivedRouteSubtree {
+		rootDir = sorter.archivedDir
+	}
+	result := filepath.Join(rootDir, sorter.layout.Render(fields))
+	log.Println("[DEBUG] Derived path", result, "from timestamp", captureTime.String(), "localized to", localTimestamp.String())
 
-	return result
+	return result, nil
 }
 
 func isUnsupportedFileByExtension(picFilePath string) bool {
@@ -1,122 +1,332 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 	"time"
+	_ "time/tzdata" // for -tz on systems without a time zone database (e.g. NAS)
 )
 
 const version = "0.10"
 
 const flagDedupeLazy = "lazy"
 const flagDedupeEager = "eager"
+const flagDedupePerceptual = "perceptual"
 
 const dedupeSubDir = "duplicates"
+const similarSubDir = "similar"
+const replacedSubDir = "replaced"
 const trashedSubDir = "trashed"
 const unsupportedSubDir = "unsupported"
+const archiveSubDir = "archives"
+const originalsSubDir = "originals"
+const archivedSubDir = "archived"
+const favoritesSubDir = "favorites"
+const albumsSubDir = "albums"
+
+// libraryLinkDirs returns the directories of the library holding links to its files, which are never indexed, so that the links aren't mistaken for duplicates even when they are hard links.
+func libraryLinkDirs(libDir string) []string {
+	return []string{filepath.Join(libDir, favoritesSubDir), filepath.Join(libDir, albumsSubDir)}
+}
+
+const defaultDateSources = "exif,video,google,filename"
+
+const defaultIndexFile = ".picsort-index.jsonl"
 
 func main() {
 	fmt.Println("picsort", version)
 
+	if len(os.Args) > 1 && os.Args[1] == "undo" {
+		runUndo(os.Args[2:])
+		return
+	} else if len(os.Args) > 1 && os.Args[1] == "dedupe-library" {
+		runDedupeLibrary(os.Args[2:])
+		return
+	}
+
+	dateExtractorRegistry := NewDateExtractorRegistry()
+
 	libDir := flag.String("libdir", "", "The directory containing your photo library (destination for sort).")
 	incomingDir := flag.String("incomingdir", "", "The directory with incoming photos (unsorted).")
-	dedupe := flag.String("dedupe", flagDedupeLazy, "How to dedupe: "+flagDedupeLazy+" = dedupe lazily per destination directory, "+flagDedupeEager+" = dedupe eagerly across entire library.")
+	dedupe := flag.String("dedupe", flagDedupeLazy, "How to dedupe: "+flagDedupeLazy+" = dedupe lazily per destination directory, "+flagDedupeEager+" = dedupe eagerly across entire library, "+flagDedupePerceptual+" = dedupe eagerly and also reject JPEG and PNG images that look like library images (e.g. recompressed copies).")
+	similarityThreshold := flag.Int("similarity", defaultSimilarityThreshold, "With -dedupe "+flagDedupePerceptual+", the maximum number of bits (of 64) by which the perceptual hashes of similar images may differ.")
 	rejectDir := flag.String("rejectdir", "", "The root directory to which rejected files will be moved.  Picsort will create subdirectories for duplicates, trashed, and files missing metadata.")
 	isDryrun := flag.Bool("dryrun", false, "Do a dry run.")
-	undoScriptFilePath := flag.String("undofile", "undo.sh", "The name of a file in which to write undo commands.")
+	undoFilePath := flag.String("undofile", "undo.jsonl", "The name of a journal file in which to record operations, for \"picsort undo\".")
+	isUndoHashed := flag.Bool("undohash", true, "Record the checksum of each moved file in the undo journal, so that undo only moves back files whose content is unchanged.  Set to false to record only the size and modification time, which avoids reading every file.")
 	matchLivePhotos := flag.Bool("matchLivePhotos", true, "Match videos to metadata as if they are live photos (e.g. match video IMG_7299.MP4 to metadata from IMG_7299.HEIC.json)")
+	dateSources := flag.String("datesources", defaultDateSources, "Comma-separated list of sources for the date of each file, in order of precedence.  Available: "+strings.Join(dateExtractorRegistry.Names(), ", ")+".")
+	var filenamePatterns stringListFlag
+	flag.Var(&filenamePatterns, "filenamepattern", "A regex for extracting dates from filenames, using named groups (?P<year>), (?P<month>), (?P<day>), and optionally (?P<hour>), (?P<minute>), (?P<second>).  May be repeated.  Takes precedence over the built-in patterns.")
+	timeZone := flag.String("tz", "Local", "The IANA time zone (e.g. America/New_York) in which to file media whose offset was not recorded.  Defaults to the system time zone.")
+	isGpsTimeZone := flag.Bool("gpstz", false, "File media in the time zone where it was captured, based on EXIF GPS or Google geoData, when its offset was not recorded.  Uses embedded time zone data (no network access).")
+	layoutTemplate := flag.String("layout", defaultLayout, "The template for the path of each file within the library.  Tokens: "+describeLayoutTokens()+".")
+	indexFilePath := flag.String("indexfile", defaultIndexFile, "The name of a file in which to cache the hashes of library files between runs, so that only new or changed files are rehashed.  Relative to -libdir unless absolute.  Set to \"\" to disable.")
+	dupePolicy := flag.String("dupepolicy", dupePolicyKeepExisting, "With -dedupe "+flagDedupePerceptual+", which of similar incoming and library images to keep: "+strings.Join(dupePolicies, ", ")+".  A library image that is replaced is moved to the \""+replacedSubDir+"\" subdirectory of -rejectdir.")
+	dupeAction := flag.String("dupeaction", dupeActionMove, "What to do with an incoming file identical to a library file: "+dupeActionMove+" = move it to the \""+dedupeSubDir+"\" subdirectory of -rejectdir, "+dupeActionHardlink+" = replace it in place with a hard link to the library file, "+dupeActionReflink+" = replace it in place with a copy-on-write clone of the library file (e.g. on Btrfs or XFS).  Falls back to moving if linking fails.")
+	hashAlgorithm := flag.String("hash", defaultHashAlgorithm, "The algorithm for hashing file content to find duplicates: "+strings.Join(sortedHashAlgorithmNames(), ", ")+".")
+	isByteCompare := flag.Bool("bytecompare", false, "Confirm that files with matching hashes are identical, byte by byte, before treating them as duplicates.")
+	jobs := flag.Int("jobs", runtime.NumCPU(), "The number of files to prepare concurrently: extracting metadata, indexing the destination directory, and hashing the file if the library holds a file of the same size (and deriving its perceptual hash with -dedupe "+flagDedupePerceptual+").  Files are still checked against the index and moved one at a time.")
+	isWritingXmp := flag.Bool("xmp", false, "Write the Google metadata of each sorted file (description, date, location, people, and favorite) to an XMP sidecar next to it in the library, named <file>"+xmpSidecarExtension+".")
+	isEmbeddingExif := flag.Bool("embedexif", false, "Write the capture date, and the Google location if any, into the EXIF of JPEG files that lack them, before moving them to the library.  The unmodified files are moved to the \""+originalsSubDir+"\" subdirectory of -rejectdir.")
+	archivedRoute := flag.String("archived", archivedRouteLibrary, "Where to put files archived in Google Photos (e.g. screenshots and receipts): "+archivedRouteLibrary+" = sort them like any other file, "+archivedRouteSubtree+" = sort them into the \""+archivedSubDir+"\" subdirectory of -libdir, "+archivedRouteReject+" = move them to the \""+archivedSubDir+"\" subdirectory of -rejectdir.")
+	isLinkingFavorites := flag.Bool("favorites", false, "Link each sorted file favorited in Google Photos into the \""+favoritesSubDir+"\" subdirectory of -libdir, in addition to sorting it.")
+	isLinkingAlbums := flag.Bool("albums", false, "Recreate the Google Photos albums among the incoming files (directories with album metadata) as folders of links to the sorted files, in the \""+albumsSubDir+"\" subdirectory of -libdir, each with a manifest named "+albumManifestName+".")
+	linkType := flag.String("linktype", linkTypeSymlink, "The type of links to create for favorites and albums: "+strings.Join(linkTypes, ", ")+".  Symbolic links are relative, so the library can be moved.")
+	reportFilePath := flag.String("report", "", "The name of a file in which to write a JSON report of the outcome for each incoming file.")
 	flag.Parse()
 	if len(*libDir) <= 0 ||
 		len(*incomingDir) <= 0 ||
 		len(*rejectDir) <= 0 ||
-		(*dedupe != flagDedupeLazy && *dedupe != flagDedupeEager) {
+		*jobs < 1 ||
+		hashAlgorithms[*hashAlgorithm] == nil ||
+		*similarityThreshold < 0 ||
+		(*dedupe != flagDedupeLazy && *dedupe != flagDedupeEager && *dedupe != flagDedupePerceptual) {
 		flag.Usage()
 		os.Exit(2)
 	}
+	if !isDupeAction(*dupeAction) {
+		log.Fatalln("[FATAL]", "Invalid -dupeaction:", *dupeAction)
+	}
+	if !isArchivedRoute(*archivedRoute) {
+		log.Fatalln("[FATAL]", "Invalid -archived:", *archivedRoute)
+	}
+	if !isLinkType(*linkType) {
+		log.Fatalln("[FATAL]", "Invalid -linktype:", *linkType)
+	}
+	if !isDupePolicy(*dupePolicy) {
+		log.Fatalln("[FATAL]", "Invalid -dupepolicy:", *dupePolicy)
+	} else if *dupePolicy != dupePolicyKeepExisting && *dedupe != flagDedupePerceptual {
+		log.Fatalln("[FATAL]", "-dupepolicy requires -dedupe", flagDedupePerceptual, "since identical files are of the same quality")
+	}
+	location, err := time.LoadLocation(*timeZone)
+	if err != nil {
+		log.Fatalln("[FATAL]", "Invalid -tz:", err)
+	}
+	layout, err := NewLayout(*layoutTemplate)
+	if err != nil {
+		log.Fatalln("[FATAL]", "Invalid -layout:", err)
+	}
+	var timeZoneLookup *TimeZoneLookup
+	if *isGpsTimeZone {
+		timeZoneLookup, err = NewTimeZoneLookup()
+		if err != nil {
+			log.Fatalln("[FATAL]", "Failed to load time zone boundaries:", err)
+		}
+	}
+	filenameDateExtractor, err := NewFilenameDateExtractor(filenamePatterns)
+	if err != nil {
+		log.Fatalln("[FATAL]", "Invalid -filenamepattern:", err)
+	}
+	dateExtractorRegistry.Register(filenameDateExtractor)
+	dateExtractors, err := dateExtractorRegistry.Chain(*dateSources)
+	if err != nil {
+		log.Fatalln("[FATAL]", "Invalid -datesources:", err)
+	}
 
 	log.Println("[INFO]", "Sorting incoming pictures from", *incomingDir, "into library", *libDir)
 	log.Println("[INFO]", "Deduping set to", *dedupe)
+	log.Println("[INFO]", "Hashing with", *hashAlgorithm)
+	if *dedupe == flagDedupePerceptual {
+		log.Println("[INFO]", "Resolving similar images with policy", *dupePolicy)
+	}
+	if *isByteCompare {
+		log.Println("[INFO]", "Confirming duplicates byte by byte")
+	}
+	if *dupeAction != dupeActionMove {
+		log.Println("[INFO]", "Replacing duplicates with", *dupeAction+"s", "to library files")
+	}
 	log.Println("[INFO]", "Moving rejects to", *rejectDir)
+	log.Println("[INFO]", "Taking dates from", *dateSources)
+	log.Println("[INFO]", "Sorting into layout", *layoutTemplate)
+	log.Println("[INFO]", "Using", *jobs, "jobs")
+	log.Println("[INFO]", "Filing dates without a recorded offset in time zone", location.String())
+	if *isGpsTimeZone {
+		log.Println("[INFO]", "Preferring the time zone at the GPS coordinates")
+	}
 	if *isDryrun {
 		log.Println("[INFO]", "Dry run only")
 	}
 	if *matchLivePhotos {
 		log.Println("[INFO]", "Matching live photos")
 	}
+	if *isWritingXmp {
+		log.Println("[INFO]", "Writing Google metadata to XMP sidecars")
+	}
+	if *isEmbeddingExif {
+		log.Println("[INFO]", "Embedding EXIF in JPEG files without it")
+	}
+	if *archivedRoute != archivedRouteLibrary {
+		log.Println("[INFO]", "Routing archived files to", *archivedRoute)
+	}
+	if *isLinkingFavorites {
+		log.Println("[INFO]", "Linking favorites with", *linkType+"s")
+	}
+	if *isLinkingAlbums {
+		log.Println("[INFO]", "Linking albums with", *linkType+"s")
+	}
 
-	tempUndoScriptFilePath := *undoScriptFilePath + ".temp"
 	dedupeDir := filepath.Join(*rejectDir, dedupeSubDir)
-	trashedDir := filepath.Join(*rejectDir, trashedSubDir)
-	unsupportedDir := filepath.Join(*rejectDir, unsupportedSubDir)
+	sortDirs := SortDirs{
+		LibDir:         *libDir,
+		SimilarDir:     filepath.Join(*rejectDir, similarSubDir),
+		ReplacedDir:    filepath.Join(*rejectDir, replacedSubDir),
+		TrashedDir:     filepath.Join(*rejectDir, trashedSubDir),
+		UnsupportedDir: filepath.Join(*rejectDir, unsupportedSubDir),
+		ArchiveDir:     filepath.Join(*rejectDir, archiveSubDir),
+		OriginalsDir:   filepath.Join(*rejectDir, originalsSubDir),
+		ArchivedDir:    filepath.Join(*libDir, archivedSubDir),
+	}
+	if *archivedRoute == archivedRouteReject {
+		sortDirs.ArchivedDir = filepath.Join(*rejectDir, archivedSubDir)
+	}
+	if *isLinkingFavorites {
+		sortDirs.FavoritesDir = filepath.Join(*libDir, favoritesSubDir)
+	}
+	if *isLinkingAlbums {
+		sortDirs.AlbumsDir = filepath.Join(*libDir, albumsSubDir)
+	}
 
-	fileMover := NewFileMover(*isDryrun, tempUndoScriptFilePath)
-	fileIndex := NewFileIndex()
-	deduper := NewDeduper(fileIndex, dedupeDir, *incomingDir, fileMover)
-	sorter := NewPicSorter(*isDryrun, deduper, fileMover, *libDir, dedupeDir, trashedDir, unsupportedDir, *matchLivePhotos)
+	var journal *UndoJournal
+	if !*isDryrun {
+		journal = openUndoFile(*undoFilePath, *isUndoHashed)
+		defer journal.Close()
+	}
+	fileMover := NewFileMover(*isDryrun, journal)
+	hashCache := loadIndexFile(*indexFilePath, *libDir, *hashAlgorithm, *isDryrun)
+	fileIndex := NewFileIndex(*hashAlgorithm, hashCache, *isByteCompare, libraryLinkDirs(*libDir), *jobs)
+	var perceptualIndex *PerceptualIndex
+	if *dedupe == flagDedupePerceptual {
+		perceptualIndex = NewPerceptualIndex(*similarityThreshold, hashCache, libraryLinkDirs(*libDir), *jobs)
+	}
+	deduper := NewDeduper(fileIndex, perceptualIndex, *dupePolicy, *dupeAction, dedupeDir, fileMover)
+	report := NewSortReport()
+	sorter := NewPicSorter(deduper, fileMover, dateExtractors, layout, report, PicSorterConfig{
+		Dirs:            sortDirs,
+		IsDryRun:        *isDryrun,
+		ArchivedRoute:   *archivedRoute,
+		LinkType:        *linkType,
+		MatchLivePhotos: *matchLivePhotos,
+		IsWritingXmp:    *isWritingXmp,
+		IsEmbeddingExif: *isEmbeddingExif,
+		Location:        location,
+		TimeZoneLookup:  timeZoneLookup,
+		Jobs:            *jobs,
+	})
 
-	if *dedupe == flagDedupeEager {
+	if *dedupe == flagDedupeEager || *dedupe == flagDedupePerceptual {
 		fileIndex.BuildIndexForDirectory(*libDir)
 	}
-
-	if !*isDryrun {
-		initializeUndoFile(tempUndoScriptFilePath, *undoScriptFilePath)
+	if perceptualIndex != nil {
+		perceptualIndex.BuildIndexForDirectory(*libDir)
 	}
+
 	sortErr := sorter.Sort(*incomingDir)
-	var undoFileErr error
-	if !*isDryrun {
-		undoFileErr = writeUndoFile(tempUndoScriptFilePath, *undoScriptFilePath)
+	report.LogSummary()
+	if hashCache != nil {
+		if err := hashCache.Save(); err != nil {
+			log.Println("[WARN]", "Failed to save index file:", err)
+		}
+	}
+	if len(*reportFilePath) > 0 {
+		if err := report.WriteFile(*reportFilePath); err != nil {
+			log.Println("[WARN]", "Failed to write report file:", err)
+		}
 	}
 	if sortErr != nil {
 		log.Fatalln("[FATAL]", "Failed to sort incoming pictures in", *incomingDir, ":", sortErr)
 	}
 	if !*isDryrun {
-		if undoFileErr != nil {
-			log.Fatalln("[FATAL]", "Failed to write undo file:", undoFileErr)
-		} else {
-			log.Println("[INFO]", "To reinstate rejected files, execute", *undoScriptFilePath)
-		}
+		log.Println("[INFO]", "To reinstate rejected files, execute: picsort undo", *undoFilePath)
 	}
 }
 
-func initializeUndoFile(tempUndoFilePath string, undoFilePath string) {
-	os.Remove(tempUndoFilePath)
-	os.Chmod(undoFilePath, 0644)
-	os.Rename(undoFilePath, undoFilePath+"."+time.Now().Format(time.RFC3339))
-}
+// runUndo implements "picsort undo [-dryrun] <journal>".
+func runUndo(args []string) {
+	undoFlags := flag.NewFlagSet("undo", flag.ExitOnError)
+	isDryrun := undoFlags.Bool("dryrun", false, "Only list the operations that would be undone.")
+	undoFlags.Usage = func() {
+		fmt.Fprintln(undoFlags.Output(), "Usage: picsort undo [-dryrun] <journal>")
+		fmt.Fprintln(undoFlags.Output(), "Reverses the operations recorded in the journal, most recent first.  May be run again to resume.")
+		undoFlags.PrintDefaults()
+	}
+	undoFlags.Parse(args)
+	if undoFlags.NArg() != 1 {
+		undoFlags.Usage()
+		os.Exit(2)
+	}
+	undoFilePath := undoFlags.Arg(0)
+	if _, err := os.Stat(undoFilePath); err != nil {
+		log.Fatalln("[FATAL]", "Failed to read undo file:", err)
+	}
 
-func writeUndoFile(tempUndoFilePath string, undoFilePath string) error {
-	tempFile, err := os.Open(tempUndoFilePath)
+	journal, err := OpenUndoJournal(undoFilePath, false)
 	if err != nil {
-		return err
+		log.Fatalln("[FATAL]", "Failed to open undo file:", err)
 	}
-	defer tempFile.Close()
+	defer journal.Close()
+	if err := journal.Undo(*isDryrun); err != nil {
+		log.Fatalln("[FATAL]", "Failed to undo:", err)
+	}
+	log.Println("[INFO]", "Undo complete.")
+}
 
-	var lines []string
-	scanner := bufio.NewScanner(tempFile)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
+// openUndoFile opens a new journal, keeping that of a previous run.
+func openUndoFile(undoFilePath string, isMoveHashed bool) *UndoJournal {
+	rotateUndoFile(undoFilePath)
+	journal, err := OpenUndoJournal(undoFilePath, isMoveHashed)
+	if err != nil {
+		log.Fatalln("[FATAL]", "Failed to open undo file:", err)
 	}
+	return journal
+}
 
-	file, err := os.OpenFile(undoFilePath, os.O_WRONLY|os.O_CREATE, 0744)
+// loadIndexFile loads the hash cache for the library, unless disabled by an empty path.  A relative path is relative to the library.  The file is not written in a dry run.
+func loadIndexFile(indexFilePath string, libDir string, hashAlgorithm string, isDryRun bool) *HashCache {
+	if len(indexFilePath) <= 0 {
+		return nil
+	}
+	if !filepath.IsAbs(indexFilePath) {
+		indexFilePath = filepath.Join(libDir, indexFilePath)
+	}
+	hashCache, err := LoadHashCache(indexFilePath, libDir, hashAlgorithm, isDryRun)
 	if err != nil {
-		return err
+		log.Fatalln("[FATAL]", "Failed to load index file:", err)
 	}
-	w := bufio.NewWriter(file)
-	fmt.Fprintln(w, "#!/bin/sh")
-	lineCount := len(lines)
-	for i := lineCount - 1; i >= 0; i-- {
-		fmt.Fprintln(w, lines[i])
+	return hashCache
+}
+
+// rotateUndoFile keeps the journal of a previous run by renaming it with a timestamp.
+func rotateUndoFile(undoFilePath string) {
+	if _, err := os.Stat(undoFilePath); err == nil {
+		os.Rename(undoFilePath, undoFilePath+"."+time.Now().Format(time.RFC3339))
 	}
-	if err := w.Flush(); err != nil {
-		return err
+}
+
+// sortedHashAlgorithmNames lists the available hash algorithms for the usage message.
+func sortedHashAlgorithmNames() []string {
+	var names []string
+	for name := range hashAlgorithms {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
+}
+
+// stringListFlag is a flag that may be repeated to build a list.
+type stringListFlag []string
 
-	tempFile.Close()
-	os.Remove(tempUndoFilePath)
+func (list *stringListFlag) String() string {
+	return strings.Join(*list, ", ")
+}
 
+func (list *stringListFlag) Set(value string) error {
+	*list = append(*list, value)
 	return nil
 }
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// editedSuffix marks a copy edited in Google Photos (e.g. IMG_1234-edited.jpg), which shares the sidecar of the original.
+const editedSuffix = "-edited"
+
+// minTruncatedNameLength is the length of file names that Takeout may have truncated, since it limits them to 47 characters.
+const minTruncatedNameLength = 46
+
+// duplicateIndexRegex matches the index that Takeout appends to a name that occurs more than once in a folder, e.g. "(1)" in IMG_1234(1).jpg, and in its sidecar IMG_1234.jpg(1).json.
+var duplicateIndexRegex = regexp.MustCompile(`\((\d+)\)$`)
+
+// SidecarResolver finds the Google Photos JSON sidecar of each media file, by the "title" recorded in every sidecar in its directory, rather than by file name alone, since Takeout truncates long names and numbers repeated names inconsistently.
+type SidecarResolver struct {
+	matchLivePhotos bool
+	directories     map[string]sidecarDirectory // by directory path, listed by IndexDirectory or on first use
+	mutex           *sync.Mutex
+}
+
+// sidecarDirectory is the listing of a directory: its JSON files, and the names of all its files, to tell whether a name is repeated.
+type sidecarDirectory struct {
+	sidecars  []sidecar
+	fileNames []string
+}
+
+// sidecar is an indexed JSON file, with the title and duplicate index of the media file it describes.
+type sidecar struct {
+	path  string
+	title string // "" for JSON files without a title
+	index int    // 0 unless the name includes a duplicate index, e.g. 1 for IMG_1234.jpg(1).json
+}
+
+// NewSidecarResolver creates a SidecarResolver, matching videos to the sidecars of their live photos (e.g. IMG_7299.MP4 to the sidecar titled IMG_7299.HEIC) if specified.
+func NewSidecarResolver(matchLivePhotos bool) *SidecarResolver {
+	result := new(SidecarResolver)
+	result.matchLivePhotos = matchLivePhotos
+	result.directories = make(map[string]sidecarDirectory)
+	result.mutex = new(sync.Mutex)
+	return result
+}
+
+// IndexDirectory recursively lists the directories within the specified directory, so that sidecars are resolved from the files as they were before any were moved, regardless of the order in which they are resolved.
+func (resolver SidecarResolver) IndexDirectory(dirPath string) error {
+	return filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			resolver.directoryOf(path)
+		}
+		return nil
+	})
+}
+
+// AddFile adds the specified file to the listing of its directory, e.g. a file that is yet to be extracted from an archive.
+func (resolver SidecarResolver) AddFile(filePath string) {
+	dirPath := filepath.Dir(filePath)
+	resolver.directoryOf(dirPath)
+	resolver.mutex.Lock()
+	defer resolver.mutex.Unlock()
+	directory := resolver.directories[dirPath]
+	directory.fileNames = append(directory.fileNames, filepath.Base(filePath))
+	resolver.directories[dirPath] = directory
+}
+
+// Resolve returns the path of the sidecar of the specified media file, or "" if there is none, or more than one candidate.  Sidecars are matched by title, allowing for truncation, "-edited" copies, and the duplicate index; sidecars without a title are matched by file name.
+func (resolver SidecarResolver) Resolve(picFilePath string) string {
+	directory := resolver.directoryOf(filepath.Dir(picFilePath))
+	sidecars := directory.sidecars
+	fileName := filepath.Base(picFilePath)
+	name, index := parseMediaName(fileName)
+	isTruncated := utf8.RuneCountInString(fileName) >= minTruncatedNameLength
+
+	// A name such as "Party (2).jpg" may well be the title itself, rather than a duplicate.
+	uneditedFileName := strings.TrimSuffix(strings.TrimSuffix(fileName, filepath.Ext(fileName)), editedSuffix) + filepath.Ext(fileName)
+	candidates := findSidecars(sidecars, 0, func(title string) bool {
+		return title == uneditedFileName
+	})
+	if len(candidates) == 0 && index > 0 {
+		candidates = findSidecars(sidecars, index, func(title string) bool {
+			return title == name
+		})
+	}
+	if len(candidates) == 0 && isTruncated {
+		candidates = findSidecars(sidecars, index, func(title string) bool {
+			return isTruncationOf(name, title)
+		})
+	}
+	if len(candidates) == 0 && resolver.matchLivePhotos {
+		stem := strings.TrimSuffix(name, filepath.Ext(name))
+		candidates = findSidecars(sidecars, index, func(title string) bool {
+			return strings.EqualFold(filepath.Ext(title), ".heic") && strings.TrimSuffix(title, filepath.Ext(title)) == stem
+		})
+	}
+	if len(candidates) == 1 {
+		log.Println("[DEBUG] Matched sidecar", candidates[0], "to", picFilePath, "by title")
+		return candidates[0]
+	} else if len(candidates) > 1 {
+		log.Println("[WARN] Skipping Google metadata for", picFilePath, "because it matches several sidecars:", strings.Join(candidates, ", "))
+		return ""
+	}
+	return resolver.resolveByFileName(picFilePath, directory)
+}
+
+// resolveByFileName matches the sidecars without a title by the original naming convention, <picname>.json, so long as no name in the directory indicates ambiguity.
+func (resolver SidecarResolver) resolveByFileName(picFilePath string, directory sidecarDirectory) string {
+	untitledPaths := make(map[string]bool)
+	for _, sidecar := range directory.sidecars {
+		if len(sidecar.title) == 0 {
+			untitledPaths[sidecar.path] = true
+		}
+	}
+	if len(untitledPaths) == 0 {
+		return ""
+	}
+	metadataFilePaths := getMetadataFilenames(picFilePath, resolver.matchLivePhotos)
+	if !isMetadataUnamgibuous(picFilePath, metadataFilePaths, directory.fileNames) {
+		log.Println("[WARN] Skipping Google metadata for", picFilePath, "because it could not be matched to the file with full confidence.")
+		return ""
+	}
+	for _, metadataFilePath := range metadataFilePaths {
+		if untitledPaths[metadataFilePath] {
+			return metadataFilePath
+		}
+	}
+	return ""
+}
+
+// directoryOf returns the listing of the specified directory, reading the titles of its sidecars the first time.
+func (resolver SidecarResolver) directoryOf(dirPath string) sidecarDirectory {
+	resolver.mutex.Lock()
+	defer resolver.mutex.Unlock()
+	if directory, isPresent := resolver.directories[dirPath]; isPresent {
+		return directory
+	}
+	var directory sidecarDirectory
+	entries, err := ioutil.ReadDir(dirPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("[WARN] Failed to list sidecars in", dirPath, ":", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		directory.fileNames = append(directory.fileNames, entry.Name())
+		if !strings.EqualFold(filepath.Ext(entry.Name()), ".json") {
+			continue
+		}
+		sidecarPath := filepath.Join(dirPath, entry.Name())
+		directory.sidecars = append(directory.sidecars, sidecar{path: sidecarPath, title: readSidecarTitle(sidecarPath), index: parseSidecarIndex(entry.Name())})
+	}
+	resolver.directories[dirPath] = directory
+	return directory
+}
+
+// findSidecars returns the paths of the sidecars with the given duplicate index whose titles match.
+func findSidecars(sidecars []sidecar, index int, isMatch func(title string) bool) []string {
+	var result []string
+	for _, sidecar := range sidecars {
+		if len(sidecar.title) > 0 && sidecar.index == index && isMatch(sidecar.title) {
+			result = append(result, sidecar.path)
+		}
+	}
+	return result
+}
+
+func readSidecarTitle(sidecarPath string) string {
+	content, err := ioutil.ReadFile(sidecarPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("[WARN] Failed to read sidecar", sidecarPath, ":", err)
+		}
+		return ""
+	}
+	var titled struct {
+		Title string `json:"title"`
+	}
+	if err := json.Unmarshal(content, &titled); err != nil {
+		log.Println("[DEBUG] Ignoring title of malformed sidecar", sidecarPath, ":", err)
+		return ""
+	}
+	return titled.Title
+}
+
+// parseMediaName returns the name of the original media file that the given file name is a copy of, without "-edited", and its duplicate index, e.g. "IMG_1234.jpg" and 1 for IMG_1234(1)-edited.jpg.
+func parseMediaName(fileName string) (string, int) {
+	ext := filepath.Ext(fileName)
+	stem := strings.TrimSuffix(strings.TrimSuffix(fileName, ext), editedSuffix)
+	index := 0
+	if match := duplicateIndexRegex.FindStringSubmatchIndex(stem); match != nil {
+		index, _ = strconv.Atoi(stem[match[2]:match[3]])
+		stem = stem[:match[0]]
+	}
+	return stem + ext, index
+}
+
+// parseSidecarIndex returns the duplicate index of the given sidecar name, e.g. 1 for IMG_1234.jpg(1).json.
+func parseSidecarIndex(fileName string) int {
+	stem := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	if match := duplicateIndexRegex.FindStringSubmatch(stem); match != nil {
+		index, _ := strconv.Atoi(match[1])
+		return index
+	}
+	return 0
+}
+
+// isTruncationOf determines whether the given name could be the title truncated by Takeout, keeping the extension.
+func isTruncationOf(name string, title string) bool {
+	if len(name) >= len(title) {
+		return false
+	}
+	ext := filepath.Ext(name)
+	if !strings.EqualFold(ext, filepath.Ext(title)) {
+		return false
+	}
+	return strings.HasPrefix(title, strings.TrimSuffix(name, ext))
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// longTitle is a media name long enough for Takeout to truncate, to truncatedName.
+const longTitle = "Holiday in the mountains with the whole family 2019.jpg"
+
+var truncatedName = longTitle[:43] + ".jpg"
+
+// titled returns the content of a sidecar with the given title.
+func titled(title string) string {
+	return `{"title": "` + title + `"}`
+}
+
+func TestParseMediaName(t *testing.T) {
+	tests := []struct {
+		fileName string
+		name     string
+		index    int
+	}{
+		{"IMG_1234.jpg", "IMG_1234.jpg", 0},
+		{"IMG_1234(1).jpg", "IMG_1234.jpg", 1},
+		{"IMG_1234-edited.jpg", "IMG_1234.jpg", 0},
+		{"IMG_1234(12)-edited.jpg", "IMG_1234.jpg", 12},
+		{"Party (2).jpg", "Party .jpg", 2},
+		{"IMG_1234(a).jpg", "IMG_1234(a).jpg", 0},
+		{"no extension(3)", "no extension", 3},
+	}
+	for _, test := range tests {
+		if name, index := parseMediaName(test.fileName); name != test.name || index != test.index {
+			t.Errorf("parseMediaName(%q) = %q, %d, expected %q, %d", test.fileName, name, index, test.name, test.index)
+		}
+	}
+}
+
+func TestParseSidecarIndex(t *testing.T) {
+	tests := map[string]int{
+		"IMG_1234.jpg.json":                       0,
+		"IMG_1234.jpg(1).json":                    1,
+		"IMG_1234.jpg(10).json":                   10,
+		"IMG_1234(1).jpg.json":                    0,
+		"Party (2).jpg.json":                      0,
+		"IMG_1234.jpg.supplemental-metadata.json": 0,
+	}
+	for fileName, expected := range tests {
+		if index := parseSidecarIndex(fileName); index != expected {
+			t.Errorf("parseSidecarIndex(%q) = %d, expected %d", fileName, index, expected)
+		}
+	}
+}
+
+func TestIsTruncationOf(t *testing.T) {
+	tests := []struct {
+		name     string
+		title    string
+		expected bool
+	}{
+		{truncatedName, longTitle, true},
+		{longTitle[:43] + ".JPG", longTitle, true},
+		{longTitle, longTitle, false},
+		{longTitle[:43] + ".png", longTitle, false},
+		{"Holiday in the hills" + longTitle[20:43] + ".jpg", longTitle, false},
+		{longTitle, truncatedName, false},
+	}
+	for _, test := range tests {
+		if actual := isTruncationOf(test.name, test.title); actual != test.expected {
+			t.Errorf("isTruncationOf(%q, %q) = %v, expected %v", test.name, test.title, actual, test.expected)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		name            string
+		files           map[string]string // by file name; sidecars hold JSON
+		matchLivePhotos bool
+		picFileName     string
+		expected        string // "" for no sidecar
+	}{
+		{
+			name:        "title",
+			files:       map[string]string{"IMG_1234.jpg": "", "IMG_1234.jpg.supplemental-metadata.json": titled("IMG_1234.jpg")},
+			picFileName: "IMG_1234.jpg",
+			expected:    "IMG_1234.jpg.supplemental-metadata.json",
+		},
+		{
+			name:        "title of truncated name",
+			files:       map[string]string{truncatedName: "", longTitle[:46] + ".json": titled(longTitle)},
+			picFileName: truncatedName,
+			expected:    longTitle[:46] + ".json",
+		},
+		{
+			name:        "short name is not truncated",
+			files:       map[string]string{"IMG_12.jpg": "", "IMG_1234.jpg.json": titled("IMG_1234.jpg")},
+			picFileName: "IMG_12.jpg",
+			expected:    "",
+		},
+		{
+			name:        "duplicate index after the extension of the sidecar",
+			files:       map[string]string{"IMG_1234.jpg": "", "IMG_1234(1).jpg": "", "IMG_1234.jpg.json": titled("IMG_1234.jpg"), "IMG_1234.jpg(1).json": titled("IMG_1234.jpg")},
+			picFileName: "IMG_1234(1).jpg",
+			expected:    "IMG_1234.jpg(1).json",
+		},
+		{
+			name:        "original of a duplicated name",
+			files:       map[string]string{"IMG_1234.jpg": "", "IMG_1234(1).jpg": "", "IMG_1234.jpg.json": titled("IMG_1234.jpg"), "IMG_1234.jpg(1).json": titled("IMG_1234.jpg")},
+			picFileName: "IMG_1234.jpg",
+			expected:    "IMG_1234.jpg.json",
+		},
+		{
+			name:        "edited copy",
+			files:       map[string]string{"IMG_1234.jpg": "", "IMG_1234-edited.jpg": "", "IMG_1234.jpg.json": titled("IMG_1234.jpg")},
+			picFileName: "IMG_1234-edited.jpg",
+			expected:    "IMG_1234.jpg.json",
+		},
+		{
+			name:        "edited copy of a duplicated name",
+			files:       map[string]string{"IMG_1234(1)-edited.jpg": "", "IMG_1234.jpg.json": titled("IMG_1234.jpg"), "IMG_1234.jpg(1).json": titled("IMG_1234.jpg")},
+			picFileName: "IMG_1234(1)-edited.jpg",
+			expected:    "IMG_1234.jpg(1).json",
+		},
+		{
+			name:        "title that looks like a duplicate index",
+			files:       map[string]string{"Party (2).jpg": "", "Party (2).jpg.json": titled("Party (2).jpg"), "Party .jpg(2).json": titled("Party .jpg")},
+			picFileName: "Party (2).jpg",
+			expected:    "Party (2).jpg.json",
+		},
+		{
+			name:        "several sidecars with the same title",
+			files:       map[string]string{"IMG_1234.jpg": "", "IMG_1234.jpg.json": titled("IMG_1234.jpg"), "IMG_1234.jpg.supplemental-metadata.json": titled("IMG_1234.jpg")},
+			picFileName: "IMG_1234.jpg",
+			expected:    "",
+		},
+		{
+			name:            "live photo video",
+			files:           map[string]string{"IMG_7299.HEIC": "", "IMG_7299.MP4": "", "IMG_7299.HEIC.json": titled("IMG_7299.HEIC")},
+			matchLivePhotos: true,
+			picFileName:     "IMG_7299.MP4",
+			expected:        "IMG_7299.HEIC.json",
+		},
+		{
+			name:        "live photo video not matched",
+			files:       map[string]string{"IMG_7299.HEIC": "", "IMG_7299.MP4": "", "IMG_7299.HEIC.json": titled("IMG_7299.HEIC")},
+			picFileName: "IMG_7299.MP4",
+			expected:    "",
+		},
+		{
+			name:        "untitled sidecar by file name",
+			files:       map[string]string{"IMG_1234.jpg": "", "IMG_1234.jpg.json": "{}"},
+			picFileName: "IMG_1234.jpg",
+			expected:    "IMG_1234.jpg.json",
+		},
+		{
+			name:        "untitled sidecar of a duplicated name",
+			files:       map[string]string{"IMG_1234.jpg": "", "IMG_1234(1).jpg": "", "IMG_1234.jpg.json": "{}"},
+			picFileName: "IMG_1234.jpg",
+			expected:    "",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dirPath := t.TempDir()
+			for fileName, content := range test.files {
+				writeTestFile(t, filepath.Join(dirPath, fileName), content)
+			}
+			expected := ""
+			if len(test.expected) > 0 {
+				expected = filepath.Join(dirPath, test.expected)
+			}
+			resolver := NewSidecarResolver(test.matchLivePhotos)
+			if sidecarPath := resolver.Resolve(filepath.Join(dirPath, test.picFileName)); sidecarPath != expected {
+				t.Errorf("Resolve(%q) = %q, expected %q", test.picFileName, sidecarPath, expected)
+			}
+		})
+	}
+}
+
+// TestResolveUsesListingBeforeMoves checks that a sidecar matched by file name is resolved from the files listed by IndexDirectory, whether or not other files have since been moved out of the directory.
+func TestResolveUsesListingBeforeMoves(t *testing.T) {
+	dirPath := t.TempDir()
+	writeTestFile(t, filepath.Join(dirPath, "fileA.jpg"), "photo")
+	writeTestFile(t, filepath.Join(dirPath, "fileA(1).jpg"), "other photo")
+	writeTestFile(t, filepath.Join(dirPath, "fileA.jpg.json"), "{}")
+	writeTestFile(t, filepath.Join(dirPath, "fileB.jpg"), "photo")
+	writeTestFile(t, filepath.Join(dirPath, "fileB.jpg.json"), "{}")
+	resolver := NewSidecarResolver(false)
+	if err := resolver.IndexDirectory(dirPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// As if sorted already, which must not make fileA's sidecar unambiguous.
+	if err := os.Remove(filepath.Join(dirPath, "fileA(1).jpg")); err != nil {
+		t.Fatal(err)
+	}
+	// As if extracted or moved in later, which must not make fileB's sidecar ambiguous.
+	writeTestFile(t, filepath.Join(dirPath, "fileB(1).jpg"), "other photo")
+
+	if sidecarPath := resolver.Resolve(filepath.Join(dirPath, "fileA.jpg")); sidecarPath != "" {
+		t.Errorf("Resolve(fileA.jpg) = %q, expected none since fileA(1).jpg made it ambiguous", sidecarPath)
+	}
+	if sidecarPath := resolver.Resolve(filepath.Join(dirPath, "fileB.jpg")); sidecarPath != filepath.Join(dirPath, "fileB.jpg.json") {
+		t.Errorf("Resolve(fileB.jpg) = %q, expected fileB.jpg.json", sidecarPath)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"sort"
+)
+
+// Outcomes of sorting an incoming file.
+const (
+	outcomeSorted      = "sorted"
+	outcomeDuplicate   = "duplicate"
+	outcomeSimilar     = "similar"
+	outcomeTrashed     = "trashed"
+	outcomeArchived    = "archived" // moved to the rejects as archived in Google Photos
+	outcomeUnsupported = "unsupported"
+	outcomeExtracted   = "extracted" // an archive, whose files are sorted in turn
+	outcomeFailed      = "failed"
+)
+
+// SortReport records the outcome of each incoming file, for the summary and the optional report file.
+type SortReport struct {
+	Entries []SortReportEntry
+}
+
+// SortReportEntry records the outcome for a single incoming file.
+type SortReportEntry struct {
+	Path        string `json:"path"`
+	Outcome     string `json:"outcome"`
+	Destination string `json:"destination,omitempty"`
+	Kept        string `json:"kept,omitempty"` // the library file kept instead of a duplicate or similar file
+	DateSource  string `json:"dateSource,omitempty"`
+	Detail      string `json:"detail,omitempty"`
+}
+
+// NewSortReport creates an empty SortReport.
+func NewSortReport() *SortReport {
+	return new(SortReport)
+}
+
+// Add records the outcome for the given file.
+func (report *SortReport) Add(entry SortReportEntry) {
+	report.Entries = append(report.Entries, entry)
+}
+
+// EntriesByPath returns the entry of each file recorded so far, by path.
+func (report *SortReport) EntriesByPath() map[string]SortReportEntry {
+	result := make(map[string]SortReportEntry)
+	for _, entry := range report.Entries {
+		result[entry.Path] = entry
+	}
+	return result
+}
+
+// LogSummary logs the number of files per outcome and per date source.
+func (report *SortReport) LogSummary() {
+	outcomeCounts := make(map[string]int)
+	dateSourceCounts := make(map[string]int)
+	for _, entry := range report.Entries {
+		outcomeCounts[entry.Outcome]++
+		if entry.DateSource != "" {
+			dateSourceCounts[entry.DateSource]++
+		}
+	}
+	log.Println("[INFO]", "Processed", len(report.Entries), "incoming files.")
+	for _, outcome := range sortedKeys(outcomeCounts) {
+		log.Println("[INFO]", "  ", outcome+":", outcomeCounts[outcome])
+	}
+	for _, dateSource := range sortedKeys(dateSourceCounts) {
+		log.Println("[INFO]", "  ", "dated by "+dateSource+":", dateSourceCounts[dateSource])
+	}
+}
+
+// WriteFile writes the report as JSON to the given file.
+func (report *SortReport) WriteFile(filePath string) error {
+	content, err := json.MarshalIndent(report.Entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filePath, content, 0644)
+}
+
+func sortedKeys(counts map[string]int) []string {
+	var result []string
+	for key := range counts {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ringsaturn/tzf"
+)
+
+// TimeZoneLookup determines the time zone at a coordinate, offline, from the time zone boundaries embedded by tzf (simplified from timezone-boundary-builder).
+type TimeZoneLookup struct {
+	finder    tzf.F
+	locations map[string]*time.Location
+	mutex     *sync.Mutex
+}
+
+// NewTimeZoneLookup creates a TimeZoneLookup, loading the embedded boundaries.
+func NewTimeZoneLookup() (*TimeZoneLookup, error) {
+	finder, err := tzf.NewDefaultFinder()
+	if err != nil {
+		return nil, err
+	}
+	result := new(TimeZoneLookup)
+	result.finder = finder
+	result.locations = make(map[string]*time.Location)
+	result.mutex = new(sync.Mutex)
+	return result, nil
+}
+
+// Lookup returns the time zone at the given coordinate.  Where no zone is found, e.g. at sea outside the boundaries, the nominal zone for the longitude is used.
+func (lookup TimeZoneLookup) Lookup(latitude float64, longitude float64) (*time.Location, error) {
+	if math.IsNaN(latitude) || math.IsNaN(longitude) || math.Abs(latitude) > 90 || math.Abs(longitude) > 180 {
+		return nil, errors.New("invalid coordinate")
+	}
+	zoneName := lookup.finder.GetTimezoneName(longitude, latitude)
+	if len(zoneName) == 0 {
+		zoneName = nominalTimeZoneName(longitude)
+	}
+	return lookup.loadLocation(zoneName)
+}
+
+func (lookup TimeZoneLookup) loadLocation(zoneName string) (*time.Location, error) {
+	lookup.mutex.Lock()
+	defer lookup.mutex.Unlock()
+	if location, isPresent := lookup.locations[zoneName]; isPresent {
+		return location, nil
+	}
+	location, err := time.LoadLocation(zoneName)
+	if err != nil {
+		return nil, err
+	}
+	lookup.locations[zoneName] = location
+	return location, nil
+}
+
+// nominalTimeZoneName returns the "Etc" zone for the longitude (15 degrees per hour).  Note the inverted sign of the "Etc" zones.
+func nominalTimeZoneName(longitude float64) string {
+	offsetHours := int(math.Round(longitude / 15))
+	switch {
+	case offsetHours > 0:
+		return "Etc/GMT-" + strconv.Itoa(offsetHours)
+	case offsetHours < 0:
+		return "Etc/GMT+" + strconv.Itoa(-offsetHours)
+	}
+	return "Etc/GMT"
+}
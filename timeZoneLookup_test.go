@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestTimeZoneLookup(t *testing.T) {
+	lookup, err := NewTimeZoneLookup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		latitude  float64
+		longitude float64
+		expected  string
+	}{
+		{"El Paso, near Ciudad Juárez", 31.7619, -106.4850, "America/Denver"},
+		{"Ciudad Juárez, near El Paso", 31.6904, -106.4245, "America/Ciudad_Juarez"},
+		{"Detroit, near Windsor", 42.3314, -83.0458, "America/Detroit"},
+		{"Windsor, near Detroit", 42.3149, -83.0364, "America/Toronto"},
+		{"Kehl, near Strasbourg", 48.5722, 7.8156, "Europe/Berlin"},
+		{"Strasbourg, near Kehl", 48.5734, 7.7521, "Europe/Paris"},
+		{"Mid-Pacific", 0, -160, "Etc/GMT+11"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			location, err := lookup.Lookup(test.latitude, test.longitude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if location.String() != test.expected {
+				t.Errorf("Lookup = %s, expected %s", location, test.expected)
+			}
+		})
+	}
+	for _, coordinate := range [][2]float64{{91, 0}, {0, 181}} {
+		if _, err := lookup.Lookup(coordinate[0], coordinate[1]); err == nil {
+			t.Errorf("Lookup(%v) expected an error", coordinate)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Operations recorded in the undo journal.
+const (
+	journalOpMove       = "move"       // file moved from Source to Dest
+	journalOpLink       = "link"       // file Dest replaced by a link to the identical file Source
+	journalOpCreate     = "create"     // file Dest created (e.g. extracted from an archive)
+	journalOpCreateLink = "createlink" // symbolic or hard link Dest to the file Source created (e.g. in a favorites folder)
+	journalOpMkdir      = "mkdir"      // directory Dest created
+	journalOpRmdir      = "rmdir"      // empty directory Source deleted
+	journalOpUndone     = "undone"     // operation UndoneSeq reversed by "picsort undo"
+)
+
+// JournalEntry is one line of the undo journal.  Paths are absolute.
+type JournalEntry struct {
+	Seq       int    `json:"seq"`
+	Time      string `json:"time"`
+	Op        string `json:"op"`
+	Source    string `json:"source,omitempty"`
+	Dest      string `json:"dest,omitempty"`
+	Sha256    string `json:"sha256,omitempty"`
+	Size      int64  `json:"size,omitempty"`  // size of a moved file, if not hashed
+	Mode      uint32 `json:"mode,omitempty"`  // permissions of a file replaced by a link
+	ModTime   int64  `json:"mtime,omitempty"` // modification time (Unix nanoseconds) of a moved file if not hashed, or of a file replaced by a link
+	UndoneSeq int    `json:"undoneSeq,omitempty"`
+}
+
+// UndoJournal is an append-only journal of file operations, written as JSON lines, from which the operations can be reversed.
+type UndoJournal struct {
+	filePath     string
+	file         *os.File
+	isMoveHashed bool
+	nextSeq      int
+	mutex        *sync.Mutex
+}
+
+// OpenUndoJournal opens the given journal for appending, creating it if needed.  Moves are recorded with the checksum of the file moved if isMoveHashed, otherwise with its size and modification time only.
+func OpenUndoJournal(filePath string, isMoveHashed bool) (*UndoJournal, error) {
+	entries, err := ReadUndoJournal(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	result := new(UndoJournal)
+	result.filePath = filePath
+	result.file = file
+	result.isMoveHashed = isMoveHashed
+	result.nextSeq = 1
+	for _, entry := range entries {
+		if entry.Seq >= result.nextSeq {
+			result.nextSeq = entry.Seq + 1
+		}
+	}
+	result.mutex = new(sync.Mutex)
+	return result, nil
+}
+
+// ReadUndoJournal reads all entries of the given journal.  A truncated last line (e.g. from a crash) is ignored.
+func ReadUndoJournal(filePath string) ([]JournalEntry, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Println("[WARN]", "Ignoring malformed journal line", lineNumber, "in", filePath, ":", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// Close closes the journal file.
+func (journal *UndoJournal) Close() error {
+	return journal.file.Close()
+}
+
+// RecordMove records that the file at sourcePath is about to be moved to destPath, along with its checksum for verification during undo.  If moves aren't hashed, its size and modification time are recorded instead, so that the content isn't read and a move within a filesystem remains a rename.
+func (journal *UndoJournal) RecordMove(sourcePath string, destPath string) error {
+	if journal.isMoveHashed {
+		hash, err := hashFileSha256(sourcePath)
+		if err != nil {
+			return err
+		}
+		return journal.append(JournalEntry{Op: journalOpMove, Source: sourcePath, Dest: destPath, Sha256: hex.EncodeToString(hash)})
+	}
+	fileInfo, err := os.Stat(sourcePath)
+	if err != nil {
+		return err
+	}
+	return journal.append(JournalEntry{Op: journalOpMove, Source: sourcePath, Dest: destPath, Size: fileInfo.Size(), ModTime: fileInfo.ModTime().UnixNano()})
+}
+
+// RecordLink records that the file at filePath is about to be replaced by a link to the identical file at targetPath, along with its checksum, permissions, and modification time, so that undo can restore it as a copy.
+func (journal *UndoJournal) RecordLink(filePath string, targetPath string) error {
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	hash, err := hashFileSha256(filePath)
+	if err != nil {
+		return err
+	}
+	return journal.append(JournalEntry{Op: journalOpLink, Source: targetPath, Dest: filePath, Sha256: hex.EncodeToString(hash), Mode: uint32(fileInfo.Mode().Perm()), ModTime: fileInfo.ModTime().UnixNano()})
+}
+
+// RecordCreate records that the file at filePath, with the given checksum, is about to be created, so that undo can delete it.
+func (journal *UndoJournal) RecordCreate(filePath string, sha256 []byte) error {
+	return journal.append(JournalEntry{Op: journalOpCreate, Dest: filePath, Sha256: hex.EncodeToString(sha256)})
+}
+
+// RecordCreateLink records that a symbolic or hard link to targetPath is about to be created at linkPath, so that undo can delete it.
+func (journal *UndoJournal) RecordCreateLink(linkPath string, targetPath string) error {
+	return journal.append(JournalEntry{Op: journalOpCreateLink, Source: targetPath, Dest: linkPath})
+}
+
+// RecordMkdir records that the directory dirPath was created.
+func (journal *UndoJournal) RecordMkdir(dirPath string) error {
+	return journal.append(JournalEntry{Op: journalOpMkdir, Dest: dirPath})
+}
+
+// RecordRmdir records that the empty directory dirPath was deleted.
+func (journal *UndoJournal) RecordRmdir(dirPath string) error {
+	return journal.append(JournalEntry{Op: journalOpRmdir, Source: dirPath})
+}
+
+func (journal *UndoJournal) recordUndone(seq int) error {
+	return journal.append(JournalEntry{Op: journalOpUndone, UndoneSeq: seq})
+}
+
+func (journal *UndoJournal) append(entry JournalEntry) error {
+	var err error
+	if entry.Source, err = absPathIfSet(entry.Source); err != nil {
+		return err
+	}
+	if entry.Dest, err = absPathIfSet(entry.Dest); err != nil {
+		return err
+	}
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	entry.Seq = journal.nextSeq
+	entry.Time = time.Now().Format(time.RFC3339)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := journal.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	// Each entry must be durable before the operation it describes is performed.
+	if err := journal.file.Sync(); err != nil {
+		return err
+	}
+	journal.nextSeq++
+	return nil
+}
+
+func absPathIfSet(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	return filepath.Abs(path)
+}
+
+// Undo reverses the journaled operations, most recent first.  Operations that were already undone are skipped, so an interrupted undo can be resumed.  Moves are only reversed if the file is unchanged, by its checksum or, if not hashed, by its size and modification time.
+func (journal *UndoJournal) Undo(isDryRun bool) error {
+	entries, err := ReadUndoJournal(journal.filePath)
+	if err != nil {
+		return err
+	}
+	undoneSeqs := make(map[int]bool)
+	for _, entry := range entries {
+		if entry.Op == journalOpUndone {
+			undoneSeqs[entry.UndoneSeq] = true
+		}
+	}
+
+	failureCount := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.Op == journalOpUndone || undoneSeqs[entry.Seq] {
+			continue
+		}
+		if isDryRun {
+			log.Println("[INFO]", "Dryrun undoing", describeJournalEntry(entry))
+			continue
+		}
+		log.Println("[INFO]", "Undoing", describeJournalEntry(entry))
+		if err := undoJournalEntry(entry); err != nil {
+			log.Println("[WARN]", "Failed to undo", describeJournalEntry(entry), ":", err)
+			failureCount++
+			continue
+		}
+		if err := journal.recordUndone(entry.Seq); err != nil {
+			return err
+		}
+	}
+	if failureCount > 0 {
+		return errors.New(strconv.Itoa(failureCount) + " operations could not be undone; resolve them and run undo again")
+	}
+	return nil
+}
+
+func undoJournalEntry(entry JournalEntry) error {
+	switch entry.Op {
+	case journalOpMove:
+		return undoMove(entry)
+	case journalOpLink:
+		return undoLink(entry.Dest, entry.Sha256, os.FileMode(entry.Mode), time.Unix(0, entry.ModTime))
+	case journalOpCreate:
+		return undoCreate(entry.Dest, entry.Sha256)
+	case journalOpCreateLink:
+		return undoCreateLink(entry.Dest, entry.Source)
+	case journalOpMkdir:
+		err := os.Remove(entry.Dest)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	case journalOpRmdir:
+		return os.MkdirAll(entry.Source, os.ModePerm)
+	}
+	return errors.New("unknown journal operation '" + entry.Op + "'")
+}
+
+// undoMove moves the file at entry.Dest back to entry.Source, if it's unchanged: by its checksum if recorded, otherwise by its size and modification time.
+func undoMove(entry JournalEntry) error {
+	currentPath, originalPath := entry.Dest, entry.Source
+	currentInfo, err := os.Lstat(currentPath)
+	if os.IsNotExist(err) {
+		if _, err := os.Lstat(originalPath); err == nil {
+			// The move never happened (e.g. interrupted or failed).
+			return nil
+		}
+		return fmt.Errorf("%s is missing", currentPath)
+	} else if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(originalPath); !os.IsNotExist(err) {
+		return fmt.Errorf("%s already exists", originalPath)
+	}
+	if entry.Sha256 != "" {
+		hash, err := hashFileSha256(currentPath)
+		if err != nil {
+			return err
+		}
+		if hex.EncodeToString(hash) != entry.Sha256 {
+			return fmt.Errorf("%s has changed since it was moved", currentPath)
+		}
+	} else if entry.ModTime != 0 && !isUnchangedSinceMove(currentInfo, entry.Size, time.Unix(0, entry.ModTime)) {
+		return fmt.Errorf("%s has changed since it was moved", currentPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(originalPath), os.ModePerm); err != nil {
+		return err
+	}
+	return moveFile(currentPath, originalPath)
+}
+
+// isUnchangedSinceMove compares the file with the size and modification time recorded before it was moved.  A move preserves the modification time, but a filesystem may store it coarsely (e.g. FAT, to 2 seconds).
+func isUnchangedSinceMove(fileInfo os.FileInfo, size int64, modTime time.Time) bool {
+	difference := fileInfo.ModTime().Sub(modTime)
+	return fileInfo.Size() == size && difference > -2*time.Second && difference < 2*time.Second
+}
+
+// undoLink replaces the link at filePath with an independent copy of its content, if it's unchanged, restoring the permissions and modification time of the file it replaced.
+func undoLink(filePath string, expectedSha256 string, mode os.FileMode, modTime time.Time) error {
+	hash, err := hashFileSha256(filePath)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(hash) != expectedSha256 {
+		return fmt.Errorf("%s has changed since it was linked", filePath)
+	}
+	copyFilePath := filePath + ".picsort-unlink"
+	if err := copyFileVerified(filePath, copyFilePath); err != nil {
+		return err
+	}
+	if err := os.Chmod(copyFilePath, mode); err != nil {
+		os.Remove(copyFilePath)
+		return err
+	}
+	if err := os.Chtimes(copyFilePath, modTime, modTime); err != nil {
+		os.Remove(copyFilePath)
+		return err
+	}
+	return os.Rename(copyFilePath, filePath)
+}
+
+// undoCreate deletes the created file at filePath, if it's unchanged.
+func undoCreate(filePath string, expectedSha256 string) error {
+	hash, err := hashFileSha256(filePath)
+	if os.IsNotExist(err) {
+		// The file was never created, or was already deleted.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if hex.EncodeToString(hash) != expectedSha256 {
+		return fmt.Errorf("%s has changed since it was created", filePath)
+	}
+	return os.Remove(filePath)
+}
+
+// undoCreateLink deletes the link at linkPath, if it still links to targetPath.
+func undoCreateLink(linkPath string, targetPath string) error {
+	linkInfo, err := os.Lstat(linkPath)
+	if os.IsNotExist(err) {
+		// The link was never created, or was already deleted.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if linkInfo.Mode()&os.ModeSymlink != 0 {
+		linkTarget, err := os.Readlink(linkPath)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(linkTarget) {
+			linkTarget = filepath.Join(filepath.Dir(linkPath), linkTarget)
+		}
+		if filepath.Clean(linkTarget) != filepath.Clean(targetPath) {
+			return fmt.Errorf("%s no longer links to %s", linkPath, targetPath)
+		}
+		return os.Remove(linkPath)
+	}
+	targetInfo, err := os.Stat(targetPath)
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(linkInfo, targetInfo) {
+		return fmt.Errorf("%s is no longer a link to %s", linkPath, targetPath)
+	}
+	return os.Remove(linkPath)
+}
+
+func describeJournalEntry(entry JournalEntry) string {
+	switch entry.Op {
+	case journalOpMove:
+		return "#" + strconv.Itoa(entry.Seq) + " move " + entry.Source + " -> " + entry.Dest
+	case journalOpLink:
+		return "#" + strconv.Itoa(entry.Seq) + " link " + entry.Dest + " -> " + entry.Source
+	case journalOpCreate:
+		return "#" + strconv.Itoa(entry.Seq) + " create " + entry.Dest
+	case journalOpCreateLink:
+		return "#" + strconv.Itoa(entry.Seq) + " createlink " + entry.Dest + " -> " + entry.Source
+	case journalOpMkdir:
+		return "#" + strconv.Itoa(entry.Seq) + " mkdir " + entry.Dest
+	case journalOpRmdir:
+		return "#" + strconv.Itoa(entry.Seq) + " rmdir " + entry.Source
+	}
+	return "#" + strconv.Itoa(entry.Seq) + " " + entry.Op
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestFileMover returns a FileMover journaling to a new journal in the given directory, hashing moves if specified, and the journal.
+func newTestFileMover(t *testing.T, dirPath string, isMoveHashed bool) (*FileMover, *UndoJournal) {
+	journal, err := OpenUndoJournal(filepath.Join(dirPath, "undo.jsonl"), isMoveHashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { journal.Close() })
+	return NewFileMover(false, journal), journal
+}
+
+func writeTestFile(t *testing.T, filePath string, content string) {
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertFileContent(t *testing.T, filePath string, expected string) {
+	t.Helper()
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != expected {
+		t.Errorf("%s has content %q, expected %q", filePath, content, expected)
+	}
+}
+
+func assertMissing(t *testing.T, filePath string) {
+	t.Helper()
+	if _, err := os.Lstat(filePath); !os.IsNotExist(err) {
+		t.Errorf("%s exists, expected it to be missing", filePath)
+	}
+}
+
+func TestUndoReversesOperations(t *testing.T) {
+	dirPath := t.TempDir()
+	incomingPath := filepath.Join(dirPath, "in", "a.jpg")
+	copyPath := filepath.Join(dirPath, "in", "copy.jpg")
+	writeTestFile(t, incomingPath, "photo")
+	writeTestFile(t, copyPath, "photo")
+	modTime := time.Date(2019, 7, 10, 14, 24, 19, 0, time.UTC)
+	if err := os.Chtimes(copyPath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	fileMover, journal := newTestFileMover(t, dirPath, true)
+
+	sortedPath, err := fileMover.MoveFileWithRename(incomingPath, filepath.Join(dirPath, "lib", "2019", "a.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	createdPath, err := fileMover.CreateFile(filepath.Join(dirPath, "lib", "2019", "a.jpg.xmp"), strings.NewReader("xmp"), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fileMover.LinkFile(copyPath, sortedPath, false); err != nil {
+		t.Fatal(err)
+	}
+	linkPath, err := fileMover.CreateLink(filepath.Join(dirPath, "lib", "favorites", "a.jpg"), sortedPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertMissing(t, incomingPath)
+	assertFileContent(t, linkPath, "photo")
+
+	if err := journal.Undo(false); err != nil {
+		t.Fatal(err)
+	}
+	assertFileContent(t, incomingPath, "photo")
+	assertFileContent(t, copyPath, "photo")
+	assertMissing(t, sortedPath)
+	assertMissing(t, createdPath)
+	assertMissing(t, linkPath)
+	assertMissing(t, filepath.Join(dirPath, "lib"))
+	copyInfo, err := os.Stat(copyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !copyInfo.ModTime().Equal(modTime) {
+		t.Errorf("unlinked copy has modification time %v, expected %v", copyInfo.ModTime(), modTime)
+	}
+	if copyInfo.Sys() != nil {
+		incomingInfo, _ := os.Stat(incomingPath)
+		if os.SameFile(copyInfo, incomingInfo) {
+			t.Error("unlinked copy is still linked")
+		}
+	}
+
+	// Undoing again finds nothing left to do.
+	if err := journal.Undo(false); err != nil {
+		t.Fatal(err)
+	}
+	assertFileContent(t, incomingPath, "photo")
+}
+
+func TestUndoKeepsChangedFiles(t *testing.T) {
+	dirPath := t.TempDir()
+	incomingPath := filepath.Join(dirPath, "in", "a.jpg")
+	writeTestFile(t, incomingPath, "photo")
+	fileMover, journal := newTestFileMover(t, dirPath, true)
+
+	sortedPath, err := fileMover.MoveFileWithRename(incomingPath, filepath.Join(dirPath, "lib", "a.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	createdPath, err := fileMover.CreateFile(filepath.Join(dirPath, "lib", "b.xmp"), strings.NewReader("xmp"), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, sortedPath, "edited photo")
+	writeTestFile(t, createdPath, "edited xmp")
+
+	if err := journal.Undo(false); err == nil {
+		t.Fatal("expected an error for the changed files")
+	}
+	assertMissing(t, incomingPath)
+	assertFileContent(t, sortedPath, "edited photo")
+	assertFileContent(t, createdPath, "edited xmp")
+}
+
+// TestUndoDetectsInPlaceEdit checks that a file edited in place without changing its size or modification time is only moved back if moves weren't hashed.
+func TestUndoDetectsInPlaceEdit(t *testing.T) {
+	for _, isMoveHashed := range []bool{true, false} {
+		t.Run("hashed "+strconv.FormatBool(isMoveHashed), func(t *testing.T) {
+			dirPath := t.TempDir()
+			incomingPath := filepath.Join(dirPath, "in", "a.jpg")
+			writeTestFile(t, incomingPath, "photo")
+			fileMover, journal := newTestFileMover(t, dirPath, isMoveHashed)
+			sortedPath, err := fileMover.MoveFileWithRename(incomingPath, filepath.Join(dirPath, "lib", "a.jpg"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			fileInfo, err := os.Stat(sortedPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, sortedPath, "PHOTO")
+			if err := os.Chtimes(sortedPath, fileInfo.ModTime(), fileInfo.ModTime()); err != nil {
+				t.Fatal(err)
+			}
+
+			err = journal.Undo(false)
+			if isMoveHashed {
+				if err == nil {
+					t.Error("expected an error for the edited file")
+				}
+				assertMissing(t, incomingPath)
+				assertFileContent(t, sortedPath, "PHOTO")
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				assertFileContent(t, incomingPath, "PHOTO")
+			}
+		})
+	}
+}
+
+func TestUndoMoveVerification(t *testing.T) {
+	dirPath := t.TempDir()
+	filePath := filepath.Join(dirPath, "moved.jpg")
+	writeTestFile(t, filePath, "photo")
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := fileInfo.ModTime()
+	hash, err := hashFileSha256(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		entry    JournalEntry
+		isUndone bool
+	}{
+		{"unchanged", JournalEntry{Size: 5, ModTime: modTime.UnixNano()}, true},
+		{"coarse modification time", JournalEntry{Size: 5, ModTime: modTime.Add(time.Second).UnixNano()}, true},
+		{"different size", JournalEntry{Size: 6, ModTime: modTime.UnixNano()}, false},
+		{"different modification time", JournalEntry{Size: 5, ModTime: modTime.Add(time.Hour).UnixNano()}, false},
+		{"checksum", JournalEntry{Sha256: hex.EncodeToString(hash)}, true},
+		{"different checksum", JournalEntry{Sha256: "f3a2b0b3fd6e0d4dd4a2a1fa9a1b81e7c7b5a1a5b2d8a0b8e6b1f0a5e2d1c6b7"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writeTestFile(t, filePath, "photo")
+			os.Chtimes(filePath, modTime, modTime)
+			originalPath := filepath.Join(dirPath, "original.jpg")
+			os.Remove(originalPath)
+			entry := test.entry
+			entry.Op = journalOpMove
+			entry.Source = originalPath
+			entry.Dest = filePath
+			err := undoMove(entry)
+			if test.isUndone && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if !test.isUndone && err == nil {
+				t.Error("expected an error")
+			}
+			if _, statErr := os.Stat(originalPath); (statErr == nil) != test.isUndone {
+				t.Errorf("moved back = %v, expected %v", statErr == nil, test.isUndone)
+			}
+		})
+	}
+}
+
+func TestReadUndoJournalIgnoresTruncatedLine(t *testing.T) {
+	dirPath := t.TempDir()
+	journalPath := filepath.Join(dirPath, "undo.jsonl")
+	content := []byte(`{"seq":1,"op":"mkdir","dest":"/tmp/x"}` + "\n" + `{"seq":2,"op":"mo`)
+	if err := ioutil.WriteFile(journalPath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ReadUndoJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Op != journalOpMkdir {
+		t.Errorf("entries = %+v, expected the mkdir only", entries)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// appleCreationDateKey is the QuickTime metadata key under which Apple devices record the local capture time, including its offset.
+const appleCreationDateKey = "com.apple.quicktime.creationdate"
+
+// quickTimeEpoch is the origin of the timestamps in the "mvhd" and "tkhd" boxes.
+var quickTimeEpoch = time.Date(1904, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// appleCreationDateLayouts are the formats seen in the Apple creation date, e.g. "2019-07-10T14:24:19-0700".
+var appleCreationDateLayouts = []string{
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05.999999999-0700",
+	"2006-01-02T15:04:05.999999999Z07:00",
+}
+
+// extractVideoCreationTime reads the creation time from a QuickTime, MP4, or 3GP video container.  Prefers Apple's creation date (which retains the capture offset), then the movie header ("mvhd"), then the first track header ("tkhd").
+func extractVideoCreationTime(file *os.File) (CaptureTime, error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return CaptureTime{}, err
+	}
+	boxes, err := readIsoBoxes(file, 0, fileInfo.Size())
+	if err != nil && len(boxes) == 0 {
+		return CaptureTime{}, err
+	}
+	moovBox, isFound := findIsoBox(boxes, "moov")
+	if !isFound {
+		return CaptureTime{}, errors.New("no 'moov' box found in video file")
+	}
+	moovChildren, err := readIsoChildBoxes(file, moovBox, 0)
+	if err != nil && len(moovChildren) == 0 {
+		return CaptureTime{}, err
+	}
+
+	if metaBox, isFound := findIsoBox(moovChildren, "meta"); isFound {
+		creationDate, err := readAppleCreationDate(file, metaBox)
+		if err == nil {
+			log.Println("[DEBUG] Using", appleCreationDateKey, "from", file.Name())
+			return NewZonedCaptureTime(creationDate), nil
+		}
+		log.Println("[TRACE] No", appleCreationDateKey, "in", file.Name(), ":", err)
+	}
+
+	if mvhdBox, isFound := findIsoBox(moovChildren, "mvhd"); isFound {
+		creationTime, err := readQuickTimeHeaderCreationTime(file, mvhdBox)
+		if err == nil {
+			log.Println("[DEBUG] Using 'mvhd' creation time from", file.Name())
+			return NewInstantCaptureTime(creationTime), nil
+		}
+		log.Println("[TRACE] No 'mvhd' creation time in", file.Name(), ":", err)
+	}
+
+	if trakBox, isFound := findIsoBox(moovChildren, "trak"); isFound {
+		trakChildren, err := readIsoChildBoxes(file, trakBox, 0)
+		if tkhdBox, isFound := findIsoBox(trakChildren, "tkhd"); isFound {
+			creationTime, err := readQuickTimeHeaderCreationTime(file, tkhdBox)
+			if err == nil {
+				log.Println("[DEBUG] Using 'tkhd' creation time from", file.Name())
+				return NewInstantCaptureTime(creationTime), nil
+			}
+			log.Println("[TRACE] No 'tkhd' creation time in", file.Name(), ":", err)
+		} else if err != nil {
+			log.Println("[TRACE] Failed to read 'trak' box in", file.Name(), ":", err)
+		}
+	}
+
+	return CaptureTime{}, errors.New("no creation time found in video file")
+}
+
+// readQuickTimeHeaderCreationTime reads the creation time from a movie header ("mvhd") or track header ("tkhd") box.
+func readQuickTimeHeaderCreationTime(file *os.File, headerBox isoBox) (time.Time, error) {
+	if headerBox.size < 12 {
+		return time.Time{}, errors.New("'" + headerBox.boxType + "' box is too small")
+	}
+	payload, err := readIsoBoxPayload(file, isoBox{boxType: headerBox.boxType, offset: headerBox.offset, size: 12})
+	if err != nil {
+		return time.Time{}, err
+	}
+	// version, flags, then creation_time which is 32 bits for version 0 or 64 bits for version 1.
+	reader := isoReader{data: payload}
+	version := reader.readUint(1)
+	reader.readUint(3) // flags
+	var seconds uint64
+	if version == 1 {
+		seconds = reader.readUint(8)
+	} else {
+		seconds = reader.readUint(4)
+	}
+	if reader.err != nil {
+		return time.Time{}, reader.err
+	}
+	if seconds == 0 {
+		return time.Time{}, errors.New("creation time is not set")
+	}
+	return quickTimeEpoch.Add(time.Duration(seconds) * time.Second), nil
+}
+
+// readAppleCreationDate finds the Apple creation date in the "keys" and "ilst" boxes of the QuickTime "meta" box.
+func readAppleCreationDate(file *os.File, metaBox isoBox) (time.Time, error) {
+	// In QuickTime, "meta" is a plain box, while in ISO files it's a full box with version and flags.
+	skip := int64(4)
+	if metaBox.size >= 8 {
+		peek, err := readIsoBoxPayload(file, isoBox{boxType: "meta", offset: metaBox.offset, size: 8})
+		if err != nil {
+			return time.Time{}, err
+		}
+		if string(peek[4:8]) == "hdlr" {
+			skip = 0
+		}
+	}
+	metaChildren, err := readIsoChildBoxes(file, metaBox, skip)
+	if err != nil && len(metaChildren) == 0 {
+		return time.Time{}, err
+	}
+	keysBox, isFound := findIsoBox(metaChildren, "keys")
+	if !isFound {
+		return time.Time{}, errors.New("no 'keys' box found")
+	}
+	ilstBox, isFound := findIsoBox(metaChildren, "ilst")
+	if !isFound {
+		return time.Time{}, errors.New("no 'ilst' box found")
+	}
+
+	keysPayload, err := readIsoBoxPayload(file, keysBox)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyIndex, err := findQuickTimeKeyIndex(keysPayload, appleCreationDateKey)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// Items in "ilst" are typed by the 1-based index of their key.
+	itemBoxes, err := readIsoChildBoxes(file, ilstBox, 0)
+	if err != nil && len(itemBoxes) == 0 {
+		return time.Time{}, err
+	}
+	for _, itemBox := range itemBoxes {
+		if binary.BigEndian.Uint32([]byte(itemBox.boxType)) != keyIndex {
+			continue
+		}
+		dataBoxes, err := readIsoChildBoxes(file, itemBox, 0)
+		if err != nil && len(dataBoxes) == 0 {
+			return time.Time{}, err
+		}
+		dataBox, isFound := findIsoBox(dataBoxes, "data")
+		if !isFound || dataBox.size < 8 {
+			return time.Time{}, errors.New("no 'data' box found for " + appleCreationDateKey)
+		}
+		// type indicator and locale, then the value.
+		value, err := readIsoBoxPayload(file, isoBox{boxType: "data", offset: dataBox.offset + 8, size: dataBox.size - 8})
+		if err != nil {
+			return time.Time{}, err
+		}
+		return parseAppleCreationDate(string(value))
+	}
+	return time.Time{}, errors.New("no value found for " + appleCreationDateKey)
+}
+
+// findQuickTimeKeyIndex returns the 1-based index of the given key in the payload of the "keys" box.
+func findQuickTimeKeyIndex(payload []byte, key string) (uint32, error) {
+	reader := isoReader{data: payload}
+	reader.readUint(4) // version and flags
+	entryCount := reader.readUint(4)
+	for i := uint64(1); i <= entryCount && reader.err == nil; i++ {
+		keySize := int(reader.readUint(4))
+		reader.readString(4) // key_namespace
+		if keySize < 8 {
+			return 0, errors.New("invalid key size in 'keys' box")
+		}
+		if reader.readString(keySize-8) == key {
+			return uint32(i), nil
+		}
+	}
+	if reader.err != nil {
+		return 0, reader.err
+	}
+	return 0, errors.New("no key '" + key + "' found")
+}
+
+func parseAppleCreationDate(value string) (time.Time, error) {
+	value = strings.TrimRight(value, "\x00")
+	var err error
+	for _, layout := range appleCreationDateLayouts {
+		var result time.Time
+		result, err = time.Parse(layout, value)
+		if err == nil {
+			return result, nil
+		}
+	}
+	return time.Time{}, err
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// newTestHeaderBox encodes a movie or track header box with the given creation time, in seconds since 1904, using 64-bit times if specified.
+func newTestHeaderBox(boxType string, seconds uint64, is64Bit bool) []byte {
+	if is64Bit {
+		return isoTestBox(boxType, []byte{1, 0, 0, 0}, isoTestUint(seconds, 8), isoTestUint(seconds, 8), isoTestUint(0, 8))
+	}
+	return isoTestBox(boxType, isoTestUint(0, 4), isoTestUint(seconds, 4), isoTestUint(seconds, 4), isoTestUint(0, 8))
+}
+
+// newTestQuickTimeKeys encodes the payload of a "keys" box holding the given keys.
+func newTestQuickTimeKeys(keys ...string) []byte {
+	result := append(isoTestUint(0, 4), isoTestUint(uint64(len(keys)), 4)...)
+	for _, key := range keys {
+		result = append(result, isoTestUint(uint64(8+len(key)), 4)...)
+		result = append(result, "mdta"...)
+		result = append(result, key...)
+	}
+	return result
+}
+
+// newTestAppleMeta encodes a QuickTime "meta" box holding the Apple creation date.
+func newTestAppleMeta(creationDate string) []byte {
+	return newTestAppleMetaWithData(false, append(isoTestUint(1, 4), append(isoTestUint(0, 4), creationDate...)...))
+}
+
+// newTestAppleMetaWithData encodes a "meta" box holding the given payload of the "data" box of the Apple creation date, as an ISO full box (with version and flags) if specified.
+func newTestAppleMetaWithData(isFullBox bool, creationDateData []byte) []byte {
+	hdlr := isoTestBox("hdlr", isoTestUint(0, 8), []byte("mdta"), make([]byte, 12), []byte{0})
+	keys := isoTestBox("keys", newTestQuickTimeKeys("com.apple.quicktime.make", appleCreationDateKey))
+	ilst := isoTestBox("ilst",
+		isoTestBox(string(isoTestUint(1, 4)), isoTestBox("data", isoTestUint(1, 4), isoTestUint(0, 4), []byte("Apple"))),
+		isoTestBox(string(isoTestUint(2, 4)), isoTestBox("data", creationDateData)),
+	)
+	if isFullBox {
+		return isoTestBox("meta", isoTestUint(0, 4), hdlr, keys, ilst)
+	}
+	return isoTestBox("meta", hdlr, keys, ilst)
+}
+
+func TestExtractVideoCreationTime(t *testing.T) {
+	ftyp := isoTestBox("ftyp", []byte("qt  "), isoTestUint(0, 4), []byte("qt  "))
+	instant := time.Date(2019, 7, 10, 21, 24, 19, 0, time.UTC)
+	seconds := uint64(instant.Sub(quickTimeEpoch) / time.Second)
+	zoned := time.Date(2019, 7, 10, 14, 24, 19, 0, time.FixedZone("", -7*60*60))
+	movieHeader := newTestHeaderBox("mvhd", seconds, false)
+	largeMoov := append(append(isoTestUint(1, 4), "moov"...), isoTestUint(uint64(16+len(movieHeader)), 8)...)
+	largeMoov = append(largeMoov, movieHeader...)
+	tests := []struct {
+		name     string
+		moov     []byte
+		expected CaptureTime
+	}{
+		{"Apple creation date", isoTestBox("moov", newTestHeaderBox("mvhd", seconds+60, false), newTestAppleMeta("2019-07-10T14:24:19-0700")), NewZonedCaptureTime(zoned)},
+		{"Apple creation date in an ISO meta box", isoTestBox("moov", newTestAppleMetaWithData(true, append(isoTestUint(1, 4), append(isoTestUint(0, 4), "2019-07-10T14:24:19-0700"...)...))), NewZonedCaptureTime(zoned)},
+		{"movie header", isoTestBox("moov", movieHeader), NewInstantCaptureTime(instant)},
+		{"64-bit movie header", isoTestBox("moov", newTestHeaderBox("mvhd", seconds, true)), NewInstantCaptureTime(instant)},
+		{"64-bit moov size", largeMoov, NewInstantCaptureTime(instant)},
+		{"malformed Apple creation date", isoTestBox("moov", newTestAppleMeta("yesterday"), movieHeader), NewInstantCaptureTime(instant)},
+		{"truncated Apple creation date data", isoTestBox("moov", newTestAppleMetaWithData(false, isoTestUint(1, 4)), movieHeader), NewInstantCaptureTime(instant)},
+		{"track header", isoTestBox("moov", newTestHeaderBox("mvhd", 0, false), isoTestBox("trak", newTestHeaderBox("tkhd", seconds, false))), NewInstantCaptureTime(instant)},
+		{"undersized movie header", isoTestBox("moov", isoTestBox("mvhd", isoTestUint(0, 4)), isoTestBox("trak", newTestHeaderBox("tkhd", seconds, false))), NewInstantCaptureTime(instant)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := openIsoTestFile(t, bytes.Join([][]byte{ftyp, test.moov, isoTestBox("mdat", []byte("video"))}, nil))
+			captureTime, err := extractVideoCreationTime(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if captureTime.Kind != test.expected.Kind || !captureTime.Time.Equal(test.expected.Time) {
+				t.Errorf("extractVideoCreationTime = %+v, expected %+v", captureTime, test.expected)
+			}
+			if _, offset := captureTime.Time.Zone(); test.expected.Kind == CaptureTimeZoned && offset != -7*60*60 {
+				t.Errorf("offset = %d, expected the recorded offset", offset)
+			}
+		})
+	}
+
+	truncatedMoov := isoTestBox("moov", movieHeader)
+	truncatedMoov = append(isoTestUint(uint64(len(truncatedMoov)+100), 4), truncatedMoov[4:]...)
+	for name, moov := range map[string][]byte{
+		"no moov":                        isoTestBox("free"),
+		"no creation time":               isoTestBox("moov", newTestHeaderBox("mvhd", 0, false)),
+		"moov beyond the end":            truncatedMoov,
+		"mvhd beyond the moov":           isoTestBox("moov", movieHeader[:len(movieHeader)-4]),
+		"no creation time in any header": isoTestBox("moov", newTestHeaderBox("mvhd", 0, true), isoTestBox("trak", newTestHeaderBox("tkhd", 0, true))),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := extractVideoCreationTime(openIsoTestFile(t, append(append([]byte(nil), ftyp...), moov...))); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestReadQuickTimeHeaderCreationTime(t *testing.T) {
+	instant := time.Date(2019, 7, 10, 21, 24, 19, 0, time.UTC)
+	seconds := uint64(instant.Sub(quickTimeEpoch) / time.Second)
+	// Beyond 2040, the time no longer fits in 32 bits.
+	lateInstant := time.Date(2041, 3, 1, 12, 0, 0, 0, time.UTC)
+	lateSeconds := uint64(lateInstant.Sub(quickTimeEpoch) / time.Second)
+	tests := []struct {
+		name     string
+		box      []byte
+		expected time.Time
+		isError  bool
+	}{
+		{"version 0", newTestHeaderBox("mvhd", seconds, false), instant, false},
+		{"version 1", newTestHeaderBox("mvhd", seconds, true), instant, false},
+		{"version 1 beyond 32 bits", newTestHeaderBox("tkhd", lateSeconds, true), lateInstant, false},
+		{"version 0 not set", newTestHeaderBox("mvhd", 0, false), time.Time{}, true},
+		{"version 1 not set", newTestHeaderBox("mvhd", 0, true), time.Time{}, true},
+		{"too small", isoTestBox("mvhd", isoTestUint(0, 4), isoTestUint(seconds, 4)), time.Time{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := openIsoTestFile(t, test.box)
+			boxes, err := readIsoBoxes(file, 0, int64(len(test.box)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			creationTime, err := readQuickTimeHeaderCreationTime(file, boxes[0])
+			if (err != nil) != test.isError {
+				t.Fatalf("error = %v, expected an error %v", err, test.isError)
+			}
+			if !creationTime.Equal(test.expected) {
+				t.Errorf("readQuickTimeHeaderCreationTime = %v, expected %v", creationTime, test.expected)
+			}
+		})
+	}
+}
+
+func TestFindQuickTimeKeyIndex(t *testing.T) {
+	keys := newTestQuickTimeKeys("com.apple.quicktime.make", appleCreationDateKey)
+	tests := []struct {
+		name     string
+		payload  []byte
+		expected uint32
+		isError  bool
+	}{
+		{"first key", newTestQuickTimeKeys(appleCreationDateKey), 1, false},
+		{"later key", keys, 2, false},
+		{"missing key", newTestQuickTimeKeys("com.apple.quicktime.make"), 0, true},
+		{"no keys", newTestQuickTimeKeys(), 0, true},
+		{"key size smaller than its header", append(append(isoTestUint(0, 4), isoTestUint(1, 4)...), append(isoTestUint(4, 4), "mdta"...)...), 0, true},
+		{"fewer keys than counted", append(append(isoTestUint(0, 4), isoTestUint(3, 4)...), keys[8:8+8+len("com.apple.quicktime.make")]...), 0, true},
+		{"truncated key", keys[:len(keys)-4], 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			index, err := findQuickTimeKeyIndex(test.payload, appleCreationDateKey)
+			if (err != nil) != test.isError {
+				t.Fatalf("error = %v, expected an error %v", err, test.isError)
+			}
+			if index != test.expected {
+				t.Errorf("findQuickTimeKeyIndex = %d, expected %d", index, test.expected)
+			}
+		})
+	}
+}
+
+func TestParseAppleCreationDate(t *testing.T) {
+	pacific := time.FixedZone("", -7*60*60)
+	tests := []struct {
+		value    string
+		expected time.Time
+		isError  bool
+	}{
+		{"2019-07-10T14:24:19-0700", time.Date(2019, 7, 10, 14, 24, 19, 0, pacific), false},
+		{"2019-07-10T14:24:19-07:00", time.Date(2019, 7, 10, 14, 24, 19, 0, pacific), false},
+		{"2019-07-10T21:24:19Z", time.Date(2019, 7, 10, 21, 24, 19, 0, time.UTC), false},
+		{"2019-07-10T14:24:19.250-0700", time.Date(2019, 7, 10, 14, 24, 19, 250000000, pacific), false},
+		{"2019-07-10T14:24:19-0700\x00\x00", time.Date(2019, 7, 10, 14, 24, 19, 0, pacific), false},
+		{"2019-07-10T14:24:19", time.Time{}, true},
+		{"", time.Time{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			result, err := parseAppleCreationDate(test.value)
+			if (err != nil) != test.isError {
+				t.Fatalf("error = %v, expected an error %v", err, test.isError)
+			}
+			if !result.Equal(test.expected) {
+				t.Errorf("parseAppleCreationDate = %v, expected %v", result, test.expected)
+			}
+			_, offset := result.Zone()
+			_, expectedOffset := test.expected.Zone()
+			if offset != expectedOffset {
+				t.Errorf("offset = %d, expected %d", offset, expectedOffset)
+			}
+		})
+	}
+}
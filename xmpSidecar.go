@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// xmpSidecarExtension is appended to the name of a media file for its XMP sidecar, e.g. IMG_1234.jpg.xmp, so that a photo and the video of a live photo don't share one.
+const xmpSidecarExtension = ".xmp"
+
+// xmpLocalDateLayout is the form of an XMP date without an offset, which is local time.
+const xmpLocalDateLayout = "2006-01-02T15:04:05"
+
+// renderXmpSidecar renders the Google metadata as an XMP packet, or returns nil if there is nothing to write.  The description, location, people, and favorite flag are written to the standard properties read by photo managers.  The date is the capture time by which the file was filed, in the form read by the "xmp" date source: local time, with its offset unless that isn't known, as in EXIF.
+func renderXmpSidecar(metadata *GooglePhotoMetadata, dateTimeOriginal time.Time, hasOffset bool) []byte {
+	var properties bytes.Buffer
+	if len(metadata.Description) > 0 {
+		properties.WriteString("   <dc:description>\n    <rdf:Alt>\n     <rdf:li xml:lang=\"x-default\">" + escapeXML(metadata.Description) + "</rdf:li>\n    </rdf:Alt>\n   </dc:description>\n")
+	}
+	if !dateTimeOriginal.IsZero() {
+		layout := xmpLocalDateLayout
+		if hasOffset {
+			layout = time.RFC3339
+		}
+		properties.WriteString("   <exif:DateTimeOriginal>" + dateTimeOriginal.Format(layout) + "</exif:DateTimeOriginal>\n")
+	}
+	geoData := metadata.GeoData
+	if geoData == nil {
+		geoData = metadata.GeoDataExif
+	}
+	if geoData != nil {
+		properties.WriteString("   <exif:GPSVersionID>2.2.0.0</exif:GPSVersionID>\n")
+		properties.WriteString("   <exif:GPSLatitude>" + formatXmpCoordinate(geoData.Latitude, "N", "S") + "</exif:GPSLatitude>\n")
+		properties.WriteString("   <exif:GPSLongitude>" + formatXmpCoordinate(geoData.Longitude, "E", "W") + "</exif:GPSLongitude>\n")
+		if geoData.Altitude != 0 {
+			altitudeRef := "0" // above sea level
+			if geoData.Altitude < 0 {
+				altitudeRef = "1"
+			}
+			properties.WriteString("   <exif:GPSAltitudeRef>" + altitudeRef + "</exif:GPSAltitudeRef>\n")
+			properties.WriteString("   <exif:GPSAltitude>" + strconv.FormatInt(int64(math.Round(math.Abs(geoData.Altitude)*100)), 10) + "/100</exif:GPSAltitude>\n")
+		}
+	}
+	if metadata.IsFavorited {
+		properties.WriteString("   <xmp:Rating>5</xmp:Rating>\n")
+	}
+	if len(metadata.People) > 0 {
+		// Google doesn't export where the faces are, so the regions have names but no areas.
+		properties.WriteString("   <mwg-rs:Regions rdf:parseType=\"Resource\">\n    <mwg-rs:RegionList>\n     <rdf:Bag>\n")
+		for _, person := range metadata.People {
+			properties.WriteString("      <rdf:li rdf:parseType=\"Resource\">\n       <mwg-rs:Name>" + escapeXML(person) + "</mwg-rs:Name>\n       <mwg-rs:Type>Face</mwg-rs:Type>\n      </rdf:li>\n")
+		}
+		properties.WriteString("     </rdf:Bag>\n    </mwg-rs:RegionList>\n   </mwg-rs:Regions>\n")
+		properties.WriteString("   <Iptc4xmpExt:PersonInImage>\n    <rdf:Bag>\n")
+		for _, person := range metadata.People {
+			properties.WriteString("     <rdf:li>" + escapeXML(person) + "</rdf:li>\n")
+		}
+		properties.WriteString("    </rdf:Bag>\n   </Iptc4xmpExt:PersonInImage>\n")
+	}
+	if properties.Len() == 0 {
+		return nil
+	}
+
+	var result bytes.Buffer
+	result.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	result.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\" x:xmptk=\"picsort " + version + "\">\n")
+	result.WriteString(" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	result.WriteString("  <rdf:Description rdf:about=\"\"\n")
+	result.WriteString("    xmlns:dc=\"http://purl.org/dc/elements/1.1/\"\n")
+	result.WriteString("    xmlns:exif=\"http://ns.adobe.com/exif/1.0/\"\n")
+	result.WriteString("    xmlns:xmp=\"http://ns.adobe.com/xap/1.0/\"\n")
+	result.WriteString("    xmlns:mwg-rs=\"http://www.metadataworkinggroup.com/schemas/regions/\"\n")
+	result.WriteString("    xmlns:Iptc4xmpExt=\"http://iptc.org/std/Iptc4xmpExt/2008-02-29/\">\n")
+	result.Write(properties.Bytes())
+	result.WriteString("  </rdf:Description>\n")
+	result.WriteString(" </rdf:RDF>\n")
+	result.WriteString("</x:xmpmeta>\n")
+	result.WriteString("<?xpacket end=\"w\"?>\n")
+	return result.Bytes()
+}
+
+// formatXmpCoordinate formats a latitude or longitude as an XMP GPSCoordinate, in degrees and decimal minutes, e.g. "40,26.766667N".
+func formatXmpCoordinate(value float64, positiveRef string, negativeRef string) string {
+	ref := positiveRef
+	if value < 0 {
+		ref = negativeRef
+	}
+	value = math.Abs(value)
+	degrees := math.Floor(value)
+	minutes := (value - degrees) * 60
+	return fmt.Sprintf("%d,%.6f%s", int(degrees), minutes, ref)
+}
+
+func escapeXML(value string) string {
+	var result bytes.Buffer
+	xml.EscapeText(&result, []byte(value))
+	return result.String()
+}
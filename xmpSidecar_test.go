@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderXmpSidecarDate(t *testing.T) {
+	pacific, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	// Google records when the photo was taken as an instant, here 14:24:19 in Los Angeles.
+	metadata := &GooglePhotoMetadata{PhotoTakenTime: time.Date(2019, 7, 10, 21, 24, 19, 0, time.UTC)}
+	tests := []struct {
+		name        string
+		captureTime CaptureTime
+		expected    string
+		kind        CaptureTimeKind
+	}{
+		{"instant", NewInstantCaptureTime(metadata.PhotoTakenTime), "2019-07-10T14:24:19-07:00", CaptureTimeZoned},
+		{"recorded offset", NewZonedCaptureTime(time.Date(2019, 7, 10, 16, 24, 19, 0, time.FixedZone("", -5*60*60))), "2019-07-10T16:24:19-05:00", CaptureTimeZoned},
+		{"local", NewLocalCaptureTime(time.Date(2019, 7, 10, 14, 24, 19, 0, time.UTC)), "2019-07-10T14:24:19", CaptureTimeLocal},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content := string(renderXmpSidecar(metadata, test.captureTime.Localize(pacific), test.captureTime.Kind != CaptureTimeLocal))
+			if !strings.Contains(content, "<exif:DateTimeOriginal>"+test.expected+"</exif:DateTimeOriginal>") {
+				t.Errorf("renderXmpSidecar = %s, expected the date %s", content, test.expected)
+			}
+			// The date reads back as the same capture time.
+			captureTime, err := parseXmpDate(content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if captureTime.Kind != test.kind || !captureTime.Localize(pacific).Equal(test.captureTime.Localize(pacific)) {
+				t.Errorf("parseXmpDate = %+v, expected %s", captureTime, test.expected)
+			}
+		})
+	}
+
+	if content := renderXmpSidecar(&GooglePhotoMetadata{}, time.Time{}, false); content != nil {
+		t.Errorf("renderXmpSidecar = %s, expected nothing to write", content)
+	}
+}